@@ -0,0 +1,88 @@
+package h2go
+
+import (
+	"crypto/x509"
+	"errors"
+	"net/netip"
+)
+
+// ErrForbidden is returned by Client.Connect when the server's ACL refuses
+// the requested destination.
+var ErrForbidden = errors.New("tunnel forbidden")
+
+// TunnelRequest describes a tunnel a client asks the server to open.
+type TunnelRequest struct {
+	// Client is the identity the tunnel is accounted to: the identity of
+	// the client certificate when one was presented, or else the user name,
+	// or else the client IP.
+	Client string
+
+	// User is the name of the server user the request was signed by, if
+	// any; see WithServerUser.
+	User string
+
+	// RemoteAddr is the network address of the client.
+	RemoteAddr string
+
+	// Certificate is the verified client certificate, if any.
+	Certificate *x509.Certificate
+
+	// Host and Port are the requested destination.
+	Host string
+	Port string
+
+	// Addrs are the addresses Host resolves to, in the order the server
+	// dials them; see WithResolver. The ACL is first consulted with Addrs
+	// empty, before Host is resolved, so that denied clients cause no
+	// lookups, and then again with Addrs. It stays empty for reverse
+	// tunnels and virtual endpoints.
+	Addrs []netip.Addr
+
+	// Source describes the connection the client tunnels, as reported by
+	// the client; see ConnectRequest. It is empty for clients that do not
+	// send it, and for reverse tunnels.
+	Source TunnelSource
+
+	// Reverse is set when the client asks the server to accept connections
+	// for it on Host and Port, or on the virtual endpoint named Host if Port
+	// is empty, instead of opening a tunnel; see Client.Listen. Tunnels to a
+	// virtual endpoint have Host set to its name followed by ".h2go".
+	Reverse bool
+}
+
+// TunnelSource is the metadata a client sends about the local connection
+// it tunnels. The server does not check it, beyond the request signature.
+type TunnelSource struct {
+	// Addr is the address of the application at the client.
+	Addr string
+
+	// Protocol is the protocol the application used to reach the client's
+	// local proxy, e.g. ProtocolSOCKS5 or ProtocolHTTP.
+	Protocol string
+
+	// Method is the HTTP method of HTTP proxy requests, "CONNECT" for
+	// tunnels.
+	Method string
+
+	// User is the user the application authenticated as at the local
+	// proxy, if any.
+	User string
+
+	// Metadata is the ConnectRequest.Metadata of the connection.
+	Metadata map[string]string
+}
+
+// ACL decides which tunnels the server may open.
+type ACL interface {
+	// Allow returns nil if the tunnel may be opened, or an error
+	// explaining why not.
+	Allow(req *TunnelRequest) error
+}
+
+// ACLFunc adapts an ordinary function to the ACL interface.
+type ACLFunc func(req *TunnelRequest) error
+
+// Allow calls f(req).
+func (f ACLFunc) Allow(req *TunnelRequest) error {
+	return f(req)
+}
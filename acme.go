@@ -0,0 +1,88 @@
+package h2go
+
+import (
+	"crypto/tls"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// acmeConfig holds the ACME settings of a ProxyServer.
+type acmeConfig struct {
+	domains     []string
+	email       string
+	cacheDir    string
+	directory   string
+	directoryCA string
+	httpAddr    string
+	manager     *autocert.Manager
+}
+
+// defaultACMECacheDir returns the directory ACME certificates and account
+// keys are cached in when none is configured.
+func defaultACMECacheDir() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "h2go-acme"
+	}
+	return filepath.Join(dir, "h2go", "acme")
+}
+
+// acmeManager returns the server's ACME certificate manager, creating it on
+// first use. It returns nil if ACME is not enabled.
+func (s *ProxyServer) acmeManager() (*autocert.Manager, error) {
+	if len(s.acme.domains) == 0 {
+		return nil, nil
+	}
+	if s.acme.manager != nil {
+		return s.acme.manager, nil
+	}
+
+	cacheDir := s.acme.cacheDir
+	if cacheDir == "" {
+		cacheDir = defaultACMECacheDir()
+	}
+	m := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(s.acme.domains...),
+		Cache:      autocert.DirCache(cacheDir),
+		Email:      s.acme.email,
+	}
+	if s.acme.directory != "" {
+		client := &acme.Client{DirectoryURL: s.acme.directory}
+		if s.acme.directoryCA != "" {
+			pool, err := loadCertPool(s.acme.directoryCA, false)
+			if err != nil {
+				return nil, err
+			}
+			client.HTTPClient = &http.Client{Transport: &http.Transport{
+				TLSClientConfig: &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12},
+			}}
+		}
+		m.Client = client
+	}
+
+	s.logger.Info("obtaining certificates with ACME",
+		"domains", s.acme.domains,
+		"cache", cacheDir)
+	s.acme.manager = m
+	return m, nil
+}
+
+// serveACMEChallenges answers ACME HTTP-01 challenges on the configured
+// address and redirects all other plain HTTP requests to HTTPS.
+func (s *ProxyServer) serveACMEChallenges(m *autocert.Manager) {
+	s.logger.Info("starting the acme http-01 challenge server",
+		"addr", s.acme.httpAddr)
+	server := &http.Server{
+		Addr:    s.acme.httpAddr,
+		Handler: m.HTTPHandler(nil),
+	}
+	if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		s.logger.Error("acme http-01 challenge server", "msg", err)
+	}
+}
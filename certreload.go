@@ -0,0 +1,178 @@
+package h2go
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// Defaults for certificate reloading.
+const (
+	defaultCertReloadInterval = 30 * time.Second
+	defaultCertExpiryWarning  = 14 * 24 * time.Hour
+	certExpiryCheckInterval   = 12 * time.Hour
+)
+
+// certPair is a certificate file and its private key file.
+type certPair struct {
+	certPath string
+	keyPath  string
+}
+
+// certLoader serves TLS certificates loaded from files, reloading them when
+// the files change or on request, and selecting one by SNI.
+type certLoader struct {
+	pairs         []certPair
+	expiryWarning time.Duration
+	logger        *slog.Logger
+
+	mu      sync.RWMutex
+	certs   []*tls.Certificate
+	modTime []time.Time
+}
+
+func newCertLoader(pairs []certPair, expiryWarning time.Duration, logger *slog.Logger) *certLoader {
+	return &certLoader{
+		pairs:         pairs,
+		expiryWarning: expiryWarning,
+		logger:        logger,
+	}
+}
+
+// modTime returns the latest modification time of the pair's files.
+func (p certPair) modTime() (time.Time, error) {
+	var latest time.Time
+	for _, path := range []string{p.certPath, p.keyPath} {
+		fi, err := os.Stat(path)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if fi.ModTime().After(latest) {
+			latest = fi.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// Reload loads all certificates from disk. If any of them fails to load,
+// the previously loaded certificates stay in use.
+func (l *certLoader) Reload() error {
+	certs := make([]*tls.Certificate, 0, len(l.pairs))
+	modTimes := make([]time.Time, 0, len(l.pairs))
+	for _, p := range l.pairs {
+		mt, err := p.modTime()
+		if err != nil {
+			return fmt.Errorf("error reading certificate: %w", err)
+		}
+		cert, err := tls.LoadX509KeyPair(p.certPath, p.keyPath)
+		if err != nil {
+			return fmt.Errorf("error loading certificate %s: %w", p.certPath, err)
+		}
+		certs = append(certs, &cert)
+		modTimes = append(modTimes, mt)
+	}
+
+	l.mu.Lock()
+	l.certs = certs
+	l.modTime = modTimes
+	l.mu.Unlock()
+
+	for i, cert := range certs {
+		l.logger.Info("loaded certificate",
+			"cert", l.pairs[i].certPath,
+			"expires", cert.Leaf.NotAfter)
+	}
+	l.checkExpiry()
+	return nil
+}
+
+// changed reports whether any certificate file was modified since the last
+// successful load.
+func (l *certLoader) changed() bool {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	for i, p := range l.pairs {
+		mt, err := p.modTime()
+		if err != nil {
+			// files are likely being replaced, try again later
+			continue
+		}
+		if i >= len(l.modTime) || !mt.Equal(l.modTime[i]) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkExpiry logs a warning for every certificate that expires within the
+// warning period.
+func (l *certLoader) checkExpiry() {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	for i, cert := range l.certs {
+		left := time.Until(cert.Leaf.NotAfter)
+		if left <= 0 {
+			l.logger.Error("certificate has expired",
+				"cert", l.pairs[i].certPath,
+				"expired", cert.Leaf.NotAfter)
+		} else if left < l.expiryWarning {
+			l.logger.Warn("certificate expires soon",
+				"cert", l.pairs[i].certPath,
+				"expires", cert.Leaf.NotAfter,
+				"left", left.Round(time.Minute))
+		}
+	}
+}
+
+// watch polls the certificate files every interval and reloads them when
+// they change. It also repeats the expiry check periodically. An interval of
+// 0 disables polling but keeps the expiry checks. It returns when done is
+// closed.
+func (l *certLoader) watch(done <-chan struct{}, interval time.Duration) {
+	poll := interval > 0
+	if !poll {
+		interval = certExpiryCheckInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	lastExpiryCheck := time.Now()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+		if poll && l.changed() {
+			if err := l.Reload(); err != nil {
+				l.logger.Error("error reloading certificates", "msg", err)
+			} else {
+				lastExpiryCheck = time.Now()
+			}
+		}
+		if time.Since(lastExpiryCheck) >= certExpiryCheckInterval {
+			l.checkExpiry()
+			lastExpiryCheck = time.Now()
+		}
+	}
+}
+
+// GetCertificate returns the first certificate valid for the client hello,
+// or the first certificate if none matches. It implements
+// tls.Config.GetCertificate.
+func (l *certLoader) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if len(l.certs) == 0 {
+		return nil, errors.New("no certificates loaded")
+	}
+	for _, cert := range l.certs {
+		if hello.SupportsCertificate(cert) == nil {
+			return cert, nil
+		}
+	}
+	return l.certs[0], nil
+}
@@ -0,0 +1,132 @@
+package h2go
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestCertLoaderReload(t *testing.T) {
+	ca := newTestCert(t, nil, "test-ca", 0)
+	first := newTestCert(t, ca, "first", x509.ExtKeyUsageServerAuth)
+	second := newTestCert(t, ca, "second", x509.ExtKeyUsageServerAuth)
+
+	l := newCertLoader([]certPair{{certPath: first.certPath, keyPath: first.keyPath}}, time.Hour, DefaultLogger())
+	if err := l.Reload(); err != nil {
+		t.Fatalf("Reload() error = %v", err)
+	}
+	if l.changed() {
+		t.Error("changed() = true right after loading")
+	}
+
+	// replace the files with another certificate
+	for src, dst := range map[string]string{second.certPath: first.certPath, second.keyPath: first.keyPath} {
+		data, err := os.ReadFile(src)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(dst, data, 0o600); err != nil {
+			t.Fatal(err)
+		}
+		future := time.Now().Add(time.Minute)
+		os.Chtimes(dst, future, future)
+	}
+	if !l.changed() {
+		t.Fatal("changed() = false after replacing the files")
+	}
+	if err := l.Reload(); err != nil {
+		t.Fatalf("Reload() error = %v", err)
+	}
+	cert, err := l.GetCertificate(&tls.ClientHelloInfo{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cert.Leaf.Subject.CommonName != "second" {
+		t.Errorf("serving %q, want %q", cert.Leaf.Subject.CommonName, "second")
+	}
+
+	// a broken pair keeps the previous certificate in use
+	if err := os.WriteFile(first.keyPath, []byte("garbage"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Reload(); err == nil {
+		t.Fatal("Reload() of a broken key succeeded")
+	}
+	if cert, _ := l.GetCertificate(&tls.ClientHelloInfo{}); cert.Leaf.Subject.CommonName != "second" {
+		t.Error("failed reload replaced the certificate")
+	}
+}
+
+func TestCertLoaderSNI(t *testing.T) {
+	ca := newTestCert(t, nil, "test-ca", 0)
+	a := newTestCert(t, ca, "a.example.com", x509.ExtKeyUsageServerAuth)
+	b := newTestCert(t, ca, "b.example.com", x509.ExtKeyUsageServerAuth)
+
+	l := newCertLoader([]certPair{
+		{certPath: a.certPath, keyPath: a.keyPath},
+		{certPath: b.certPath, keyPath: b.keyPath},
+	}, time.Hour, DefaultLogger())
+	if err := l.Reload(); err != nil {
+		t.Fatalf("Reload() error = %v", err)
+	}
+
+	for sni, want := range map[string]string{
+		"b.example.com": "b.example.com",
+		"a.example.com": "a.example.com",
+		"unknown":       "a.example.com",
+	} {
+		cert, err := l.GetCertificate(&tls.ClientHelloInfo{
+			ServerName:        sni,
+			SupportedVersions: []uint16{tls.VersionTLS13},
+			SignatureSchemes:  []tls.SignatureScheme{tls.ECDSAWithP256AndSHA256},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := cert.Leaf.Subject.CommonName; got != want {
+			t.Errorf("GetCertificate(%q) = %q, want %q", sni, got, want)
+		}
+	}
+}
+
+func TestServerCertFiles(t *testing.T) {
+	ca := newTestCert(t, nil, "test-ca", 0)
+	pair := newTestCert(t, ca, "pair.example.com", x509.ExtKeyUsageServerAuth)
+	s := NewProxyServer(WithHTTPS(true), WithTLSCertPair(pair.certPath, pair.keyPath))
+
+	// a reload, e.g. on SIGHUP, may come before the server starts
+	reloaded := make(chan error, 1)
+	go func() { reloaded <- s.ReloadCertificates() }()
+	tlsConfig, err := s.newTLSConfig()
+	if err != nil {
+		t.Fatalf("newTLSConfig() error = %v", err)
+	}
+	if err := <-reloaded; err != nil {
+		t.Errorf("ReloadCertificates() error = %v", err)
+	}
+	if tlsConfig.GetCertificate == nil {
+		t.Fatal("pairs without WithTLSCert are not served")
+	}
+	cert, err := tlsConfig.GetCertificate(&tls.ClientHelloInfo{})
+	if err != nil || cert.Leaf.Subject.CommonName != "pair.example.com" {
+		t.Errorf("GetCertificate() = %v, want the pair", err)
+	}
+}
+
+func TestCertLoaderWatchStops(t *testing.T) {
+	l := newCertLoader(nil, time.Hour, DefaultLogger())
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		l.watch(done, time.Millisecond)
+		close(stopped)
+	}()
+	close(done)
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("watch() kept running after done was closed")
+	}
+}
@@ -1,30 +1,47 @@
 package h2go
 
 import (
+	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
+	"net"
 	"net/http"
 	"strings"
+	"sync/atomic"
 	"time"
 )
 
 // Client represents an HTTP/2 proxy client that can establish connections
 // through a remote proxy server. It implements the Connector interface.
 type Client struct {
-	serverURL     string
-	secret        string
-	interval      time.Duration
-	logger        *slog.Logger
-	httpClient    HTTPClient
-	authenticator Authenticator
+	serverURL      string
+	secret         string
+	user           string
+	interval       time.Duration
+	timeout        time.Duration
+	heartbeat      time.Duration
+	logger         *slog.Logger
+	httpClient     HTTPClient
+	authenticator  Authenticator
+	skewCorrection bool
+	clockOffset    atomic.Int64
+	caPath         string
+	certPath       string
+	keyPath        string
+	pins           []string
+	err            error
 }
 
-// Ensure Client implements the Connector and ProxyHandler interfaces.
+// Ensure Client implements the Connector, ContextDialer, ContextConnector
+// and ProxyHandler interfaces.
 var (
-	_ Connector    = (*Client)(nil)
-	_ ProxyHandler = (*Client)(nil)
+	_ Connector        = (*Client)(nil)
+	_ ContextDialer    = (*Client)(nil)
+	_ ContextConnector = (*Client)(nil)
+	_ ProxyHandler     = (*Client)(nil)
 )
 
 // NewClient creates a new proxy client with the given options.
@@ -38,7 +55,10 @@ var (
 //	)
 func NewClient(opts ...ClientOption) *Client {
 	c := &Client{
-		logger: DefaultLogger(),
+		logger:         DefaultLogger(),
+		timeout:        defaultTimeout,
+		heartbeat:      defaultHeartTTL / 2,
+		skewCorrection: true,
 	}
 
 	for _, opt := range opts {
@@ -47,7 +67,12 @@ func NewClient(opts ...ClientOption) *Client {
 
 	// Set default HTTP client if not provided
 	if c.httpClient == nil {
-		c.httpClient = newDefaultHTTPClient()
+		tlsConfig, err := c.newTLSConfig()
+		if err != nil {
+			c.logger.Error("invalid client TLS configuration", "err", err)
+			c.err = err
+		}
+		c.httpClient = newDefaultHTTPClient(tlsConfig)
 	}
 
 	// Set default authenticator if not provided
@@ -62,39 +87,88 @@ func NewClient(opts ...ClientOption) *Client {
 // The address should be in "host:port" format.
 // Returns an io.ReadWriteCloser that can be used for bidirectional communication.
 func (c *Client) Connect(addr string) (io.ReadWriteCloser, error) {
+	return c.ConnectContext(context.Background(), &ConnectRequest{Addr: addr})
+}
+
+// ConnectContext connects to req.Addr like Connect, with ctx bounding the
+// setup of the tunnel together with the client timeout. The metadata of
+// req is sent to the server, whose ACL and logs see it.
+func (c *Client) ConnectContext(ctx context.Context, req *ConnectRequest) (io.ReadWriteCloser, error) {
+	conn, err := c.dial(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
+// DialContext connects to addr through the proxy server. Only TCP networks
+// are supported. ctx bounds the setup of the tunnel, together with the
+// client timeout; once DialContext returns, canceling ctx has no effect on
+// the connection.
+//
+// Unlike Connect, the returned net.Conn supports deadlines and half-close
+// with CloseWrite. Its LocalAddr is the proxy server and its RemoteAddr is
+// addr.
+func (c *Client) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, &net.OpError{Op: "dial", Net: network, Err: net.UnknownNetworkError(network)}
+	}
+	conn, err := c.dial(ctx, &ConnectRequest{Addr: addr})
+	if err != nil {
+		return nil, err
+	}
+	return newTunnelConn(conn, tunnelAddr(conn.server), tunnelAddr(addr)), nil
+}
+
+// dial opens a tunnel to req.Addr.
+func (c *Client) dial(ctx context.Context, req *ConnectRequest) (*clientConnection, error) {
+	addr := req.Addr
+	if c.err != nil {
+		return nil, fmt.Errorf("client configuration: %w", c.err)
+	}
 	serverURL := strings.TrimSuffix(c.serverURL, "/")
 
-	conn := newClientConnection(
-		serverURL,
-		c.secret,
-		c.interval,
-		c.logger,
-		c.httpClient,
-		c.authenticator,
-	)
-
-	parts := strings.Split(addr, ":")
-	if len(parts) != 2 {
+	conn := newClientConnection(serverURL, c)
+
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
 		return nil, fmt.Errorf("invalid address format: %s", addr)
 	}
-	host, port := parts[0], parts[1]
 
-	uuid, err := conn.connect(host, port)
+	uuid, err := conn.connect(ctx, host, port, req)
+	var skew *clockSkewError
+	if errors.As(err, &skew) && c.skewCorrection {
+		c.logger.Warn("clock skew detected, retrying with server time",
+			"offset", skew.offset)
+		c.clockOffset.Store(int64(skew.offset))
+		uuid, err = conn.connect(ctx, host, port, req)
+	}
 	if err != nil {
 		return nil, fmt.Errorf("connect %s: %w", addr, err)
 	}
+	if err := c.open(conn, uuid); err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
+// open starts the data flow and heartbeats of the tunnel with the given id
+// on conn.
+func (c *Client) open(conn *clientConnection, uuid string) error {
 	conn.uuid = uuid
 
 	if c.interval == 0 {
 		if err := conn.pull(); err != nil {
-			return nil, err
+			return err
 		}
 	}
 
 	conn.close = make(chan bool)
 	go conn.alive()
 
-	return conn, nil
+	return nil
 }
 
 // Clean performs any cleanup operations.
@@ -107,10 +181,13 @@ func (c *Client) ServerURL() string {
 }
 
 // newDefaultHTTPClient creates a new HTTP client configured for HTTP/2.
-func newDefaultHTTPClient() *http.Client {
-	tlsConfig := &tls.Config{
-		MinVersion: tls.VersionTLS12,
-		NextProtos: []string{"h2", "http/1.1"},
+// A nil tlsConfig selects the default TLS settings.
+func newDefaultHTTPClient(tlsConfig *tls.Config) *http.Client {
+	if tlsConfig == nil {
+		tlsConfig = &tls.Config{
+			MinVersion: tls.VersionTLS12,
+			NextProtos: []string{"h2", "http/1.1"},
+		}
 	}
 	return &http.Client{Transport: configureHTTP2Transport(tlsConfig)}
 }
@@ -1,7 +1,10 @@
 package h2go
 
 import (
+	"context"
+	"errors"
 	"io"
+	"net"
 	"strings"
 	"testing"
 	"time"
@@ -128,6 +131,19 @@ func TestProxyServerOptions(t *testing.T) {
 	}
 }
 
+// TestNonPositiveDurations verifies that durations that would break the
+// client or server are ignored.
+func TestNonPositiveDurations(t *testing.T) {
+	server := NewProxyServer(WithDialTimeout(0), WithSignTTL(-time.Second), WithHeartbeatTTL(0))
+	if server.dialTimeout != defaultTimeout || server.signTTL != defaultSignTTL || server.heartTTL != defaultHeartTTL {
+		t.Errorf("durations = %v, %v, %v, want the defaults", server.dialTimeout, server.signTTL, server.heartTTL)
+	}
+	client := NewClient(WithRequestTimeout(0), WithHeartbeatInterval(-time.Second))
+	if client.timeout <= 0 || client.heartbeat <= 0 {
+		t.Errorf("client durations = %v, %v, want the defaults", client.timeout, client.heartbeat)
+	}
+}
+
 // TestLocalServerOptions verifies that NewLocalServer configures properly.
 func TestLocalServerOptions(t *testing.T) {
 	startProxyServer()
@@ -225,3 +241,148 @@ func TestAuthenticatorInterface(t *testing.T) {
 		t.Error("Verify() returned false for valid signature")
 	}
 }
+
+// TestClientClockSkewCorrection verifies that a client with a skewed clock
+// adopts the server time hint and retries.
+func TestClientClockSkewCorrection(t *testing.T) {
+	_, url := newTestProxyServer(t)
+
+	client := NewClient(
+		WithServerURL(url),
+		WithSecret(testSecret),
+		WithInterval(time.Millisecond*20),
+	)
+	client.clockOffset.Store(int64(time.Hour))
+
+	conn, err := client.Connect(strings.TrimPrefix(url, "http://"))
+	if err != nil {
+		t.Fatalf("Connect() error = %v", err)
+	}
+	conn.Close()
+
+	if offset := time.Duration(client.clockOffset.Load()); offset > time.Second*2 || offset < -time.Second*2 {
+		t.Errorf("clock offset = %v, want about 0", offset)
+	}
+}
+
+// TestClientClockSkewDetected verifies that skew is reported when automatic
+// correction is disabled.
+func TestClientClockSkewDetected(t *testing.T) {
+	_, url := newTestProxyServer(t)
+
+	client := NewClient(
+		WithServerURL(url),
+		WithSecret(testSecret),
+		WithClockSkewCorrection(false),
+	)
+	client.clockOffset.Store(int64(-time.Hour))
+
+	_, err := client.Connect(strings.TrimPrefix(url, "http://"))
+	if !errors.Is(err, ErrClockSkew) {
+		t.Fatalf("Connect() error = %v, want %v", err, ErrClockSkew)
+	}
+}
+
+// TestClientDialContext verifies the deadlines, addresses and half-close of
+// the connections returned by Client.DialContext.
+func TestClientDialContext(t *testing.T) {
+	echo := startEcho(t)
+	client := startReverseServer(t)
+
+	if _, err := client.DialContext(context.Background(), "udp", echo); err == nil {
+		t.Error("DialContext() accepted a udp network")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := client.DialContext(ctx, "tcp", echo); !errors.Is(err, context.Canceled) {
+		t.Errorf("DialContext() with a canceled context error = %v, want context.Canceled", err)
+	}
+
+	conn, err := client.DialContext(context.Background(), "tcp", echo)
+	if err != nil {
+		t.Fatalf("DialContext() error = %v", err)
+	}
+	defer conn.Close()
+	if got := conn.RemoteAddr().String(); got != echo {
+		t.Errorf("RemoteAddr() = %s, want %s", got, echo)
+	}
+	checkEcho(t, conn)
+
+	conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	var nerr net.Error
+	if _, err := conn.Read(make([]byte, 1)); !errors.As(err, &nerr) || !nerr.Timeout() {
+		t.Fatalf("Read() past the deadline error = %v, want a timeout", err)
+	}
+	conn.SetReadDeadline(time.Time{})
+	checkEcho(t, conn)
+
+	cw, ok := conn.(interface{ CloseWrite() error })
+	if !ok {
+		t.Fatal("DialContext() returned a conn without CloseWrite")
+	}
+	if _, err := conn.Write([]byte("bye")); err != nil {
+		t.Fatal(err)
+	}
+	if err := cw.CloseWrite(); err != nil {
+		t.Fatalf("CloseWrite() error = %v", err)
+	}
+	if _, err := conn.Write([]byte("more")); err == nil {
+		t.Error("Write() after CloseWrite succeeded")
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 3)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "bye" {
+		t.Errorf("read after CloseWrite = %q, %v, want bye", buf, err)
+	}
+
+	conn.Close()
+	if _, err := conn.Read(buf); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("Read() after Close error = %v, want net.ErrClosed", err)
+	}
+}
+
+// TestClientHalfClose verifies that the end of the data sent by the client
+// reaches the remote host while its reply still flows back, in both
+// transfer modes.
+func TestClientHalfClose(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				data, _ := io.ReadAll(conn)
+				conn.Write(append(data, " done"...))
+			}()
+		}
+	}()
+
+	for _, interval := range []time.Duration{0, 20 * time.Millisecond} {
+		client := startReverseServer(t)
+		client.interval = interval
+
+		conn, err := client.DialContext(context.Background(), "tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatalf("interval %v: DialContext() error = %v", interval, err)
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		if _, err := conn.Write([]byte("hello")); err != nil {
+			t.Fatal(err)
+		}
+		if err := conn.(interface{ CloseWrite() error }).CloseWrite(); err != nil {
+			t.Fatalf("interval %v: CloseWrite() error = %v", interval, err)
+		}
+		got, err := io.ReadAll(conn)
+		if err != nil || string(got) != "hello done" {
+			t.Errorf("interval %v: read %q, %v, want %q", interval, got, err, "hello done")
+		}
+		conn.Close()
+	}
+}
@@ -1,30 +1,136 @@
 package main
 
 import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/x509"
 	"crypto/x509/pkix"
 	"encoding/pem"
+	"errors"
+	"fmt"
 	"math/big"
 	"net"
 	"os"
 	"time"
+
+	"github.com/mosajjal/h2go"
+)
+
+// Supported key types.
+const (
+	keyTypeRSA     = "rsa"
+	keyTypeECDSA   = "ecdsa"
+	keyTypeEd25519 = "ed25519"
 )
 
 type CertConfig struct {
 	Domains    []string `koanf:"domains"`
+	CommonName string   `koanf:"cn"`
 	KeyFile    string   `koanf:"keyfile"`
 	CertFile   string   `koanf:"certfile"`
 	ValidDays  int      `koanf:"validdays"`
 	KeyBitSize int      `koanf:"keysize"`
+	KeyType    string   `koanf:"keytype"`
+	CA         bool     `koanf:"ca"`
+	Client     bool     `koanf:"client"`
+	CACertFile string   `koanf:"cacert"`
+	CAKeyFile  string   `koanf:"cakey"`
+	Force      bool     `koanf:"force"`
+}
+
+// generateKey creates a private key of the given type. bits only applies to
+// RSA keys.
+func generateKey(keyType string, bits int) (crypto.Signer, error) {
+	switch keyType {
+	case keyTypeRSA:
+		return rsa.GenerateKey(rand.Reader, bits)
+	case keyTypeECDSA:
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case keyTypeEd25519:
+		_, priv, err := ed25519.GenerateKey(rand.Reader)
+		return priv, err
+	}
+	return nil, fmt.Errorf("unknown key type %q, use rsa, ecdsa or ed25519", keyType)
+}
+
+// loadCA reads the certificate and private key of the CA used to sign.
+func loadCA(certFile, keyFile string) (*x509.Certificate, crypto.Signer, error) {
+	certPEM, err := os.ReadFile(certFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	block, _ := pem.Decode(certPEM)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, nil, fmt.Errorf("%s does not contain a PEM certificate", certFile)
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !cert.IsCA {
+		return nil, nil, fmt.Errorf("%s is not a CA certificate", certFile)
+	}
+
+	keyPEM, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	block, _ = pem.Decode(keyPEM)
+	if block == nil {
+		return nil, nil, fmt.Errorf("%s does not contain a PEM private key", keyFile)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, nil, err
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, nil, fmt.Errorf("%s does not contain a signing key", keyFile)
+	}
+	return cert, signer, nil
 }
 
-func generateCerts(conf CertConfig) error {
-	priv, err := rsa.GenerateKey(rand.Reader, conf.KeyBitSize)
+// writePEM writes a PEM block to path with the given permissions. Existing
+// files are only replaced if force is set.
+func writePEM(path string, block *pem.Block, perm os.FileMode, force bool) error {
+	flags := os.O_WRONLY | os.O_CREATE | os.O_EXCL
+	if force {
+		flags = os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	}
+	f, err := os.OpenFile(path, flags, perm)
 	if err != nil {
 		return err
 	}
+	defer f.Close()
+	// OpenFile leaves the permissions of replaced files unchanged
+	if err := f.Chmod(perm); err != nil {
+		return err
+	}
+	return pem.Encode(f, block)
+}
+
+// generateCerts writes a certificate and its key, and returns the SPKI pin
+// of the certificate. Depending on conf it creates a CA, or a server or
+// client certificate that is either self-signed or signed by a CA.
+func generateCerts(conf CertConfig) (string, error) {
+	if !conf.Force {
+		for _, path := range []string{conf.CertFile, conf.KeyFile} {
+			if _, err := os.Stat(path); err == nil {
+				return "", fmt.Errorf("%s already exists, use --force to overwrite it", path)
+			} else if !errors.Is(err, os.ErrNotExist) {
+				return "", err
+			}
+		}
+	}
+
+	priv, err := generateKey(conf.KeyType, conf.KeyBitSize)
+	if err != nil {
+		return "", err
+	}
 
 	notBefore := time.Now()
 	notAfter := notBefore.Add(time.Duration(conf.ValidDays) * 24 * time.Hour)
@@ -32,20 +138,38 @@ func generateCerts(conf CertConfig) error {
 	serialNumberLimit := new(big.Int).Lsh(big.NewInt(1), 128)
 	serialNumber, err := rand.Int(rand.Reader, serialNumberLimit)
 	if err != nil {
-		return err
+		return "", err
+	}
+
+	commonName := conf.CommonName
+	if commonName == "" && len(conf.Domains) > 0 {
+		commonName = conf.Domains[0]
 	}
 
 	template := x509.Certificate{
 		SerialNumber: serialNumber,
 		Subject: pkix.Name{
-			CommonName: conf.Domains[0],
+			CommonName: commonName,
 		},
 		NotBefore:             notBefore,
 		NotAfter:              notAfter,
-		KeyUsage:              x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
-		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		KeyUsage:              x509.KeyUsageDigitalSignature,
 		BasicConstraintsValid: true,
 	}
+	if _, ok := priv.(*rsa.PrivateKey); ok {
+		template.KeyUsage |= x509.KeyUsageKeyEncipherment
+	}
+
+	switch {
+	case conf.CA:
+		template.IsCA = true
+		template.MaxPathLenZero = true
+		template.KeyUsage |= x509.KeyUsageCertSign | x509.KeyUsageCRLSign
+	case conf.Client:
+		template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+	default:
+		template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+	}
 
 	for _, domain := range conf.Domains {
 		if ip := net.ParseIP(domain); ip != nil {
@@ -55,35 +179,37 @@ func generateCerts(conf CertConfig) error {
 		}
 	}
 
-	derBytes, err := x509.CreateCertificate(rand.Reader, &template, &template, &priv.PublicKey, priv)
-	if err != nil {
-		return err
+	parent, signer := &template, priv
+	if conf.CACertFile != "" {
+		parent, signer, err = loadCA(conf.CACertFile, conf.CAKeyFile)
+		if err != nil {
+			return "", fmt.Errorf("error loading CA: %w", err)
+		}
 	}
 
-	certOut, err := os.Create(conf.CertFile)
+	derBytes, err := x509.CreateCertificate(rand.Reader, &template, parent, priv.Public(), signer)
 	if err != nil {
-		return err
+		return "", err
 	}
-	defer certOut.Close()
 
-	if err := pem.Encode(certOut, &pem.Block{Type: "CERTIFICATE", Bytes: derBytes}); err != nil {
-		return err
-	}
-
-	keyOut, err := os.Create(conf.KeyFile)
+	privBytes, err := x509.MarshalPKCS8PrivateKey(priv)
 	if err != nil {
-		return err
+		return "", err
 	}
-	defer keyOut.Close()
 
-	privBytes, err := x509.MarshalPKCS8PrivateKey(priv)
-	if err != nil {
-		return err
+	if err := writePEM(conf.KeyFile, &pem.Block{Type: "PRIVATE KEY", Bytes: privBytes}, 0o600, conf.Force); err != nil {
+		return "", err
 	}
 
-	if err := pem.Encode(keyOut, &pem.Block{Type: "PRIVATE KEY", Bytes: privBytes}); err != nil {
-		return err
+	if err := writePEM(conf.CertFile, &pem.Block{Type: "CERTIFICATE", Bytes: derBytes}, 0o644, conf.Force); err != nil {
+		// a key without its certificate would block the next run
+		os.Remove(conf.KeyFile)
+		return "", err
 	}
 
-	return nil
+	cert, err := x509.ParseCertificate(derBytes)
+	if err != nil {
+		return "", err
+	}
+	return h2go.SPKIPin(cert), nil
 }
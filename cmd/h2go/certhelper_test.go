@@ -0,0 +1,102 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mosajjal/h2go"
+)
+
+// genCert runs gencert with conf, writing name.pem and name.key to dir.
+func genCert(t *testing.T, dir, name string, conf CertConfig) CertConfig {
+	t.Helper()
+	conf.CertFile = filepath.Join(dir, name+".pem")
+	conf.KeyFile = filepath.Join(dir, name+".key")
+	conf.ValidDays = 1
+	conf.KeyBitSize = 2048
+	if _, err := generateCerts(conf); err != nil {
+		t.Fatalf("generating %s: %v", name, err)
+	}
+	return conf
+}
+
+func TestGenerateCertsMutualTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca := genCert(t, dir, "ca", CertConfig{CommonName: "h2go test CA", KeyType: keyTypeECDSA, CA: true})
+	server := genCert(t, dir, "server", CertConfig{
+		Domains: []string{"127.0.0.1"}, KeyType: keyTypeRSA,
+		CACertFile: ca.CertFile, CAKeyFile: ca.KeyFile,
+	})
+	client := genCert(t, dir, "client", CertConfig{
+		CommonName: "device-1", KeyType: keyTypeEd25519, Client: true,
+		CACertFile: ca.CertFile, CAKeyFile: ca.KeyFile,
+	})
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	identity := make(chan string, 1)
+	p := h2go.NewProxyServer(
+		h2go.WithListenAddr(addr),
+		h2go.WithHTTPS(true),
+		h2go.WithTLSCert(server.CertFile),
+		h2go.WithTLSKey(server.KeyFile),
+		h2go.WithClientCA(ca.CertFile),
+		h2go.WithClientCertAuth(true),
+		h2go.WithACL(h2go.ACLFunc(func(req *h2go.TunnelRequest) error {
+			if len(req.Addrs) == 0 { // the first, name-based check
+				identity <- req.Client
+			}
+			return nil
+		})),
+	)
+	go p.ListenAndServe()
+	for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+		if conn, err := net.Dial("tcp", addr); err == nil {
+			conn.Close()
+			break
+		}
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("server did not start")
+		}
+	}
+
+	c := h2go.NewClient(
+		h2go.WithServerURL("https://"+addr),
+		h2go.WithServerCA(ca.CertFile),
+		h2go.WithClientCertificate(client.CertFile, client.KeyFile),
+	)
+	conn, err := c.Connect(addr)
+	if err != nil {
+		t.Fatalf("Connect() with the issued client certificate error = %v", err)
+	}
+	conn.Close()
+	if got := <-identity; got != "device-1" {
+		t.Errorf("identity = %q, want %q", got, "device-1")
+	}
+}
+
+func TestGenerateCertsKeepsNoOrphanKey(t *testing.T) {
+	dir := t.TempDir()
+	conf := CertConfig{
+		CommonName: "server",
+		KeyType:    keyTypeECDSA,
+		ValidDays:  1,
+		KeyFile:    filepath.Join(dir, "server.key"),
+		CertFile:   filepath.Join(dir, "missing", "server.pem"),
+	}
+	if _, err := generateCerts(conf); err == nil {
+		t.Fatal("generateCerts() into a missing directory succeeded")
+	}
+	if _, err := os.Stat(conf.KeyFile); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("key file left behind: %v", err)
+	}
+}
@@ -7,20 +7,31 @@ The client mode sets up an HTTP/2 client that connects to a remote server
 and can optionally use a certificate for secure communication.
 it exposes a combo http and socks5 proxy server to localhost
 
+The forward mode forwards local ports to fixed destinations through the
+server, like ssh -L: "h2go forward -L 127.0.0.1:5432:db.internal:5432", and
+exposes local services through servers that allow reverse tunnels, like
+ssh -R: "h2go forward -R 0.0.0.0:8080:localhost:3000".
+
 The server mode sets up an HTTP/2 server that can optionally use HTTPS for
 secure communication and acts as a proxy server.
 
-The configuration can be provided via command-line flags or environment
-variables prefixed with "H2GO_". The configuration is unmarshaled into a
-Config struct.
+The configuration can be provided via a YAML, TOML or JSON file given with
+--config, environment variables prefixed with "H2GO_" and command-line flags,
+in increasing order of precedence. The flags of each mode map to the keys of
+the client or server section of the file, which can additionally define
+multiple listeners, upstreams, routing rules and users. The configuration is
+unmarshaled into an h2go.Config struct.
+
+"h2go config check --config <file>" validates a configuration file.
 */
 package main
 
 import (
 	"fmt"
 	"os"
+	"os/signal"
 	"strings"
-	"time"
+	"syscall"
 
 	"github.com/knadh/koanf/providers/env"
 	"github.com/knadh/koanf/providers/posflag"
@@ -36,135 +47,334 @@ var (
 
 var log = h2go.DefaultLogger()
 
-// Config holds all configuration
-type Config struct {
-	Version  bool          `koanf:"version"`
-	Addr     string        `koanf:"addr"`
-	Secret   string        `koanf:"secret"`
-	Cert     string        `koanf:"cert"`
-	RAddr    string        `koanf:"raddr"`
-	Interval time.Duration `koanf:"interval"`
-	HTTPS    bool          `koanf:"https"`
-	Key      string        `koanf:"key"`
-}
-
 func main() {
 	if len(os.Args) < 2 {
-		fmt.Println("Usage: h2go <client|server|gencert> [flags]")
+		fmt.Println("Usage: h2go <client|server|forward|gencert|config check> [flags]")
 		os.Exit(1)
 	}
 
 	mode := os.Args[1]
-	if mode != "client" && mode != "server" && mode != "gencert" {
-		fmt.Println("First argument must be either 'client', 'server' or 'gencert'")
+	if mode != "client" && mode != "server" && mode != "forward" && mode != "gencert" && mode != "config" {
+		fmt.Println("First argument must be either 'client', 'server', 'forward', 'gencert' or 'config'")
 		os.Exit(1)
 	}
+	args := os.Args[2:]
+	if mode == "config" {
+		if len(args) == 0 || args[0] != "check" {
+			fmt.Println("Usage: h2go config check --config <file>")
+			os.Exit(1)
+		}
+		args = args[1:]
+	}
 
 	k := koanf.New(".")
 	flags := pflag.NewFlagSet("config", pflag.ContinueOnError)
 
-	// Define flags based on mode
+	// Define flags based on mode, with the defaults of the library
+	defaults := h2go.DefaultConfig()
 	switch mode {
 	case "client":
-		flags.Bool("version", false, "version")
-		flags.String("addr", "127.0.0.1:1080", "listen addr")
-		flags.String("secret", "", "secret key")
-		flags.String("cert", "", "cert file")
-		flags.String("raddr", "", "remote http url(e.g, https://example.com)")
-		flags.Duration("interval", 0, "interval of pulling, 0 means use http chunked")
+		upstreamFlags(flags, defaults.Client)
+		flags.String("addr", defaults.Client.Addr, "listen addr")
+		flags.Bool("disablesocks5", false, "disable the socks5 proxy")
+		flags.Bool("disablehttp", false, "disable the http proxy")
+		flags.Bool("disablehttpconnect", false, "disable the CONNECT method of the http proxy")
+		flags.Bool("tls", false, "serve the local proxy over TLS (https:// proxy URLs), with a self-signed certificate unless --tlscert is set")
+		flags.String("tlscert", "", "certificate file of the local proxy, implies --tls")
+		flags.String("tlskey", "", "private key file of the local proxy")
+		flags.Usage = func() {
+			fmt.Fprintf(os.Stderr, "Usage of h2go client:\n%s\n"+
+				"HTTP/2 clients of the local proxy can use extended CONNECT (RFC 8441, e.g. WebSocket\n"+
+				"over HTTP/2) only when h2go runs with GODEBUG=http2xconnect=1 in its environment.\n",
+				flags.FlagUsages())
+		}
+	case "forward":
+		upstreamFlags(flags, defaults.Client)
+		flags.StringArrayP("local", "L", []string{}, "forward [bind_address:]port:host:hostport through the server. can be multiple")
+		flags.StringArrayP("remote", "R", []string{}, "expose host:hostport on the server at [bind_address:]port, or at a virtual endpoint name. can be multiple")
 	case "server":
 		flags.Bool("version", false, "version")
+		flags.String("config", "", "config file (.yaml, .toml or .json)")
 		flags.String("addr", "", "listen addr")
 		flags.String("secret", "", "secret key")
 		flags.String("cert", "", "cert file")
 		flags.Bool("https", false, "enable https")
 		flags.String("key", "", "private key file")
+		flags.StringArray("certpair", []string{}, "additional cert,key file pair selected by SNI. can be multiple")
+		flags.Duration("certreload", defaults.Server.CertReload, "interval of checking cert files for changes, 0 disables (SIGHUP still reloads)")
+		flags.Duration("certwarn", defaults.Server.CertWarn, "warn when a certificate expires within this period")
+		flags.String("clientca", "", "CA bundle to require and verify client certificates against")
+		flags.Bool("certauth", false, "accept a verified client certificate in place of the secret")
+		flags.StringArray("acmedomain", []string{}, "obtain certificates for this domain with ACME, implies --https. can be multiple")
+		flags.String("acmeemail", "", "contact email for the ACME account")
+		flags.String("acmecache", "", "directory to cache ACME certificates in")
+		flags.String("acmedirectory", "", "ACME directory URL, defaults to Let's Encrypt")
+		flags.String("acmedirectoryca", "", "CA file to trust for the ACME directory (e.g. Pebble)")
+		flags.String("acmehttp", "", "listen addr for ACME HTTP-01 challenges (e.g. :80)")
+		flags.Duration("dialtimeout", defaults.Server.DialTimeout, "timeout of dialing tunnel destinations")
+		flags.Duration("signttl", defaults.Server.SignTTL, "max age of a request signature")
+		flags.Duration("clockskew", defaults.Server.ClockSkew, "tolerated difference between client and server clocks")
+		flags.Duration("heartttl", defaults.Server.HeartTTL, "close tunnels without a heartbeat for this long")
+		flags.Duration("idletimeout", 0, "close tunnels without data for this long, 0 disables")
+		flags.Duration("maxlifetime", 0, "close tunnels open for this long, 0 disables")
+		flags.String("auth", h2go.AuthHMACSHA1, "request authenticator, hmac-sha1 or hmac-sha256. must match the clients")
+		flags.Int("maxtunnels", 0, "max concurrent tunnels, 0 means no limit")
+		flags.Int("maxtunnelsperclient", 0, "max concurrent tunnels per client, 0 means no limit")
+		flags.Float64("connectrate", 0, "max tunnels opened per second per client, 0 means no limit")
+		flags.Int("connectburst", 1, "burst of tunnels allowed above connectrate")
+		flags.Bool("reverse", false, "allow clients to register reverse tunnels (h2go forward -R)")
+		flags.StringArray("dns", []string{}, "DNS server resolving destinations: ip[:port], udp://, tcp://, tls:// (DoT) or https:// (DoH) URL. can be multiple")
+		flags.String("hosts", "", "hosts file overriding the resolution of destinations")
+		flags.String("dnsprefer", "", "dial ipv4 or ipv6 addresses first, or only ipv4only or ipv6only")
+		flags.Bool("blockprivate", false, "refuse destinations resolving to private, loopback or link-local addresses")
+		flags.String("loglevel", "", "log level: debug, info, warn or error. defaults to H2GO_LOG_LEVEL or info")
+	case "config":
+		flags.String("config", "", "config file (.yaml, .toml or .json)")
 	case "gencert":
 		flags.StringArray("domain", []string{}, "domain or IP address. can be multiple")
 		flags.String("keyfile", "key.pem", "output private key file")
 		flags.String("certfile", "cert.pem", "output certificate file")
 		flags.Int("validdays", 390, "certificate validity in days")
 		flags.Int("keysize", 2048, "RSA key size in bits")
+		flags.String("keytype", "rsa", "key type: rsa, ecdsa (P-256) or ed25519")
+		flags.String("cn", "", "subject common name, defaults to the first domain. identifies clients for mutual TLS")
+		flags.Bool("ca", false, "create a CA certificate to sign server and client certificates with")
+		flags.Bool("client", false, "create a client certificate for mutual TLS")
+		flags.String("cacert", "", "CA certificate to sign with, instead of self-signing")
+		flags.String("cakey", "", "CA private key to sign with")
+		flags.Bool("force", false, "overwrite existing files")
 	}
 
-	if err := flags.Parse(os.Args[2:]); err != nil {
+	if err := flags.Parse(args); err != nil {
 		log.Error("error parsing flags", "err", err)
 		os.Exit(1)
 	}
 
+	configPath, _ := flags.GetString("config")
+	if configPath == "" {
+		configPath = os.Getenv("H2GO_CONFIG")
+	}
+	if mode == "config" {
+		if configPath == "" {
+			log.Error("--config is required")
+			os.Exit(1)
+		}
+		if err := checkConfig(configPath); err != nil {
+			log.Error("invalid config", "err", err)
+			os.Exit(1)
+		}
+		fmt.Printf("%s: ok\n", configPath)
+		return
+	}
+
+	// the keys of the client and server modes live in their own section,
+	// as in the config file; forward shares the client section
+	section := func(key string) string {
+		switch {
+		case mode == "gencert" || key == "version":
+			return key
+		case mode == "forward":
+			return "client." + key
+		}
+		return mode + "." + key
+	}
+
+	// Load the config file
+	if configPath != "" && mode != "gencert" {
+		kf, err := loadConfigFile(configPath)
+		if err != nil {
+			log.Error("error loading config", "err", err)
+			os.Exit(1)
+		}
+		if err := k.Merge(kf); err != nil {
+			log.Error("error loading config", "err", err)
+			os.Exit(1)
+		}
+	}
+
 	// Load environment variables
 	if err := k.Load(env.Provider("H2GO_", ".", func(s string) string {
-		return strings.Replace(strings.ToLower(strings.TrimPrefix(s, "H2GO_")), "_", ".", -1)
+		return section(strings.Replace(strings.ToLower(strings.TrimPrefix(s, "H2GO_")), "_", ".", -1))
 	}), nil); err != nil {
 		log.Error("error loading env", "err", err)
 		os.Exit(1)
 	}
 
 	// Load flags
-	if err := k.Load(posflag.Provider(flags, ".", k), nil); err != nil {
+	if err := k.Load(posflag.ProviderWithFlag(flags, ".", k, func(f *pflag.Flag) (string, interface{}) {
+		if f.Name == "config" {
+			return "", nil
+		}
+		return section(f.Name), posflag.FlagVal(flags, f)
+	}), nil); err != nil {
 		log.Error("error loading flags", "err", err)
 		os.Exit(1)
 	}
 
-	var conf Config
-	if err := k.Unmarshal("", &conf); err != nil {
-		log.Error("error unmarshaling config", "err", err)
-		os.Exit(1)
+	if level := k.String(section("loglevel")); level != "" {
+		log = h2go.NewLogger(level)
 	}
 
-	if conf.Version {
+	if k.Bool("version") {
 		fmt.Printf("h2go %s (%s)\n", version, commit)
 		os.Exit(0)
 	}
 
 	switch mode {
 	case "client":
+		var conf h2go.ClientConfig
+		if err := k.Unmarshal("client", &conf); err != nil {
+			log.Error("error unmarshaling config", "err", err)
+			os.Exit(1)
+		}
+		runClient(conf)
+	case "forward":
+		var conf h2go.ClientConfig
+		if err := k.Unmarshal("client", &conf); err != nil {
+			log.Error("error unmarshaling config", "err", err)
+			os.Exit(1)
+		}
+		locals, remotes := k.Strings("client.local"), k.Strings("client.remote")
+		if len(locals) == 0 && len(remotes) == 0 {
+			log.Error("at least one -L or -R forwarding is required")
+			os.Exit(1)
+		}
+		conf.Addr = ""
+		conf.Listeners = nil
+		for _, spec := range locals {
+			l, err := h2go.ParseForward(spec)
+			if err != nil {
+				log.Error("error parsing flags", "err", err)
+				os.Exit(1)
+			}
+			conf.Listeners = append(conf.Listeners, h2go.ListenerConfig{
+				Addr:     l.Addr,
+				Protocol: l.Protocol,
+				Target:   l.Target,
+			})
+		}
+		conf.Reverse = nil
+		for _, spec := range remotes {
+			r, err := h2go.ParseReverse(spec)
+			if err != nil {
+				log.Error("error parsing flags", "err", err)
+				os.Exit(1)
+			}
+			conf.Reverse = append(conf.Reverse, h2go.ReverseConfig{Addr: r.Addr, Target: r.Target})
+		}
 		runClient(conf)
 	case "server":
+		var conf h2go.ServerConfig
+		if err := k.Unmarshal("server", &conf); err != nil {
+			log.Error("error unmarshaling config", "err", err)
+			os.Exit(1)
+		}
 		runServer(conf)
 	case "gencert":
 		certConf := CertConfig{
 			Domains:    k.Strings("domain"),
+			CommonName: k.String("cn"),
 			KeyFile:    k.String("keyfile"),
 			CertFile:   k.String("certfile"),
 			ValidDays:  k.Int("validdays"),
 			KeyBitSize: k.Int("keysize"),
+			KeyType:    k.String("keytype"),
+			CA:         k.Bool("ca"),
+			Client:     k.Bool("client"),
+			CACertFile: k.String("cacert"),
+			CAKeyFile:  k.String("cakey"),
+			Force:      k.Bool("force"),
 		}
-		if len(certConf.Domains) == 0 {
+		switch {
+		case certConf.CA && certConf.Client:
+			log.Error("--ca and --client are mutually exclusive")
+			os.Exit(1)
+		case certConf.CA && certConf.CommonName == "":
+			certConf.CommonName = "h2go CA"
+		case certConf.Client && certConf.CommonName == "" && len(certConf.Domains) == 0:
+			log.Error("cn is required for client certificates")
+			os.Exit(1)
+		case !certConf.CA && !certConf.Client && len(certConf.Domains) == 0:
 			log.Error("domain is required")
 			os.Exit(1)
 		}
-		if err := generateCerts(certConf); err != nil {
+		if (certConf.CACertFile == "") != (certConf.CAKeyFile == "") {
+			log.Error("--cacert and --cakey must be used together")
+			os.Exit(1)
+		}
+		pin, err := generateCerts(certConf)
+		if err != nil {
 			log.Error("failed to generate certificates", "err", err)
 			os.Exit(1)
 		}
 		log.Info("certificates generated successfully",
 			"cert", certConf.CertFile,
 			"key", certConf.KeyFile)
+		fmt.Printf("pin: %s\n", pin)
 	}
 }
 
-func runClient(conf Config) {
-	if conf.Cert != "" {
-		h2go.Init(log, conf.Cert)
-	}
+// upstreamFlags defines the flags of the modes that connect to a server.
+func upstreamFlags(flags *pflag.FlagSet, defaults h2go.ClientConfig) {
+	flags.Bool("version", false, "version")
+	flags.String("config", "", "config file (.yaml, .toml or .json)")
+	flags.String("secret", "", "secret key")
+	flags.String("cert", "", "cert file")
+	flags.String("raddr", "", "remote http url(e.g, https://example.com)")
+	flags.String("user", "", "server user to authenticate as, with that user's secret")
+	flags.Duration("interval", 0, "interval of pulling, 0 means use http chunked")
+	flags.StringArray("pin", []string{}, "accept only a server whose certificate or issuing CA has this SPKI SHA-256 pin. can be multiple")
+	flags.String("clientcert", "", "client certificate file for mutual TLS")
+	flags.String("clientkey", "", "client private key file for mutual TLS")
+	flags.Duration("timeout", defaults.Timeout, "timeout of requests to the server")
+	flags.Duration("heartbeat", defaults.Heartbeat, "interval of tunnel heartbeats, must be below the server's heartttl")
+	flags.String("auth", h2go.AuthHMACSHA1, "request authenticator, hmac-sha1 or hmac-sha256. must match the server")
+	flags.Bool("disableskewcorrection", false, "do not adopt the server time when rejected for clock skew")
+	flags.String("loglevel", "", "log level: debug, info, warn or error. defaults to H2GO_LOG_LEVEL or info")
+}
 
-	s := h2go.Server{
-		Addr:   conf.Addr,
-		Logger: log,
+// checkConfig loads and validates the config file at path.
+func checkConfig(path string) error {
+	kf, err := loadConfigFile(path)
+	if err != nil {
+		return err
 	}
+	if !kf.Exists("client") && !kf.Exists("server") {
+		return fmt.Errorf("%s: neither a client nor a server section found", path)
+	}
+	var fc h2go.Config
+	if err := kf.Unmarshal("", &fc); err != nil {
+		return err
+	}
+	if kf.Exists("client") {
+		if err := fc.Client.Validate(); err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	if kf.Exists("server") {
+		if err := fc.Server.Validate(); err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	return nil
+}
 
-	handler := h2go.NewHandler(conf.RAddr, conf.Secret, conf.Interval, log)
-
-	s.HTTPHandler = handler
-	s.Socks5Handler = handler
+func runClient(conf h2go.ClientConfig) {
+	s, err := conf.NewLocalServer()
+	if err != nil {
+		log.Error("invalid config", "err", err)
+		os.Exit(1)
+	}
 	log.Error("error", "msg", s.ListenAndServe())
 }
 
-func runServer(conf Config) {
-	p := h2go.NewHttpProxy(log, conf.Addr, conf.Secret, conf.HTTPS)
-
-	if conf.HTTPS {
+func runServer(conf h2go.ServerConfig) {
+	p, err := conf.NewProxyServer()
+	if err != nil {
+		log.Error("invalid config", "err", err)
+		os.Exit(1)
+	}
+	if conf.HTTPS && len(conf.ACMEDomains) == 0 {
 		for _, file := range []string{conf.Cert, conf.Key} {
 			f, err := os.Stat(file)
 			if err != nil {
@@ -176,8 +386,22 @@ func runServer(conf Config) {
 				return
 			}
 		}
-		p.ListenHTTPS(conf.Cert, conf.Key)
-	} else {
-		p.Listen()
+	}
+
+	if conf.HTTPS && len(conf.ACMEDomains) == 0 {
+		go reloadOnSIGHUP(p)
+	}
+	log.Error("error", "msg", p.ListenAndServe())
+}
+
+// reloadOnSIGHUP reloads the server certificates whenever SIGHUP is received.
+func reloadOnSIGHUP(p *h2go.ProxyServer) {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGHUP)
+	for range sig {
+		log.Info("reloading certificates")
+		if err := p.ReloadCertificates(); err != nil {
+			log.Error("error reloading certificates", "msg", err)
+		}
 	}
 }
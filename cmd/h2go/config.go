@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/go-viper/mapstructure/v2"
+	"github.com/knadh/koanf/parsers/json"
+	"github.com/knadh/koanf/parsers/toml/v2"
+	"github.com/knadh/koanf/parsers/yaml"
+	"github.com/knadh/koanf/providers/file"
+	"github.com/knadh/koanf/v2"
+	"github.com/mosajjal/h2go"
+)
+
+// loadConfigFile reads a YAML, TOML or JSON configuration file, picked by its
+// extension, and checks it for unknown keys and values of the wrong type.
+func loadConfigFile(path string) (*koanf.Koanf, error) {
+	var parser koanf.Parser
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		parser = yaml.Parser()
+	case ".toml":
+		parser = toml.Parser()
+	case ".json":
+		parser = json.Parser()
+	default:
+		return nil, fmt.Errorf("%s: unknown config format, use .yaml, .toml or .json", path)
+	}
+
+	kf := koanf.New(".")
+	if err := kf.Load(file.Provider(path), parser); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	var fc h2go.Config
+	if err := unmarshalStrict(kf, "", &fc); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return kf, nil
+}
+
+// unmarshalStrict decodes the config at path into out, failing on keys out
+// has no field for.
+func unmarshalStrict(k *koanf.Koanf, path string, out any) error {
+	return k.UnmarshalWithConf(path, out, koanf.UnmarshalConf{
+		Tag: "koanf",
+		DecoderConfig: &mapstructure.DecoderConfig{
+			DecodeHook: mapstructure.ComposeDecodeHookFunc(
+				mapstructure.StringToTimeDurationHookFunc(),
+				mapstructure.StringToSliceHookFunc(","),
+				mapstructure.TextUnmarshallerHookFunc()),
+			ErrorUnused:      true,
+			WeaklyTypedInput: true,
+			TagName:          "koanf",
+			Result:           out,
+		},
+	})
+}
@@ -0,0 +1,773 @@
+package h2go
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Route targets besides upstream names.
+const (
+	viaDirect = "direct"
+	viaBlock  = "block"
+)
+
+// defaultUpstream names the upstream given by the flat client keys.
+const defaultUpstream = "default"
+
+// Config is the declarative configuration of the h2go client and server,
+// as read from configuration files by the h2go command. The koanf tags name
+// the keys of the file, which match the flags of the command. Start from
+// DefaultConfig to get the defaults of the h2go command and the library.
+type Config struct {
+	Client ClientConfig `koanf:"client"`
+	Server ServerConfig `koanf:"server"`
+}
+
+// UpstreamConfig describes an h2go server the client can tunnel through.
+// Zero Timeout and Heartbeat select the client defaults.
+type UpstreamConfig struct {
+	Name       string        `koanf:"name"`
+	RAddr      string        `koanf:"raddr"`
+	Secret     string        `koanf:"secret"`
+	User       string        `koanf:"user"`
+	Cert       string        `koanf:"cert"`
+	Pins       []string      `koanf:"pin"`
+	ClientCert string        `koanf:"clientcert"`
+	ClientKey  string        `koanf:"clientkey"`
+	Interval   time.Duration `koanf:"interval"`
+	Timeout    time.Duration `koanf:"timeout"`
+	Heartbeat  time.Duration `koanf:"heartbeat"`
+
+	// Auth names the authenticator, see NewAuthenticator.
+	Auth                  string `koanf:"auth"`
+	DisableSkewCorrection bool   `koanf:"disableskewcorrection"`
+}
+
+// ListenerConfig describes a local proxy listener. Connections accepted on
+// it follow the routes, unless Upstream names a single route target.
+// Network is "tcp" or "unix" and Protocol is "auto", "socks5", "http",
+// "redirect", "tproxy" or "forward"; empty values select the first of each.
+// Forwarding listeners connect every connection to Target. TLS makes a
+// proxy listener accept TLS with the TLSCert and TLSKey files, which imply
+// it, or else a self-signed certificate.
+type ListenerConfig struct {
+	Addr     string            `koanf:"addr"`
+	Network  string            `koanf:"network"`
+	Protocol string            `koanf:"protocol"`
+	Sniff    bool              `koanf:"sniff"`
+	Target   string            `koanf:"target"`
+	Upstream string            `koanf:"upstream"`
+	Users    []LocalUserConfig `koanf:"users"`
+	TLS      bool              `koanf:"tls"`
+	TLSCert  string            `koanf:"tlscert"`
+	TLSKey   string            `koanf:"tlskey"`
+}
+
+// LocalUserConfig describes a user SOCKS5 and HTTP clients of a listener
+// must authenticate as.
+type LocalUserConfig struct {
+	Name     string `koanf:"name"`
+	Password string `koanf:"password"`
+}
+
+// ReverseConfig exposes the local service Target through an upstream,
+// which accepts connections for it on Addr; see Client.Listen. Upstream
+// defaults to the first upstream.
+type ReverseConfig struct {
+	Addr     string `koanf:"addr"`
+	Target   string `koanf:"target"`
+	Upstream string `koanf:"upstream"`
+}
+
+// RouteConfig sends destinations matching any of the Match patterns to Via,
+// which is an upstream name, "direct" or "block".
+type RouteConfig struct {
+	Match []string `koanf:"match"`
+	Via   string   `koanf:"via"`
+}
+
+// ClientConfig holds the client configuration. The upstream keys at the top
+// of the section define an upstream named "default" when raddr is set.
+type ClientConfig struct {
+	Addr           string `koanf:"addr"`
+	LogLevel       string `koanf:"loglevel"`
+	UpstreamConfig `koanf:",squash"`
+
+	DisableSocks5      bool `koanf:"disablesocks5"`
+	DisableHTTP        bool `koanf:"disablehttp"`
+	DisableHTTPConnect bool `koanf:"disablehttpconnect"`
+
+	// TLS, TLSCert and TLSKey configure TLS on Addr, as for a listener.
+	TLS     bool   `koanf:"tls"`
+	TLSCert string `koanf:"tlscert"`
+	TLSKey  string `koanf:"tlskey"`
+
+	Listeners []ListenerConfig `koanf:"listeners"`
+	Reverse   []ReverseConfig  `koanf:"reverse"`
+	Upstreams []UpstreamConfig `koanf:"upstreams"`
+	Routes    []RouteConfig    `koanf:"routes"`
+	Default   string           `koanf:"default"`
+}
+
+// ServerListenerConfig describes an address the server listens on.
+type ServerListenerConfig struct {
+	Addr string `koanf:"addr"`
+}
+
+// UserConfig describes a server user with its own secret. A non-empty Allow
+// restricts the user to destinations matching its patterns.
+type UserConfig struct {
+	Name   string   `koanf:"name"`
+	Secret string   `koanf:"secret"`
+	Allow  []string `koanf:"allow"`
+}
+
+// ServerConfig holds the server configuration. Zero DialTimeout, SignTTL
+// and HeartTTL select the server defaults; the other durations are used as
+// they are, with zero disabling the feature.
+type ServerConfig struct {
+	Addr        string        `koanf:"addr"`
+	LogLevel    string        `koanf:"loglevel"`
+	Secret      string        `koanf:"secret"`
+	Auth        string        `koanf:"auth"` // for the secret and all users
+	Cert        string        `koanf:"cert"`
+	HTTPS       bool          `koanf:"https"`
+	Key         string        `koanf:"key"`
+	DialTimeout time.Duration `koanf:"dialtimeout"`
+	SignTTL     time.Duration `koanf:"signttl"`
+	HeartTTL    time.Duration `koanf:"heartttl"`
+	IdleTimeout time.Duration `koanf:"idletimeout"`
+	MaxLifetime time.Duration `koanf:"maxlifetime"`
+	ClockSkew   time.Duration `koanf:"clockskew"`
+	ClientCA    string        `koanf:"clientca"`
+	CertAuth    bool          `koanf:"certauth"`
+	CertPairs   []string      `koanf:"certpair"`
+	CertReload  time.Duration `koanf:"certreload"`
+	CertWarn    time.Duration `koanf:"certwarn"`
+
+	ACMEDomains     []string `koanf:"acmedomain"`
+	ACMEEmail       string   `koanf:"acmeemail"`
+	ACMECache       string   `koanf:"acmecache"`
+	ACMEDirectory   string   `koanf:"acmedirectory"`
+	ACMEDirectoryCA string   `koanf:"acmedirectoryca"`
+	ACMEHTTP        string   `koanf:"acmehttp"`
+
+	Reverse bool `koanf:"reverse"` // allow reverse tunnels
+
+	// DNS servers resolve destinations instead of the system resolver, see
+	// NewDNSResolver, with the names in the Hosts file taking precedence.
+	DNS          []string `koanf:"dns"`
+	Hosts        string   `koanf:"hosts"`
+	DNSPrefer    string   `koanf:"dnsprefer"`
+	BlockPrivate bool     `koanf:"blockprivate"`
+
+	MaxTunnels          int     `koanf:"maxtunnels"`
+	MaxTunnelsPerClient int     `koanf:"maxtunnelsperclient"`
+	ConnectRate         float64 `koanf:"connectrate"`
+	ConnectBurst        int     `koanf:"connectburst"`
+
+	Listeners []ServerListenerConfig `koanf:"listeners"`
+	Users     []UserConfig           `koanf:"users"`
+}
+
+// ConfigError reports an invalid configuration value by its key, e.g.
+// "client.routes[1].via".
+type ConfigError struct {
+	Key string
+	Err error
+}
+
+func (e *ConfigError) Error() string {
+	return fmt.Sprintf("%s: %v", e.Key, e.Err)
+}
+
+func (e *ConfigError) Unwrap() error {
+	return e.Err
+}
+
+func keyErrorf(key, format string, args ...any) error {
+	return &ConfigError{Key: key, Err: fmt.Errorf(format, args...)}
+}
+
+// DefaultConfig returns a configuration with the default settings of the
+// client and server.
+func DefaultConfig() Config {
+	return Config{
+		Client: ClientConfig{
+			Addr: "127.0.0.1:1080",
+			UpstreamConfig: UpstreamConfig{
+				Timeout:   defaultTimeout,
+				Heartbeat: defaultHeartTTL / 2,
+			},
+		},
+		Server: ServerConfig{
+			DialTimeout: defaultTimeout,
+			SignTTL:     defaultSignTTL,
+			HeartTTL:    defaultHeartTTL,
+			ClockSkew:   defaultClockSkew,
+			CertReload:  defaultCertReloadInterval,
+			CertWarn:    defaultCertExpiryWarning,
+		},
+	}
+}
+
+// upstreams returns the configured upstreams, including the one defined by
+// the flat keys of the section.
+func (c *ClientConfig) upstreams() []UpstreamConfig {
+	if c.RAddr == "" {
+		return c.Upstreams
+	}
+	u := c.UpstreamConfig
+	if u.Name == "" {
+		u.Name = defaultUpstream
+	}
+	return append([]UpstreamConfig{u}, c.Upstreams...)
+}
+
+// listeners returns the configured listeners, or one on addr if there are
+// none and addr is set.
+func (c *ClientConfig) listeners() []ListenerConfig {
+	if len(c.Listeners) == 0 && c.Addr != "" {
+		return []ListenerConfig{{Addr: c.Addr, TLS: c.TLS, TLSCert: c.TLSCert, TLSKey: c.TLSKey}}
+	}
+	return c.Listeners
+}
+
+// defaultVia returns the target of destinations no route matches.
+func (c *ClientConfig) defaultVia() string {
+	if c.Default != "" {
+		return c.Default
+	}
+	if ups := c.upstreams(); len(ups) > 0 {
+		return ups[0].Name
+	}
+	return viaBlock
+}
+
+// validate checks the client section, naming the key of the first invalid
+// value found below prefix.
+func (c *ClientConfig) validate(prefix string) error {
+	names := map[string]bool{viaDirect: true, viaBlock: true}
+	addUpstream := func(key string, u UpstreamConfig) error {
+		if u.Name == "" {
+			return keyErrorf(key+".name", "missing")
+		}
+		if names[u.Name] {
+			return keyErrorf(key+".name", "%q is already in use", u.Name)
+		}
+		names[u.Name] = true
+		return u.validate(key)
+	}
+	if c.RAddr != "" {
+		// the flat keys live directly in the section
+		if err := addUpstream(prefix, c.upstreams()[0]); err != nil {
+			return err
+		}
+	}
+	for i, u := range c.Upstreams {
+		if err := addUpstream(fmt.Sprintf("%s.upstreams[%d]", prefix, i), u); err != nil {
+			return err
+		}
+	}
+	if len(names) == 2 && c.Default != viaDirect && c.Default != viaBlock {
+		return keyErrorf(prefix+".raddr", "missing, set it or add upstreams")
+	}
+
+	if (c.TLSCert == "") != (c.TLSKey == "") {
+		return keyErrorf(prefix+".tlskey", "tlscert and tlskey go together")
+	}
+	for i, l := range c.Listeners {
+		key := fmt.Sprintf("%s.listeners[%d]", prefix, i)
+		if l.Addr == "" {
+			return keyErrorf(key+".addr", "missing")
+		}
+		switch l.Network {
+		case "", "tcp", "unix":
+		default:
+			return keyErrorf(key+".network", "%q should be tcp or unix", l.Network)
+		}
+		switch l.Protocol {
+		case "", ProtocolAuto, ProtocolSOCKS5, ProtocolHTTP:
+			if l.Sniff {
+				return keyErrorf(key+".sniff", "only transparent listeners sniff")
+			}
+		case ProtocolRedirect, ProtocolTProxy:
+			if l.Network == "unix" {
+				return keyErrorf(key+".network", "transparent listeners need tcp")
+			}
+			if len(l.Users) > 0 {
+				return keyErrorf(key+".users", "transparent listeners do not authenticate")
+			}
+			if l.TLS || l.TLSCert != "" {
+				return keyErrorf(key+".tls", "transparent listeners do not use TLS")
+			}
+		case ProtocolForward:
+			if _, _, err := net.SplitHostPort(l.Target); err != nil {
+				return keyErrorf(key+".target", "%q should be host:port", l.Target)
+			}
+			if l.Sniff {
+				return keyErrorf(key+".sniff", "only transparent listeners sniff")
+			}
+			if len(l.Users) > 0 {
+				return keyErrorf(key+".users", "forwarding listeners do not authenticate")
+			}
+			if l.TLS || l.TLSCert != "" {
+				return keyErrorf(key+".tls", "forwarding listeners do not use TLS")
+			}
+		default:
+			return keyErrorf(key+".protocol", "%q should be auto, socks5, http, redirect, tproxy or forward", l.Protocol)
+		}
+		if (l.TLSCert == "") != (l.TLSKey == "") {
+			return keyErrorf(key+".tlskey", "tlscert and tlskey go together")
+		}
+		if l.Target != "" && l.Protocol != ProtocolForward {
+			return keyErrorf(key+".target", "only forwarding listeners have a target")
+		}
+		if l.Upstream != "" && !names[l.Upstream] {
+			return keyErrorf(key+".upstream", "unknown upstream %q", l.Upstream)
+		}
+		users := make(map[string]bool)
+		for j, u := range l.Users {
+			ukey := fmt.Sprintf("%s.users[%d]", key, j)
+			if u.Name == "" {
+				return keyErrorf(ukey+".name", "missing")
+			}
+			if len(u.Name) > 255 {
+				return keyErrorf(ukey+".name", "longer than 255 bytes")
+			}
+			if strings.Contains(u.Name, ":") {
+				return keyErrorf(ukey+".name", "contains a colon")
+			}
+			if users[u.Name] {
+				return keyErrorf(ukey+".name", "%q is already in use", u.Name)
+			}
+			users[u.Name] = true
+			if u.Password == "" {
+				return keyErrorf(ukey+".password", "missing")
+			}
+			if len(u.Password) > 255 {
+				return keyErrorf(ukey+".password", "longer than 255 bytes")
+			}
+		}
+	}
+	for i, r := range c.Reverse {
+		key := fmt.Sprintf("%s.reverse[%d]", prefix, i)
+		if r.Addr == "" {
+			return keyErrorf(key+".addr", "missing")
+		}
+		if !strings.Contains(r.Addr, ":") && !validEndpointName(r.Addr) {
+			return keyErrorf(key+".addr", "%q should be host:port or an endpoint name without dots other than localhost", r.Addr)
+		}
+		if _, _, err := net.SplitHostPort(r.Target); err != nil {
+			return keyErrorf(key+".target", "%q should be host:port", r.Target)
+		}
+		switch {
+		case r.Upstream == viaDirect || r.Upstream == viaBlock:
+			return keyErrorf(key+".upstream", "%q is not an upstream", r.Upstream)
+		case r.Upstream != "" && !names[r.Upstream]:
+			return keyErrorf(key+".upstream", "unknown upstream %q", r.Upstream)
+		case r.Upstream == "" && len(names) == 2:
+			return keyErrorf(key+".upstream", "missing, there are no upstreams")
+		}
+	}
+	for i, r := range c.Routes {
+		key := fmt.Sprintf("%s.routes[%d]", prefix, i)
+		if len(r.Match) == 0 {
+			return keyErrorf(key+".match", "missing")
+		}
+		for j, p := range r.Match {
+			if _, err := NewHostMatcher(p); err != nil {
+				return keyErrorf(fmt.Sprintf("%s.match[%d]", key, j), "%v", err)
+			}
+		}
+		if r.Via == "" {
+			return keyErrorf(key+".via", "missing")
+		}
+		if !names[r.Via] {
+			return keyErrorf(key+".via", "unknown upstream %q", r.Via)
+		}
+	}
+	if c.Default != "" && !names[c.Default] {
+		return keyErrorf(prefix+".default", "unknown upstream %q", c.Default)
+	}
+	return nil
+}
+
+func (u *UpstreamConfig) validate(key string) error {
+	if u.RAddr == "" {
+		return keyErrorf(key+".raddr", "missing")
+	}
+	if ru, err := url.Parse(u.RAddr); err != nil {
+		return keyErrorf(key+".raddr", "%v", err)
+	} else if ru.Scheme != "http" && ru.Scheme != "https" {
+		return keyErrorf(key+".raddr", "%q should start with http:// or https://", u.RAddr)
+	}
+	if (u.ClientCert == "") != (u.ClientKey == "") {
+		return keyErrorf(key+".clientcert", "clientcert and clientkey must be used together")
+	}
+	if _, err := NewAuthenticator(u.Auth, u.Secret); err != nil {
+		return keyErrorf(key+".auth", "%v", err)
+	}
+	for _, d := range []struct {
+		name string
+		v    time.Duration
+	}{{"interval", u.Interval}, {"timeout", u.Timeout}, {"heartbeat", u.Heartbeat}} {
+		if d.v < 0 {
+			return keyErrorf(key+"."+d.name, "must not be negative")
+		}
+	}
+	return nil
+}
+
+// validate checks the server section, naming the key of the first invalid
+// value found below prefix.
+func (c *ServerConfig) validate(prefix string) error {
+	for i, l := range c.Listeners {
+		if l.Addr == "" {
+			return keyErrorf(fmt.Sprintf("%s.listeners[%d].addr", prefix, i), "missing")
+		}
+	}
+	if c.HTTPS && len(c.ACMEDomains) == 0 {
+		if c.Cert == "" {
+			return keyErrorf(prefix+".cert", "missing, https needs a certificate or acmedomain")
+		}
+		if c.Key == "" {
+			return keyErrorf(prefix+".key", "missing, https needs a private key")
+		}
+	}
+	for i, pair := range c.CertPairs {
+		if _, _, ok := strings.Cut(pair, ","); !ok {
+			return keyErrorf(fmt.Sprintf("%s.certpair[%d]", prefix, i), "%q should be cert,key", pair)
+		}
+	}
+	for i, server := range c.DNS {
+		if _, err := parseDNSServer(server); err != nil {
+			return keyErrorf(fmt.Sprintf("%s.dns[%d]", prefix, i), "%v", err)
+		}
+	}
+	switch c.DNSPrefer {
+	case "", PreferIPv4, PreferIPv6, OnlyIPv4, OnlyIPv6:
+	default:
+		return keyErrorf(prefix+".dnsprefer", "%q should be ipv4, ipv6, ipv4only or ipv6only", c.DNSPrefer)
+	}
+	if c.CertAuth && c.ClientCA == "" {
+		return keyErrorf(prefix+".certauth", "requires clientca")
+	}
+	if _, err := NewAuthenticator(c.Auth, c.Secret); err != nil {
+		return keyErrorf(prefix+".auth", "%v", err)
+	}
+	for _, n := range []struct {
+		name string
+		v    float64
+	}{
+		{"maxtunnels", float64(c.MaxTunnels)}, {"maxtunnelsperclient", float64(c.MaxTunnelsPerClient)},
+		{"connectrate", c.ConnectRate}, {"connectburst", float64(c.ConnectBurst)},
+	} {
+		if n.v < 0 {
+			return keyErrorf(prefix+"."+n.name, "must not be negative")
+		}
+	}
+	for _, d := range []struct {
+		name string
+		v    time.Duration
+	}{
+		{"dialtimeout", c.DialTimeout}, {"signttl", c.SignTTL}, {"heartttl", c.HeartTTL},
+		{"idletimeout", c.IdleTimeout}, {"maxlifetime", c.MaxLifetime}, {"clockskew", c.ClockSkew},
+		{"certreload", c.CertReload}, {"certwarn", c.CertWarn},
+	} {
+		if d.v < 0 {
+			return keyErrorf(prefix+"."+d.name, "must not be negative")
+		}
+	}
+
+	names := make(map[string]bool)
+	for i, u := range c.Users {
+		key := fmt.Sprintf("%s.users[%d]", prefix, i)
+		if u.Name == "" {
+			return keyErrorf(key+".name", "missing")
+		}
+		if names[u.Name] {
+			return keyErrorf(key+".name", "%q is already in use", u.Name)
+		}
+		names[u.Name] = true
+		if u.Secret == "" {
+			return keyErrorf(key+".secret", "missing")
+		}
+		for j, p := range u.Allow {
+			if _, err := NewHostMatcher(p); err != nil {
+				return keyErrorf(fmt.Sprintf("%s.allow[%d]", key, j), "%v", err)
+			}
+		}
+	}
+	return nil
+}
+
+// configLogger returns the logger for the given level, or the default logger if
+// level is empty.
+func configLogger(level string) *slog.Logger {
+	if level == "" {
+		return DefaultLogger()
+	}
+	return NewLogger(level)
+}
+
+// Validate checks the client configuration, returning a *ConfigError for
+// the first invalid value found.
+func (c *ClientConfig) Validate() error {
+	return c.validate("client")
+}
+
+// Validate checks the server configuration, returning a *ConfigError for
+// the first invalid value found.
+func (c *ServerConfig) Validate() error {
+	return c.validate("server")
+}
+
+// NewClient creates a client for the upstream. Options in opts are applied
+// after the configured ones.
+func (u *UpstreamConfig) NewClient(opts ...ClientOption) *Client {
+	configured := []ClientOption{
+		WithServerURL(u.RAddr),
+		WithSecret(u.Secret),
+		WithUser(u.User),
+		WithInterval(u.Interval),
+	}
+	if u.Timeout > 0 {
+		configured = append(configured, WithRequestTimeout(u.Timeout))
+	}
+	if u.Heartbeat > 0 {
+		configured = append(configured, WithHeartbeatInterval(u.Heartbeat))
+	}
+	if u.Cert != "" {
+		configured = append(configured, WithServerCA(u.Cert))
+	}
+	if len(u.Pins) > 0 {
+		configured = append(configured, WithPinnedSPKI(u.Pins...))
+	}
+	if u.ClientCert != "" {
+		configured = append(configured, WithClientCertificate(u.ClientCert, u.ClientKey))
+	}
+	if u.DisableSkewCorrection {
+		configured = append(configured, WithClockSkewCorrection(false))
+	}
+	// unknown authenticators are reported by Validate
+	if auth, err := NewAuthenticator(u.Auth, u.Secret); err == nil && u.Auth != "" {
+		configured = append(configured, WithAuthenticator(auth))
+	}
+	return NewClient(append(configured, opts...)...)
+}
+
+// targets returns the handlers of all route targets by name, creating a
+// client for every upstream.
+func (c *ClientConfig) targets(opts []ClientOption) map[string]ProxyHandler {
+	targets := map[string]ProxyHandler{
+		viaDirect: Direct{Timeout: c.Timeout},
+		viaBlock:  Block{},
+	}
+	for _, u := range c.upstreams() {
+		targets[u.Name] = u.NewClient(opts...)
+	}
+	return targets
+}
+
+// router builds the router of the configured routes over targets.
+func (c *ClientConfig) router(targets map[string]ProxyHandler) (*Router, error) {
+	routes := make([]Route, 0, len(c.Routes))
+	for _, r := range c.Routes {
+		hosts, err := NewHostMatcher(r.Match...)
+		if err != nil {
+			return nil, err
+		}
+		routes = append(routes, Route{Hosts: hosts, Handler: targets[r.Via]})
+	}
+	return NewRouter(targets[c.defaultVia()], routes...), nil
+}
+
+// NewRouter validates the configuration and creates a router that sends
+// connections through the configured upstreams according to the routes.
+// Options in opts are applied to the client of every upstream.
+func (c *ClientConfig) NewRouter(opts ...ClientOption) (*Router, error) {
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	opts = append([]ClientOption{WithLogger(configLogger(c.LogLevel))}, opts...)
+	return c.router(c.targets(opts))
+}
+
+// NewLocalServer validates the configuration and creates a local proxy
+// server listening on every listener, connecting through the configured
+// upstreams and routes. Options in opts are applied after the configured
+// ones.
+func (c *ClientConfig) NewLocalServer(opts ...LocalServerOption) (*LocalServer, error) {
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	logger := configLogger(c.LogLevel)
+	targets := c.targets([]ClientOption{WithLogger(logger)})
+	router, err := c.router(targets)
+	if err != nil {
+		return nil, err
+	}
+
+	configured := []LocalServerOption{
+		WithSocks5Handler(router),
+		WithHTTPHandler(router),
+		WithDisableSocks5(c.DisableSocks5),
+		WithDisableHTTP(c.DisableHTTP),
+		WithDisableHTTPConnect(c.DisableHTTPConnect),
+		WithLocalLogger(logger),
+	}
+	for _, l := range c.listeners() {
+		listener := Listener{
+			Network:  l.Network,
+			Addr:     l.Addr,
+			Protocol: l.Protocol,
+			Sniff:    l.Sniff,
+			Target:   l.Target,
+		}
+		if l.Upstream != "" {
+			listener.Handler = targets[l.Upstream]
+		}
+		if len(l.Users) > 0 {
+			listener.Users = make(map[string]string, len(l.Users))
+			for _, u := range l.Users {
+				listener.Users[u.Name] = u.Password
+			}
+		}
+		if l.TLS || l.TLSCert != "" {
+			if listener.TLS, err = localTLSConfig(l.Addr, l.TLSCert, l.TLSKey); err != nil {
+				return nil, err
+			}
+			if l.TLSCert == "" {
+				logger.Info("self-signed certificate for local listener",
+					"addr", l.Addr,
+					"pin", "sha256/"+SPKIPin(listener.TLS.Certificates[0].Leaf))
+			}
+		}
+		configured = append(configured, WithListener(listener))
+	}
+	for _, r := range c.Reverse {
+		upstream := r.Upstream
+		if upstream == "" {
+			upstream = c.upstreams()[0].Name
+		}
+		configured = append(configured, WithReverse(Reverse{
+			Client: targets[upstream].(*Client),
+			Addr:   r.Addr,
+			Target: r.Target,
+		}))
+	}
+	return NewLocalServer(append(configured, opts...)...), nil
+}
+
+// NewProxyServer validates the configuration and creates a proxy server
+// from it. Options in opts are applied after the configured ones.
+func (c *ServerConfig) NewProxyServer(opts ...ServerOption) (*ProxyServer, error) {
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	addrs := []string{c.Addr}
+	if len(c.Listeners) > 0 {
+		addrs = addrs[:0]
+		for _, l := range c.Listeners {
+			addrs = append(addrs, l.Addr)
+		}
+	}
+	configured := []ServerOption{
+		WithListenAddrs(addrs...),
+		WithServerSecret(c.Secret),
+		WithHTTPS(c.HTTPS || len(c.ACMEDomains) > 0),
+		WithTLSCert(c.Cert),
+		WithTLSKey(c.Key),
+		WithServerLogger(configLogger(c.LogLevel)),
+		WithClockSkew(c.ClockSkew),
+		WithIdleTimeout(c.IdleTimeout),
+		WithMaxTunnelLifetime(c.MaxLifetime),
+		WithClientCA(c.ClientCA),
+		WithClientCertAuth(c.CertAuth),
+		WithCertReloadInterval(c.CertReload),
+		WithCertExpiryWarning(c.CertWarn),
+		WithMaxTunnels(c.MaxTunnels),
+		WithMaxTunnelsPerClient(c.MaxTunnelsPerClient),
+		WithConnectRate(c.ConnectRate, c.ConnectBurst),
+		WithReverseTunnels(c.Reverse),
+		WithDNSPreference(c.DNSPrefer),
+		WithBlockPrivateAddrs(c.BlockPrivate),
+	}
+	var resolver Resolver
+	if len(c.DNS) > 0 {
+		r, err := NewDNSResolver(c.DNS...)
+		if err != nil {
+			return nil, err
+		}
+		resolver = r
+	}
+	if c.Hosts != "" {
+		next := resolver
+		if next == nil {
+			next = net.DefaultResolver
+		}
+		r, err := LoadHostsFile(c.Hosts, next)
+		if err != nil {
+			return nil, err
+		}
+		resolver = r
+	}
+	if resolver != nil {
+		configured = append(configured, WithResolver(resolver))
+	}
+	if c.DialTimeout > 0 {
+		configured = append(configured, WithDialTimeout(c.DialTimeout))
+	}
+	if c.SignTTL > 0 {
+		configured = append(configured, WithSignTTL(c.SignTTL))
+	}
+	if c.HeartTTL > 0 {
+		configured = append(configured, WithHeartbeatTTL(c.HeartTTL))
+	}
+	for _, pair := range c.CertPairs {
+		cert, key, _ := strings.Cut(pair, ",")
+		configured = append(configured, WithTLSCertPair(cert, key))
+	}
+	if len(c.ACMEDomains) > 0 {
+		configured = append(configured,
+			WithACME(c.ACMEDomains...),
+			WithACMEEmail(c.ACMEEmail),
+			WithACMECacheDir(c.ACMECache),
+			WithACMEDirectory(c.ACMEDirectory),
+			WithACMEDirectoryCA(c.ACMEDirectoryCA),
+			WithACMEHTTPAddr(c.ACMEHTTP),
+		)
+	}
+
+	if c.Auth != "" && (c.Secret != "" || len(c.Users) == 0) {
+		auth, _ := NewAuthenticator(c.Auth, c.Secret)
+		configured = append(configured, WithServerAuthenticator(auth))
+	}
+	allow := make(map[string]*HostMatcher)
+	for _, u := range c.Users {
+		auth, _ := NewAuthenticator(c.Auth, u.Secret)
+		configured = append(configured, WithServerUserAuthenticator(u.Name, auth))
+		if len(u.Allow) > 0 {
+			m, err := NewHostMatcher(u.Allow...)
+			if err != nil {
+				return nil, err
+			}
+			allow[u.Name] = m
+		}
+	}
+	if len(allow) > 0 {
+		configured = append(configured, WithACL(ACLFunc(func(req *TunnelRequest) error {
+			if m, ok := allow[req.User]; ok && !m.Match(req.Host) {
+				return errors.New("destination not allowed for user")
+			}
+			return nil
+		})))
+	}
+	return NewProxyServer(append(configured, opts...)...), nil
+}
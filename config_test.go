@@ -0,0 +1,163 @@
+package h2go
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestConfigValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		modify  func(c *Config)
+		wantKey string
+	}{
+		{"missing raddr", func(c *Config) {}, "client.raddr"},
+		{"bad scheme", func(c *Config) { c.Client.RAddr = "ftp://example.com" }, "client.raddr"},
+		{"unknown via", func(c *Config) {
+			c.Client.RAddr = "http://example.com"
+			c.Client.Routes = []RouteConfig{{Match: []string{"*"}, Via: "nope"}}
+		}, "client.routes[0].via"},
+		{"bad pattern", func(c *Config) {
+			c.Client.RAddr = "http://example.com"
+			c.Client.Routes = []RouteConfig{{Match: []string{"*", "a*b"}, Via: "direct"}}
+		}, "client.routes[0].match[1]"},
+		{"duplicate upstream", func(c *Config) {
+			c.Client.Upstreams = []UpstreamConfig{
+				{Name: "a", RAddr: "http://a.example.com"},
+				{Name: "a", RAddr: "http://b.example.com"},
+			}
+		}, "client.upstreams[1].name"},
+		{"bad protocol", func(c *Config) {
+			c.Client.RAddr = "http://example.com"
+			c.Client.Listeners = []ListenerConfig{{Addr: ":1080"}, {Addr: ":8118", Protocol: "https"}}
+		}, "client.listeners[1].protocol"},
+		{"transparent unix socket", func(c *Config) {
+			c.Client.RAddr = "http://example.com"
+			c.Client.Listeners = []ListenerConfig{{Addr: "/run/h2go.sock", Network: "unix", Protocol: ProtocolRedirect}}
+		}, "client.listeners[0].network"},
+		{"forward without target", func(c *Config) {
+			c.Client.RAddr = "http://example.com"
+			c.Client.Listeners = []ListenerConfig{{Addr: ":5432", Protocol: ProtocolForward}}
+		}, "client.listeners[0].target"},
+		{"tls on forwarding listener", func(c *Config) {
+			c.Client.RAddr = "http://example.com"
+			c.Client.Listeners = []ListenerConfig{{Addr: ":5432", Protocol: ProtocolForward, Target: "db:5432", TLS: true}}
+		}, "client.listeners[0].tls"},
+		{"tls cert without key", func(c *Config) {
+			c.Client.RAddr = "http://example.com"
+			c.Client.TLSCert = "cert.pem"
+		}, "client.tlskey"},
+		{"reverse via direct", func(c *Config) {
+			c.Client.RAddr = "http://example.com"
+			c.Client.Reverse = []ReverseConfig{{Addr: "demo", Target: "localhost:3000", Upstream: "direct"}}
+		}, "client.reverse[0].upstream"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := DefaultConfig()
+			tt.modify(&c)
+			err := c.Client.Validate()
+			var ce *ConfigError
+			if !errors.As(err, &ce) || ce.Key != tt.wantKey {
+				t.Fatalf("Validate() error = %v, want key %s", err, tt.wantKey)
+			}
+		})
+	}
+
+	c := DefaultConfig()
+	c.Server.Users = []UserConfig{{Name: "alice"}}
+	var ce *ConfigError
+	if err := c.Server.Validate(); !errors.As(err, &ce) || ce.Key != "server.users[0].secret" {
+		t.Fatalf("Validate() error = %v, want key server.users[0].secret", err)
+	}
+
+	c = DefaultConfig()
+	c.Server.DNS = []string{"1.1.1.1", "quic://dns.example"}
+	if err := c.Server.Validate(); !errors.As(err, &ce) || ce.Key != "server.dns[1]" {
+		t.Fatalf("Validate() error = %v, want key server.dns[1]", err)
+	}
+}
+
+func TestConfigNewProxyServer(t *testing.T) {
+	c := DefaultConfig().Server
+	c.Users = []UserConfig{{Name: "alice", Secret: "alice-secret", Allow: []string{"example.com"}}}
+	s, err := c.NewProxyServer()
+	if err != nil {
+		t.Fatalf("NewProxyServer() error = %v", err)
+	}
+	if s.certReload != defaultCertReloadInterval || s.heartTTL != defaultHeartTTL {
+		t.Errorf("defaults not applied: certReload = %v, heartTTL = %v", s.certReload, s.heartTTL)
+	}
+	if err := s.acl.Allow(&TunnelRequest{User: "alice", Host: "example.com"}); err != nil {
+		t.Errorf("Allow() allowed destination error = %v", err)
+	}
+	if err := s.acl.Allow(&TunnelRequest{User: "alice", Host: "example.org"}); err == nil {
+		t.Error("Allow() accepted a destination outside the user's allow list")
+	}
+}
+
+func TestConfigNewLocalServer(t *testing.T) {
+	c := DefaultConfig().Client
+	c.Upstreams = []UpstreamConfig{{Name: "main", RAddr: "http://proxy.example.com"}}
+	c.Listeners = []ListenerConfig{
+		{Addr: "127.0.0.1:0", Protocol: ProtocolSOCKS5, Users: []LocalUserConfig{{Name: "alice", Password: "pw"}}},
+		{Addr: "127.0.0.1:0", Protocol: ProtocolHTTP, Upstream: "block", TLS: true},
+	}
+	c.Routes = []RouteConfig{{Match: []string{".internal.example"}, Via: "direct"}}
+
+	s, err := c.NewLocalServer()
+	if err != nil {
+		t.Fatalf("NewLocalServer() error = %v", err)
+	}
+	if s.Addr != "" || len(s.Listeners) != 2 {
+		t.Fatalf("got addr %q and %d listeners, want only the 2 listeners", s.Addr, len(s.Listeners))
+	}
+	if l := s.Listeners[0]; l.Protocol != ProtocolSOCKS5 || l.Handler != nil || l.Users["alice"] != "pw" {
+		t.Errorf("listener 0 = %+v, want socks5 with user alice and the router", l)
+	}
+	router, ok := s.Socks5Handler.(*Router)
+	if !ok {
+		t.Fatalf("handler = %T, want *Router", s.Socks5Handler)
+	}
+	if _, ok := router.Handler("db.internal.example").(Direct); !ok {
+		t.Errorf("internal destination handler = %T, want Direct", router.Handler("db.internal.example"))
+	}
+	if client, ok := router.Handler("example.com").(*Client); !ok || !strings.Contains(client.ServerURL(), "proxy.example.com") {
+		t.Errorf("default handler = %T, want the main upstream", router.Handler("example.com"))
+	}
+	if _, ok := s.Listeners[1].Handler.(Block); !ok {
+		t.Errorf("listener handler = %T, want Block", s.Listeners[1].Handler)
+	}
+	if l := s.Listeners[1]; l.TLS == nil || len(l.TLS.Certificates) != 1 || l.TLS.Certificates[0].Leaf.VerifyHostname("127.0.0.1") != nil {
+		t.Errorf("listener 1 TLS = %+v, want a self-signed certificate for 127.0.0.1", l.TLS)
+	}
+	if s.Listeners[0].TLS != nil {
+		t.Errorf("listener 0 TLS = %+v, want none", s.Listeners[0].TLS)
+	}
+}
+
+func TestConfigNewProxyServerOptions(t *testing.T) {
+	c := DefaultConfig().Server
+	c.Secret = "secret"
+	c.Auth = AuthHMACSHA256
+	c.MaxTunnels = 10
+	c.ConnectRate = 2
+	c.ConnectBurst = 4
+	s, err := c.NewProxyServer()
+	if err != nil {
+		t.Fatalf("NewProxyServer() error = %v", err)
+	}
+	if _, ok := s.authenticator.(*HMACSHA256Authenticator); !ok {
+		t.Errorf("authenticator = %T, want *HMACSHA256Authenticator", s.authenticator)
+	}
+	if s.limits.maxTotal != 10 || s.limits.rate != 2 || s.limits.burst != 4 {
+		t.Errorf("limits = %d, %v, %d, want 10, 2, 4", s.limits.maxTotal, s.limits.rate, s.limits.burst)
+	}
+
+	c.Auth = "md5"
+	var ce *ConfigError
+	if _, err := c.NewProxyServer(); !errors.As(err, &ce) || ce.Key != "server.auth" {
+		t.Fatalf("NewProxyServer() error = %v, want key server.auth", err)
+	}
+}
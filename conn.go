@@ -0,0 +1,251 @@
+package h2go
+
+import (
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// errWriteClosed is returned by writes after CloseWrite.
+var errWriteClosed = errors.New("write after CloseWrite")
+
+// tunnelAddr is the address of an end of a tunnel as reported by the server.
+type tunnelAddr string
+
+func (a tunnelAddr) Network() string { return "h2go" }
+func (a tunnelAddr) String() string  { return string(a) }
+
+// deadline is a deadline that can be changed while Read or Write wait for
+// it. Its channel is closed when the deadline passes.
+type deadline struct {
+	mu     sync.Mutex
+	timer  *time.Timer
+	cancel chan struct{}
+}
+
+func makeDeadline() deadline {
+	return deadline{cancel: make(chan struct{})}
+}
+
+// set sets the deadline to t. A zero t clears it.
+func (d *deadline) set(t time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.timer != nil && !d.timer.Stop() {
+		<-d.cancel // wait for the timer callback to finish and close cancel
+	}
+	d.timer = nil
+
+	closed := isClosedChan(d.cancel)
+	if t.IsZero() {
+		if closed {
+			d.cancel = make(chan struct{})
+		}
+		return
+	}
+	if dur := time.Until(t); dur > 0 {
+		if closed {
+			d.cancel = make(chan struct{})
+		}
+		cancel := d.cancel
+		d.timer = time.AfterFunc(dur, func() {
+			close(cancel)
+		})
+		return
+	}
+	if !closed {
+		close(d.cancel)
+	}
+}
+
+// wait returns a channel that is closed when the deadline passes.
+func (d *deadline) wait() chan struct{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.cancel
+}
+
+func isClosedChan(c <-chan struct{}) bool {
+	select {
+	case <-c:
+		return true
+	default:
+		return false
+	}
+}
+
+// readResult is a chunk of data read from a tunnel.
+type readResult struct {
+	data []byte
+	err  error
+}
+
+// writeResult is the outcome of a write to a tunnel.
+type writeResult struct {
+	n   int
+	err error
+}
+
+// tunnelConn adapts a tunnel to net.Conn. The tunnel is read and written by
+// goroutines, so that Read and Write can return when a deadline passes.
+// A Write that timed out may still be delivered.
+type tunnelConn struct {
+	conn          *clientConnection
+	local, remote net.Addr
+
+	readOnce sync.Once
+	readMu   sync.Mutex
+	reads    chan readResult
+	pending  []byte
+	readErr  error
+
+	writing chan struct{} // held by the goroutine of a pending write
+
+	readDeadline  deadline
+	writeDeadline deadline
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+// newTunnelConn returns a net.Conn for the tunnel conn.
+func newTunnelConn(conn *clientConnection, local, remote net.Addr) *tunnelConn {
+	return &tunnelConn{
+		conn:          conn,
+		local:         local,
+		remote:        remote,
+		reads:         make(chan readResult),
+		writing:       make(chan struct{}, 1),
+		readDeadline:  makeDeadline(),
+		writeDeadline: makeDeadline(),
+		closed:        make(chan struct{}),
+	}
+}
+
+// readLoop reads the tunnel until it fails.
+func (c *tunnelConn) readLoop() {
+	for {
+		buf := make([]byte, 32<<10)
+		n, err := c.conn.Read(buf)
+		if n == 0 && err == nil {
+			continue
+		}
+		select {
+		case c.reads <- readResult{data: buf[:n], err: err}:
+		case <-c.closed:
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// Read reads data from the tunnel.
+func (c *tunnelConn) Read(b []byte) (int, error) {
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+
+	if len(c.pending) == 0 && c.readErr == nil {
+		c.readOnce.Do(func() { go c.readLoop() })
+		if isClosedChan(c.closed) {
+			return 0, net.ErrClosed
+		}
+		if isClosedChan(c.readDeadline.wait()) {
+			return 0, os.ErrDeadlineExceeded
+		}
+		select {
+		case r := <-c.reads:
+			c.pending, c.readErr = r.data, r.err
+		case <-c.readDeadline.wait():
+			return 0, os.ErrDeadlineExceeded
+		case <-c.closed:
+			return 0, net.ErrClosed
+		}
+	}
+	if len(c.pending) == 0 {
+		return 0, c.readErr
+	}
+	n := copy(b, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+// Write writes data to the tunnel.
+func (c *tunnelConn) Write(b []byte) (int, error) {
+	if isClosedChan(c.closed) {
+		return 0, net.ErrClosed
+	}
+	if isClosedChan(c.writeDeadline.wait()) {
+		return 0, os.ErrDeadlineExceeded
+	}
+	select {
+	case c.writing <- struct{}{}:
+	case <-c.writeDeadline.wait():
+		return 0, os.ErrDeadlineExceeded
+	case <-c.closed:
+		return 0, net.ErrClosed
+	}
+
+	// b may be reused by the caller once Write returns on a deadline
+	data := append([]byte(nil), b...)
+	done := make(chan writeResult, 1)
+	go func() {
+		n, err := c.conn.Write(data)
+		<-c.writing
+		done <- writeResult{n: n, err: err}
+	}()
+	select {
+	case r := <-done:
+		return r.n, r.err
+	case <-c.writeDeadline.wait():
+		return 0, os.ErrDeadlineExceeded
+	case <-c.closed:
+		return 0, net.ErrClosed
+	}
+}
+
+// CloseWrite shuts down the writing side of the tunnel once the pending
+// writes are delivered. The server passes the end of data on to the remote
+// host. Reading is unaffected.
+func (c *tunnelConn) CloseWrite() error {
+	select {
+	case c.writing <- struct{}{}:
+	case <-c.closed:
+		return net.ErrClosed
+	}
+	defer func() { <-c.writing }()
+	return c.conn.CloseWrite()
+}
+
+// Close closes the tunnel. Pending reads and writes return net.ErrClosed.
+func (c *tunnelConn) Close() error {
+	err := net.ErrClosed
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		err = c.conn.Close()
+	})
+	return err
+}
+
+func (c *tunnelConn) LocalAddr() net.Addr  { return c.local }
+func (c *tunnelConn) RemoteAddr() net.Addr { return c.remote }
+
+func (c *tunnelConn) SetDeadline(t time.Time) error {
+	c.readDeadline.set(t)
+	c.writeDeadline.set(t)
+	return nil
+}
+
+func (c *tunnelConn) SetReadDeadline(t time.Time) error {
+	c.readDeadline.set(t)
+	return nil
+}
+
+func (c *tunnelConn) SetWriteDeadline(t time.Time) error {
+	c.writeDeadline.set(t)
+	return nil
+}
@@ -0,0 +1,86 @@
+package h2go
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// ParseForward parses a local port forwarding in the form of ssh -L,
+// "[bind_address:]port:host:hostport", into a Listener that connects every
+// connection it accepts to host:hostport. The bind address defaults to
+// 127.0.0.1. IPv6 addresses are written in brackets, e.g.
+// "[::1]:5432:[2001:db8::1]:5432".
+func ParseForward(spec string) (Listener, error) {
+	fields, err := splitForward(spec)
+	if err != nil {
+		return Listener{}, fmt.Errorf("invalid forwarding %q: %w", spec, err)
+	}
+	switch len(fields) {
+	case 3:
+		fields = append([]string{"127.0.0.1"}, fields...)
+	case 4:
+	default:
+		return Listener{}, fmt.Errorf("invalid forwarding %q: want [bind_address:]port:host:hostport", spec)
+	}
+	for _, i := range []int{1, 3} {
+		if port, err := strconv.ParseUint(fields[i], 10, 16); err != nil || port == 0 {
+			return Listener{}, fmt.Errorf("invalid forwarding %q: invalid port %q", spec, fields[i])
+		}
+	}
+	if fields[2] == "" {
+		return Listener{}, fmt.Errorf("invalid forwarding %q: missing host", spec)
+	}
+	return Listener{
+		Addr:     net.JoinHostPort(fields[0], fields[1]),
+		Protocol: ProtocolForward,
+		Target:   net.JoinHostPort(fields[2], fields[3]),
+	}, nil
+}
+
+// splitForward splits spec at colons outside of brackets, removing the
+// brackets.
+func splitForward(spec string) ([]string, error) {
+	var fields []string
+	for {
+		var field string
+		if strings.HasPrefix(spec, "[") {
+			end := strings.Index(spec, "]")
+			if end < 0 {
+				return nil, errors.New("missing ]")
+			}
+			field, spec = spec[1:end], spec[end+1:]
+			if spec != "" && spec[0] != ':' {
+				return nil, fmt.Errorf("unexpected %q after ]", spec)
+			}
+			spec = strings.TrimPrefix(spec, ":")
+		} else {
+			field, spec, _ = strings.Cut(spec, ":")
+		}
+		fields = append(fields, field)
+		if spec == "" {
+			return fields, nil
+		}
+	}
+}
+
+// handleForward connects a connection accepted on a forwarding listener to
+// its target.
+func (s *LocalServer) handleForward(conn net.Conn, l *Listener) error {
+	handler := s.handlerFor(l, s.Socks5Handler)
+	if handler == nil {
+		return ErrNotSupportedProtocol
+	}
+	conn2, err := s.connect(handler, conn, &ConnectRequest{Addr: l.Target, Protocol: ProtocolForward})
+	if err != nil {
+		return err
+	}
+	defer handler.Clean()
+	defer conn2.Close()
+	s.Logger.Info("forward",
+		"local", conn.RemoteAddr().String(),
+		"remote", l.Target)
+	return s.transport(conn, conn2)
+}
@@ -0,0 +1,69 @@
+package h2go
+
+import (
+	"net"
+	"testing"
+)
+
+func TestParseForward(t *testing.T) {
+	tests := []struct {
+		spec    string
+		addr    string
+		target  string
+		wantErr bool
+	}{
+		{spec: "5432:db.internal:5432", addr: "127.0.0.1:5432", target: "db.internal:5432"},
+		{spec: "0.0.0.0:8080:web:80", addr: "0.0.0.0:8080", target: "web:80"},
+		{spec: ":8080:web:80", addr: ":8080", target: "web:80"},
+		{spec: "[::1]:5432:[2001:db8::1]:5432", addr: "[::1]:5432", target: "[2001:db8::1]:5432"},
+		{spec: "5432:db.internal", wantErr: true},
+		{spec: "5432:db.internal:pg", wantErr: true},
+		{spec: "70000:db:5432", wantErr: true},
+		{spec: "[::1:5432:db:5432", wantErr: true},
+		{spec: "5432::5432", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.spec, func(t *testing.T) {
+			l, err := ParseForward(tt.spec)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("ParseForward() = %+v, want an error", l)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseForward() error = %v", err)
+			}
+			if l.Addr != tt.addr || l.Target != tt.target || l.Protocol != ProtocolForward {
+				t.Errorf("ParseForward() = %+v, want addr %s and target %s", l, tt.addr, tt.target)
+			}
+		})
+	}
+}
+
+func TestLocalServerForward(t *testing.T) {
+	echo := startEcho(t)
+	addrs := []string{freeAddr(t), freeAddr(t)}
+	h := &echoHandler{echo: echo, addrs: make(chan string, 2)}
+
+	s := NewLocalServer(
+		WithSocks5Handler(h),
+		WithListener(Listener{Addr: addrs[0], Protocol: ProtocolForward, Target: "db.internal:5432"}),
+		WithListener(Listener{Addr: addrs[1], Protocol: ProtocolForward, Target: "web.internal:80"}),
+	)
+	go s.ListenAndServe()
+
+	for i, want := range []string{"db.internal:5432", "web.internal:80"} {
+		waitListening(t, "tcp", addrs[i])
+		<-h.addrs // the probe of waitListening
+		conn, err := net.Dial("tcp", addrs[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkEcho(t, conn)
+		conn.Close()
+		if got := <-h.addrs; got != want {
+			t.Errorf("forwarded to %s, want %s", got, want)
+		}
+	}
+}
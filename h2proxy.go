@@ -0,0 +1,216 @@
+package h2go
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+
+	"golang.org/x/net/http2"
+)
+
+// h2PrefaceRest is the part of the HTTP/2 client connection preface that
+// follows what http.ReadRequest reads as a "PRI * HTTP/2.0" request.
+const h2PrefaceRest = "SM\r\n\r\n"
+
+// proxyAuthChallenge is the Proxy-Authenticate header of responses to
+// requests without valid credentials.
+const proxyAuthChallenge = `Basic realm="h2go", charset="UTF-8"`
+
+// h2Proxy serves the streams of an HTTP/2 proxy connection, each of which is
+// a request of its own: CONNECT opens a tunnel, extended CONNECT (RFC 8441)
+// a tunnel through a protocol upgrade of the origin server, such as
+// WebSocket, and other methods are forwarded.
+type h2Proxy struct {
+	s         *LocalServer
+	l         *Listener
+	conn      net.Conn
+	handler   ProxyHandler
+	forwarder *httpForwarder
+}
+
+// serveHTTP2 serves conn as an HTTP/2 proxy connection until it ends.
+// sawPreface reports whether the client connection preface was already
+// read from conn.
+func (s *LocalServer) serveHTTP2(conn net.Conn, l *Listener, handler ProxyHandler, sawPreface bool) error {
+	p := &h2Proxy{
+		s:         s,
+		l:         l,
+		conn:      conn,
+		handler:   handler,
+		forwarder: s.newHTTPForwarder(conn, handler),
+	}
+	defer p.forwarder.close()
+	(&http2.Server{}).ServeConn(conn, &http2.ServeConnOpts{
+		Handler:          p,
+		SawClientPreface: sawPreface,
+	})
+	return nil
+}
+
+func (p *h2Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p.s.Logger.Info("http",
+		"method", r.Method,
+		"remote", p.conn.RemoteAddr().String(),
+		"host", r.Host,
+		"proto", r.Proto)
+
+	user, ok := proxyUser(r, p.l.Users)
+	if !ok {
+		w.Header().Set("Proxy-Authenticate", proxyAuthChallenge)
+		http.Error(w, "proxy authentication required", http.StatusProxyAuthRequired)
+		return
+	}
+	switch {
+	case r.Method == http.MethodConnect && r.Header.Get(":protocol") != "":
+		p.serveUpgrade(w, r, user)
+	case r.Method == http.MethodConnect:
+		p.serveConnect(w, r, user)
+	default:
+		body := r.Body
+		if r.ContentLength == 0 {
+			body = http.NoBody
+		}
+		res, err := p.forwarder.roundTrip(r, user, body)
+		if err != nil {
+			http.Error(w, err.Error(), errorStatus(err))
+			return
+		}
+		defer res.Body.Close()
+		writeResponse(w, res)
+	}
+}
+
+// serveConnect tunnels the stream of a CONNECT request for user to the
+// requested host.
+func (p *h2Proxy) serveConnect(w http.ResponseWriter, r *http.Request, user string) {
+	if p.s.DisableHTTPCONNECT {
+		http.Error(w, "connection refused", http.StatusBadGateway)
+		return
+	}
+	addr := r.Host
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, "443")
+	}
+	conn, err := p.s.connect(p.handler, p.conn, &ConnectRequest{
+		Addr:     addr,
+		Protocol: ProtocolHTTP,
+		Method:   r.Method,
+		User:     user,
+		Header:   r.Header,
+	})
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+	defer conn.Close()
+	w.WriteHeader(http.StatusOK)
+	if err := http.NewResponseController(w).Flush(); err != nil {
+		return
+	}
+	p.s.Logger.Info("http",
+		"local", p.conn.RemoteAddr().String(),
+		"remote", addr,
+		"proto", r.Proto)
+	p.s.transport(&streamConn{Reader: r.Body, flushWriter: flushWriter{w}}, conn)
+}
+
+// serveUpgrade serves an extended CONNECT request for user by asking the
+// origin server to upgrade an HTTP/1.1 request to the protocol, and
+// tunneling the stream to the upgraded connection. The scheme of the
+// origin server is https only if the client connection uses TLS and asks
+// for it.
+func (p *h2Proxy) serveUpgrade(w http.ResponseWriter, r *http.Request, user string) {
+	protocol := r.Header.Get(":protocol")
+	req := r.Clone(r.Context())
+	req.Method = http.MethodGet
+	req.Header.Del(":protocol")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", protocol)
+	if r.TLS != nil {
+		req.URL.Scheme = "https"
+	}
+	// RFC 8441 drops the WebSocket handshake key, which HTTP/1.1 needs
+	websocket := strings.EqualFold(protocol, "websocket")
+	if websocket && req.Header.Get("Sec-WebSocket-Key") == "" {
+		key := make([]byte, 16)
+		rand.Read(key)
+		req.Header.Set("Sec-WebSocket-Key", base64.StdEncoding.EncodeToString(key))
+	}
+
+	res, err := p.forwarder.roundTrip(req, user, http.NoBody)
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusSwitchingProtocols {
+		writeResponse(w, res)
+		return
+	}
+	upstream, ok := res.Body.(io.ReadWriteCloser)
+	if !ok {
+		http.Error(w, "upstream connection is not writable", http.StatusBadGateway)
+		return
+	}
+
+	removeHopHeaders(res.Header)
+	if websocket {
+		res.Header.Del("Sec-WebSocket-Accept")
+	}
+	addVia(res.Header, res.ProtoMajor, res.ProtoMinor)
+	copyHeader(w.Header(), res.Header)
+	w.WriteHeader(http.StatusOK)
+	if err := http.NewResponseController(w).Flush(); err != nil {
+		return
+	}
+	p.s.transport(&streamConn{Reader: r.Body, flushWriter: flushWriter{w}}, upstream)
+}
+
+// writeResponse writes res, the response of an origin server, to w,
+// flushing the body as it arrives.
+func writeResponse(w http.ResponseWriter, res *http.Response) {
+	removeHopHeaders(res.Header)
+	addVia(res.Header, res.ProtoMajor, res.ProtoMinor)
+	copyHeader(w.Header(), res.Header)
+	for key := range res.Trailer {
+		w.Header().Add("Trailer", key)
+	}
+	w.WriteHeader(res.StatusCode)
+	if _, err := io.Copy(flushWriter{w}, res.Body); err != nil {
+		return
+	}
+	copyHeader(w.Header(), res.Trailer)
+}
+
+// copyHeader adds the values of src to dst.
+func copyHeader(dst, src http.Header) {
+	for key, values := range src {
+		for _, v := range values {
+			dst.Add(key, v)
+		}
+	}
+}
+
+// flushWriter writes to an http.ResponseWriter and flushes every write, so
+// that streamed responses and tunnels are not delayed.
+type flushWriter struct {
+	w http.ResponseWriter
+}
+
+func (f flushWriter) Write(b []byte) (int, error) {
+	n, err := f.w.Write(b)
+	if err == nil {
+		err = http.NewResponseController(f.w).Flush()
+	}
+	return n, err
+}
+
+// streamConn is a tunnel over an HTTP/2 stream: reads come from the request
+// body and writes go to the response.
+type streamConn struct {
+	io.Reader
+	flushWriter
+}
@@ -0,0 +1,178 @@
+package h2go
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+// h2cTransport returns an HTTP/2 transport with prior knowledge that sends
+// every request to proxyAddr, and the number of connections it opened.
+func h2cTransport(proxyAddr string) (*http2.Transport, *atomic.Int32) {
+	var dials atomic.Int32
+	return &http2.Transport{
+		AllowHTTP: true,
+		DialTLSContext: func(ctx context.Context, network, addr string, cfg *tls.Config) (net.Conn, error) {
+			dials.Add(1)
+			return (&net.Dialer{}).DialContext(ctx, network, proxyAddr)
+		},
+	}, &dials
+}
+
+// h2Tunnel opens a tunnel to host with a CONNECT request, extended with
+// protocol if not empty.
+func h2Tunnel(t *testing.T, tr *http2.Transport, host, protocol string) *streamTunnel {
+	t.Helper()
+	pr, pw := io.Pipe()
+	req, _ := http.NewRequest(http.MethodConnect, "http://proxy/", pr)
+	req.Host = host
+	if protocol != "" {
+		req.Header.Set(":protocol", protocol)
+	}
+	res, err := tr.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("CONNECT %s error = %v", host, err)
+	}
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("CONNECT %s status = %d, want 200", host, res.StatusCode)
+	}
+	tunnel := &streamTunnel{ReadCloser: res.Body, w: pw}
+	t.Cleanup(func() { tunnel.Close() })
+	return tunnel
+}
+
+// streamTunnel is the client side of an HTTP/2 tunnel.
+type streamTunnel struct {
+	io.ReadCloser
+	w *io.PipeWriter
+}
+
+func (c *streamTunnel) Write(b []byte) (int, error) { return c.w.Write(b) }
+
+func (c *streamTunnel) Close() error {
+	c.w.Close()
+	return c.ReadCloser.Close()
+}
+
+// checkTunnelEcho checks that data written to rw is echoed back.
+func checkTunnelEcho(t *testing.T, rw io.ReadWriter) {
+	t.Helper()
+	done := make(chan error, 1)
+	go func() {
+		buf := make([]byte, 5)
+		_, err := io.ReadFull(rw, buf)
+		if err == nil && string(buf) != "hello" {
+			err = io.ErrUnexpectedEOF
+		}
+		done <- err
+	}()
+	if _, err := rw.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("echo error = %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("echo timed out")
+	}
+}
+
+func TestHTTP2Proxy(t *testing.T) {
+	echo := startEcho(t)
+	a, _ := startOrigin(t, "a")
+	proxyAddr := startHTTPProxy(t)
+	tr, dials := h2cTransport(proxyAddr)
+	defer tr.CloseIdleConnections()
+
+	t.Run("connect", func(t *testing.T) {
+		first := h2Tunnel(t, tr, echo, "")
+		second := h2Tunnel(t, tr, echo, "")
+		checkTunnelEcho(t, second)
+		checkTunnelEcho(t, first)
+	})
+
+	t.Run("forward", func(t *testing.T) {
+		req, _ := http.NewRequest(http.MethodGet, "http://proxy/one?x=1", nil)
+		req.Host = a.Listener.Addr().String()
+		res, err := tr.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		body, _ := io.ReadAll(res.Body)
+		if want := `a /one?x=1 via="2.0 h2go" body=""`; res.StatusCode != http.StatusOK || string(body) != want {
+			t.Errorf("response = %d %q, want 200 %q", res.StatusCode, body, want)
+		}
+	})
+
+	if n := dials.Load(); n != 1 {
+		t.Errorf("transport opened %d connections, want 1", n)
+	}
+}
+
+func TestHTTP2ExtendedConnect(t *testing.T) {
+	// the HTTP/2 server only advertises extended CONNECT if the setting is
+	// in the environment when the process starts
+	if !strings.Contains(os.Getenv("GODEBUG"), "http2xconnect=1") {
+		cmd := exec.Command(os.Args[0], "-test.run=^TestHTTP2ExtendedConnect$", "-test.count=1")
+		cmd.Env = append(os.Environ(), "GODEBUG=http2xconnect=1")
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("with GODEBUG=http2xconnect=1: %v\n%s", err, out)
+		}
+		return
+	}
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet || r.Header.Get("Upgrade") != "echo" {
+			http.Error(w, "upgrade required", http.StatusUpgradeRequired)
+			return
+		}
+		conn, brw, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		brw.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+		brw.Flush()
+		io.Copy(conn, brw)
+	}))
+	defer origin.Close()
+	tr, _ := h2cTransport(startHTTPProxy(t))
+	defer tr.CloseIdleConnections()
+	checkTunnelEcho(t, h2Tunnel(t, tr, origin.Listener.Addr().String(), "echo"))
+}
+
+func TestHTTP2ProxyAuth(t *testing.T) {
+	proxyAddr := freeAddr(t)
+	s := NewLocalServer(
+		WithHTTPHandler(Direct{}),
+		WithListener(Listener{Addr: proxyAddr, Protocol: ProtocolHTTP, Users: map[string]string{"alice": "secret"}}),
+	)
+	go s.ListenAndServe()
+	waitListening(t, "tcp", proxyAddr)
+	tr, _ := h2cTransport(proxyAddr)
+	defer tr.CloseIdleConnections()
+
+	req, _ := http.NewRequest(http.MethodGet, "http://proxy/", nil)
+	req.Host = "example.com"
+	res, err := tr.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusProxyAuthRequired || res.Header.Get("Proxy-Authenticate") == "" {
+		t.Errorf("response = %d %q, want 407 with a challenge", res.StatusCode, res.Header.Get("Proxy-Authenticate"))
+	}
+}
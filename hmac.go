@@ -3,9 +3,29 @@ package h2go
 import (
 	"crypto/hmac"
 	"crypto/sha1"
+	"crypto/sha256"
 	"fmt"
 )
 
+// Names of the built-in authenticators, as accepted by NewAuthenticator.
+const (
+	AuthHMACSHA1   = "hmac-sha1"
+	AuthHMACSHA256 = "hmac-sha256"
+)
+
+// NewAuthenticator returns the built-in authenticator with the given name
+// for secret. An empty name selects HMAC-SHA1, the default of clients and
+// servers. Both sides of a tunnel must use the same authenticator.
+func NewAuthenticator(name, secret string) (Authenticator, error) {
+	switch name {
+	case "", AuthHMACSHA1:
+		return NewHMACAuthenticator(secret), nil
+	case AuthHMACSHA256:
+		return NewHMACSHA256Authenticator(secret), nil
+	}
+	return nil, fmt.Errorf("unknown authenticator %q, use %s or %s", name, AuthHMACSHA1, AuthHMACSHA256)
+}
+
 // HMACAuthenticator implements the Authenticator interface using HMAC-SHA1.
 // It provides secure request signing and verification using a shared secret.
 type HMACAuthenticator struct {
@@ -30,6 +50,33 @@ func (a *HMACAuthenticator) Verify(data, signature string) bool {
 	return VerifyHMACSHA1(a.secret, data, signature)
 }
 
+// HMACSHA256Authenticator implements the Authenticator interface using
+// HMAC-SHA256.
+type HMACSHA256Authenticator struct {
+	secret string
+}
+
+// Ensure HMACSHA256Authenticator implements the Authenticator interface.
+var _ Authenticator = (*HMACSHA256Authenticator)(nil)
+
+// NewHMACSHA256Authenticator creates a new HMACSHA256Authenticator with the
+// given secret.
+func NewHMACSHA256Authenticator(secret string) *HMACSHA256Authenticator {
+	return &HMACSHA256Authenticator{secret: secret}
+}
+
+// Sign generates an HMAC-SHA256 signature for the given data.
+func (a *HMACSHA256Authenticator) Sign(data string) string {
+	mac := hmac.New(sha256.New, []byte(a.secret))
+	mac.Write([]byte(data))
+	return fmt.Sprintf("%x", mac.Sum(nil))
+}
+
+// Verify checks if the provided signature is valid for the given data.
+func (a *HMACSHA256Authenticator) Verify(data, signature string) bool {
+	return hmac.Equal([]byte(a.Sign(data)), []byte(signature))
+}
+
 // GenHMACSHA1 generates an HMAC-SHA1 signature for the given key and data.
 // This is a low-level function; prefer using HMACAuthenticator for most use cases.
 func GenHMACSHA1(key, raw string) string {
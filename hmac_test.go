@@ -25,3 +25,29 @@ func TestVerifyHMACSHA12(t *testing.T) {
 		t.Errorf("VerifyHMACSHA1() = %v, want %v", got, false)
 	}
 }
+
+func TestNewAuthenticator(t *testing.T) {
+	sha256, err := NewAuthenticator(AuthHMACSHA256, "123456")
+	if err != nil {
+		t.Fatalf("NewAuthenticator() error = %v", err)
+	}
+	sign := sha256.Sign("123456")
+	if sign != "b8ad08a3a547e35829b821b75370301dd8c4b06bdd7771f9b541a75914068718" {
+		t.Errorf("Sign() = %v", sign)
+	}
+	if !sha256.Verify("123456", sign) {
+		t.Error("Verify() = false for its own signature")
+	}
+
+	sha1, err := NewAuthenticator("", "123456")
+	if err != nil {
+		t.Fatalf("NewAuthenticator() error = %v", err)
+	}
+	if sha1.Verify("123456", sign) {
+		t.Error("HMAC-SHA1 accepted an HMAC-SHA256 signature")
+	}
+
+	if _, err := NewAuthenticator("md5", "123456"); err == nil {
+		t.Error("NewAuthenticator() accepted an unknown name")
+	}
+}
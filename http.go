@@ -1,7 +1,6 @@
 package h2go
 
 import (
-	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
@@ -26,6 +25,7 @@ const (
 	DOWNLOAD   = "/download"
 	CHUNK_PULL = "/chunk_pull"
 	CHUNK_PUSH = "/chunk_push"
+	LISTEN     = "/listen"
 )
 
 // Message types for the proxy protocol.
@@ -33,15 +33,25 @@ const (
 	DATA_TYP  = "data"
 	QUIT_TYP  = "quit"
 	HEART_TYP = "heart"
+	EOF_TYP   = "eof" // the client is done sending, see proxyConn.CloseWrite
 )
 
-// Protocol constants.
+// Default protocol timeouts.
 const (
-	timeout  = 10
-	signTTL  = 10
-	heartTTL = 60
+	defaultTimeout   = 10 * time.Second
+	defaultSignTTL   = 10 * time.Second
+	defaultHeartTTL  = 60 * time.Second
+	defaultClockSkew = 10 * time.Second
 )
 
+// serverTimeHeader carries the server's Unix time in responses to requests
+// rejected for clock skew, letting clients correct their clock offset.
+const serverTimeHeader = "Server-Timestamp"
+
+// errTimestampSkew is returned by verify for correctly signed requests whose
+// timestamp lies outside the accepted window.
+var errTimestampSkew = errors.New("timestamp out of window")
+
 const (
 	version = "20170803"
 )
@@ -63,7 +73,9 @@ var bufPool = &sync.Pool{New: func() interface{} { return make([]byte, 1024*8) }
 // It supports both HTTP and HTTPS modes.
 type ProxyServer struct {
 	addr          string
+	extraAddrs    []string
 	secret        string
+	users         map[string]Authenticator
 	proxyMap      map[string]*proxyConn
 	mu            sync.Mutex
 	https         bool
@@ -72,6 +84,27 @@ type ProxyServer struct {
 	certPath      string
 	keyPath       string
 	mux           *http.ServeMux
+	limits        *connLimiter
+	dialTimeout   time.Duration
+	signTTL       time.Duration
+	heartTTL      time.Duration
+	idleTimeout   time.Duration
+	maxLifetime   time.Duration
+	clockSkew     time.Duration
+	clientCAPath  string
+	certAuth      bool
+	acl           ACL
+	resolver      Resolver
+	dnsPreference string
+	blockPrivate  bool
+	acme          acmeConfig
+	reverse       bool
+	endpoints     map[string]*reverseRegistration
+
+	extraCerts        []certPair
+	certs             *certLoader
+	certReload        time.Duration
+	certExpiryWarning time.Duration
 }
 
 // NewProxyServer creates a new proxy server with the given options.
@@ -84,17 +117,27 @@ type ProxyServer struct {
 //	)
 func NewProxyServer(opts ...ServerOption) *ProxyServer {
 	s := &ProxyServer{
-		proxyMap: make(map[string]*proxyConn),
-		logger:   DefaultLogger(),
-		mux:      http.NewServeMux(),
+		proxyMap:    make(map[string]*proxyConn),
+		endpoints:   make(map[string]*reverseRegistration),
+		logger:      DefaultLogger(),
+		mux:         http.NewServeMux(),
+		limits:      newConnLimiter(),
+		dialTimeout: defaultTimeout,
+		signTTL:     defaultSignTTL,
+		heartTTL:    defaultHeartTTL,
+		clockSkew:   defaultClockSkew,
+
+		certReload:        defaultCertReloadInterval,
+		certExpiryWarning: defaultCertExpiryWarning,
 	}
 
 	for _, opt := range opts {
 		opt(s)
 	}
 
-	// Set default authenticator if not provided
-	if s.authenticator == nil {
+	// Set default authenticator if not provided. Servers with users and
+	// no shared secret only accept users.
+	if s.authenticator == nil && (s.secret != "" || len(s.users) == 0) {
 		s.authenticator = NewHMACAuthenticator(s.secret)
 	}
 
@@ -119,45 +162,74 @@ func (s *ProxyServer) registerHandlers() {
 	s.mux.HandleFunc(PING, s.handlePing)
 	s.mux.HandleFunc(CHUNK_PULL, s.handleChunkPull)
 	s.mux.HandleFunc(CHUNK_PUSH, s.handleChunkPush)
+	s.mux.HandleFunc(LISTEN, s.handleListen)
 }
 
 func (s *ProxyServer) listenHTTPS() error {
-	s.logger.Info("starting the https/http2 server",
-		"addr", s.addr)
-
-	// Create HTTP/2 server with TLS
-	server := &http.Server{
-		Addr:    s.addr,
-		Handler: s.mux,
-		TLSConfig: &tls.Config{
-			MinVersion: tls.VersionTLS12,
-			NextProtos: []string{"h2", "http/1.1"},
-		},
+	tlsConfig, err := s.newTLSConfig()
+	if err != nil {
+		return err
 	}
 
-	// Configure HTTP/2
-	if err := http2.ConfigureServer(server, &http2.Server{}); err != nil {
-		return fmt.Errorf("error configuring http2: %w", err)
+	if s.acme.manager != nil && s.acme.httpAddr != "" {
+		go s.serveACMEChallenges(s.acme.manager)
 	}
+	if certs := s.certFiles(); certs != nil {
+		done := make(chan struct{})
+		defer close(done)
+		go certs.watch(done, s.certReload)
+	}
+	return s.serveAll(func(addr string) error {
+		s.logger.Info("starting the https/http2 server",
+			"addr", addr)
 
-	return server.ListenAndServeTLS(s.certPath, s.keyPath)
+		// Create HTTP/2 server with TLS
+		server := &http.Server{
+			Addr:      addr,
+			Handler:   s.mux,
+			TLSConfig: tlsConfig,
+		}
+
+		// Configure HTTP/2
+		if err := http2.ConfigureServer(server, &http2.Server{}); err != nil {
+			return fmt.Errorf("error configuring http2: %w", err)
+		}
+		return server.ListenAndServeTLS("", "")
+	})
 }
 
 func (s *ProxyServer) listen() error {
-	s.logger.Info("starting the http/http2 server (h2c)",
-		"addr", s.addr)
+	return s.serveAll(func(addr string) error {
+		s.logger.Info("starting the http/http2 server (h2c)",
+			"addr", addr)
+
+		// Create HTTP/2 server without TLS (h2c - HTTP/2 cleartext)
+		h2s := &http2.Server{}
+		server := &http.Server{
+			Addr:    addr,
+			Handler: h2c.NewHandler(s.mux, h2s),
+		}
 
-	// Create HTTP/2 server without TLS (h2c - HTTP/2 cleartext)
-	h2s := &http2.Server{}
-	server := &http.Server{
-		Addr:    s.addr,
-		Handler: h2c.NewHandler(s.mux, h2s),
-	}
+		return server.ListenAndServe()
+	})
+}
 
-	return server.ListenAndServe()
+// serveAll runs serve for every listen address and returns the first error.
+func (s *ProxyServer) serveAll(serve func(addr string) error) error {
+	addrs := append([]string{s.addr}, s.extraAddrs...)
+	errc := make(chan error, len(addrs))
+	for _, addr := range addrs {
+		go func() {
+			errc <- serve(addr)
+		}()
+	}
+	return <-errc
 }
 
 func (s *ProxyServer) verify(r *http.Request) error {
+	if s.certAuth && peerCertificate(r) != nil {
+		return nil
+	}
 	ts := r.Header.Get("timestamp")
 	if ts == "" {
 		return errors.New("timestamp is empty")
@@ -167,21 +239,64 @@ func (s *ProxyServer) verify(r *http.Request) error {
 	if err != nil {
 		return fmt.Errorf("timestamp invalid: %w", err)
 	}
-	now := time.Now().Unix()
-	if now-tm > signTTL {
-		return errors.New("timestamp expire")
+	auth := s.authenticator
+	if name := r.Header.Get("User"); name != "" {
+		var ok bool
+		if auth, ok = s.users[name]; !ok {
+			return fmt.Errorf("unknown user %q", name)
+		}
+	} else if auth == nil {
+		return errors.New("user is empty")
 	}
-	if s.authenticator.Verify(ts, sign) {
-		return nil
+	if !auth.Verify(ts, sign) {
+		return errors.New("sign invalid")
 	}
-	return errors.New("sign invalid")
+	age := time.Since(time.Unix(tm, 0))
+	if age > s.signTTL+s.clockSkew || age < -s.clockSkew {
+		return fmt.Errorf("%w: timestamp is %v off", errTimestampSkew, age)
+	}
+	return nil
+}
+
+// clientID returns the key used to account tunnels to the requesting client:
+// the identity of its certificate if it presented one, or else its user
+// name, or else its IP.
+func (s *ProxyServer) clientID(r *http.Request) string {
+	if cert := peerCertificate(r); cert != nil {
+		if id := CertificateIdentity(cert); id != "" {
+			return id
+		}
+	}
+	if name := s.user(r); name != "" {
+		return name
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// user returns the name of the server user the request is signed by, if any.
+// Requests authenticated by their client certificate are not signed.
+func (s *ProxyServer) user(r *http.Request) string {
+	if s.certAuth && peerCertificate(r) != nil {
+		return ""
+	}
+	return r.Header.Get("User")
 }
 
 func (s *ProxyServer) before(w http.ResponseWriter, r *http.Request) error {
 	err := s.verify(r)
 	if err != nil {
 		s.logger.Warn("error while verifying the request",
+			"client", s.clientID(r),
 			"msg", err)
+		// only correctly signed requests learn the server time, so the
+		// hint does not reveal the proxy to unauthenticated probes
+		if errors.Is(err, errTimestampSkew) {
+			w.Header().Set(serverTimeHeader, strconv.FormatInt(time.Now().Unix(), 10))
+		}
 		WriteNotFoundError(w, "404")
 	}
 	return err
@@ -230,13 +345,19 @@ func (s *ProxyServer) handlePull(w http.ResponseWriter, r *http.Request) {
 	if t > 0 {
 		pc.remote.SetReadDeadline(time.Now().Add(time.Duration(t)))
 		n, err := pc.remote.Read(buf)
+		if n == 0 && err == io.EOF {
+			// the remote host is done sending, the client may still write
+			WriteHTTPQuit(w, "eof")
+			return
+		}
 		if n > 0 {
+			pc.Touch()
 			w.Write(buf[:n])
 		}
 		if err != nil {
 			if err, ok := err.(net.Error); ok && err.Timeout() {
-			} else {
-				if err != io.EOF && !pc.IsClosed() {
+			} else if err != io.EOF {
+				if !pc.IsClosed() {
 					s.logger.Error("error", "msg", err)
 				}
 				s.logger.Debug("closing the remote conn",
@@ -253,17 +374,23 @@ func (s *ProxyServer) handlePull(w http.ResponseWriter, r *http.Request) {
 			"msg", "can't convert to http.Flusher")
 	}
 	w.Header().Set("Transfer-Encoding", "chunked")
-	defer pc.Close()
 	for {
 		flusher.Flush()
 		n, err := pc.remote.Read(buf)
 		if n > 0 {
+			pc.Touch()
 			w.Write(buf[:n])
 		}
+		if err == io.EOF {
+			// end the stream but keep the tunnel open for the client to
+			// finish sending
+			return
+		}
 		if err != nil {
-			if err != io.EOF && !pc.IsClosed() {
+			if !pc.IsClosed() {
 				s.logger.Error("error", "msg", err)
 			}
+			pc.Close()
 			return
 		}
 	}
@@ -297,8 +424,14 @@ func (s *ProxyServer) handlePush(w http.ResponseWriter, r *http.Request) {
 		s.logger.Debug("closing the remote conn",
 			"uuid", uuid)
 		pc.Close()
+	case EOF_TYP:
+		s.logger.Debug("half-closing the remote conn",
+			"uuid", uuid)
+		if err := pc.CloseWrite(); err != nil {
+			s.logger.Warn("error", "uuid", uuid, "msg", err)
+		}
 	case DATA_TYP:
-		_, err := io.Copy(pc.remote, r.Body)
+		_, err := io.Copy(pc.remote, activityReader{r.Body, pc})
 		if err != nil && err != io.EOF {
 			if !pc.IsClosed() {
 				s.logger.Error("error", "msg", err)
@@ -317,27 +450,99 @@ func (s *ProxyServer) handleConnect(w http.ResponseWriter, r *http.Request) {
 
 	host := r.Header.Get("DSTHOST")
 	port := r.Header.Get("DSTPORT")
-	addr := fmt.Sprintf("%s:%s", host, port)
-	remote, err := net.DialTimeout("tcp", addr, time.Second*timeout)
+	addr := net.JoinHostPort(host, port)
+	client := s.clientID(r)
+	source := tunnelSource(r.Header)
+	reg := s.endpoint(host)
+	req := &TunnelRequest{
+		Client:      client,
+		User:        s.user(r),
+		RemoteAddr:  r.RemoteAddr,
+		Certificate: peerCertificate(r),
+		Host:        host,
+		Port:        port,
+		Source:      source,
+	}
+	// denied and limited clients get no lookups of names of their choosing
+	if s.acl != nil {
+		if err := s.acl.Allow(req); err != nil {
+			s.logger.Warn("connect denied",
+				"client", client,
+				"addr", addr,
+				"msg", err)
+			WriteHTTPForbidden(w, err.Error())
+			return
+		}
+	}
+	if err := s.limits.acquire(client); err != nil {
+		s.logger.Warn("connect rejected",
+			"client", client,
+			"addr", addr,
+			"msg", err)
+		WriteHTTPLimited(w, err.Error())
+		return
+	}
+	var remote net.Conn
+	var err error
+	if reg != nil {
+		remote, err = reg.dial(s.dialTimeout)
+	} else if req.Addrs, err = s.resolve(r.Context(), host); err == nil {
+		if err := s.allowAddrs(req); err != nil {
+			s.limits.release(client)
+			s.logger.Warn("connect denied",
+				"client", client,
+				"addr", addr,
+				"msg", err)
+			WriteHTTPForbidden(w, err.Error())
+			return
+		}
+		remote, err = s.dial(req.Addrs, port)
+	}
 	if err != nil {
+		s.limits.release(client)
 		WriteHTTPError(w, fmt.Sprintf("connect %s %v", addr, err))
 		return
 	}
-	s.logger.Info("connect success", "addr", addr)
+	attrs := []any{"addr", addr, "client", client}
+	if source.Addr != "" {
+		attrs = append(attrs, "src", source.Addr)
+	}
+	if source.Protocol != "" {
+		attrs = append(attrs, "proto", source.Protocol)
+	}
+	if source.User != "" {
+		attrs = append(attrs, "srcuser", source.User)
+	}
+	s.logger.Info("connect success", attrs...)
+	WriteHTTPOK(w, s.openTunnel(remote, client, addr))
+}
+
+// openTunnel registers a tunnel to remote for client and returns its id.
+// The tunnel slot of client, which the caller acquired, is released when
+// the tunnel ends.
+func (s *ProxyServer) openTunnel(remote net.Conn, client, addr string) string {
 	proxyID := uuid.New().String()
 	pc := newProxyConn(remote, proxyID)
+	pc.heartTTL = s.heartTTL
+	pc.idleTimeout = s.idleTimeout
+	pc.maxLifetime = s.maxLifetime
 	s.mu.Lock()
 	s.proxyMap[proxyID] = pc
 	s.mu.Unlock()
 
 	go func() {
-		pc.Do()
+		reason := pc.Do()
 		s.mu.Lock()
 		delete(s.proxyMap, proxyID)
 		s.mu.Unlock()
-		s.logger.Info("disconnect", "addr", addr)
+		s.limits.release(client)
+		if reason != nil {
+			s.logger.Info("disconnect", "addr", addr, "client", client, "reason", reason)
+		} else {
+			s.logger.Info("disconnect", "addr", addr, "client", client)
+		}
 	}()
-	WriteHTTPOK(w, proxyID)
+	return proxyID
 }
 
 func (s *ProxyServer) handleChunkPush(w http.ResponseWriter, r *http.Request) {
@@ -410,14 +615,17 @@ func (s *ProxyServer) ListenHTTPS(cert, key string) {
 	s.logger.Info("starting the https/http2 server",
 		"addr", s.addr)
 
+	tlsConfig, err := s.newTLSConfig()
+	if err != nil {
+		s.logger.Error("error", "msg", err)
+		return
+	}
+
 	// Create HTTP/2 server with TLS
 	server := &http.Server{
-		Addr:    s.addr,
-		Handler: nil,
-		TLSConfig: &tls.Config{
-			MinVersion: tls.VersionTLS12,
-			NextProtos: []string{"h2", "http/1.1"},
-		},
+		Addr:      s.addr,
+		Handler:   nil,
+		TLSConfig: tlsConfig,
 	}
 
 	// Configure HTTP/2
@@ -426,7 +634,12 @@ func (s *ProxyServer) ListenHTTPS(cert, key string) {
 		return
 	}
 
-	s.logger.Error("error", "msg", server.ListenAndServeTLS(cert, key))
+	if certs := s.certFiles(); certs != nil {
+		done := make(chan struct{})
+		defer close(done)
+		go certs.watch(done, s.certReload)
+	}
+	s.logger.Error("error", "msg", server.ListenAndServeTLS("", ""))
 }
 
 // Listen starts the server in HTTP mode (h2c).
@@ -4,6 +4,8 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"net/http/httptest"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -32,6 +34,18 @@ func startProxyServer() {
 	serverHaveStart = true
 }
 
+// newTestProxyServer starts a ProxyServer with the given options on an
+// ephemeral port and returns it along with its base URL.
+func newTestProxyServer(t *testing.T, opts ...ServerOption) (*ProxyServer, string) {
+	t.Helper()
+	opts = append([]ServerOption{WithServerSecret(testSecret)}, opts...)
+	s := NewProxyServer(opts...)
+	s.registerHandlers()
+	ts := httptest.NewServer(s.mux)
+	t.Cleanup(ts.Close)
+	return s, ts.URL
+}
+
 func TestHandler_Connect(t *testing.T) {
 	startProxyServer()
 
@@ -48,3 +62,38 @@ func TestHandler_Connect(t *testing.T) {
 		t.Error("body not equal 404")
 	}
 }
+
+func TestServerUsers(t *testing.T) {
+	var got *TunnelRequest
+	s := NewProxyServer(
+		WithServerUser("alice", "alice-secret"),
+		WithACL(ACLFunc(func(req *TunnelRequest) error {
+			got = req
+			return nil
+		})),
+	)
+	s.registerHandlers()
+	ts := httptest.NewServer(s.mux)
+	defer ts.Close()
+	addr := strings.TrimPrefix(ts.URL, "http://")
+
+	alice := NewClient(WithServerURL(ts.URL), WithUser("alice"), WithSecret("alice-secret"))
+	conn, err := alice.Connect(addr)
+	if err != nil {
+		t.Fatalf("Connect() as user error = %v", err)
+	}
+	conn.Close()
+	if got == nil || got.User != "alice" || got.Client != "alice" {
+		t.Errorf("TunnelRequest = %+v, want user and client alice", got)
+	}
+
+	for name, c := range map[string]*Client{
+		"wrong secret": NewClient(WithServerURL(ts.URL), WithUser("alice"), WithSecret("other")),
+		"unknown user": NewClient(WithServerURL(ts.URL), WithUser("bob"), WithSecret("alice-secret")),
+		"no user":      NewClient(WithServerURL(ts.URL)),
+	} {
+		if _, err := c.Connect(addr); err == nil {
+			t.Errorf("Connect() with %s succeeded", name)
+		}
+	}
+}
@@ -0,0 +1,393 @@
+package h2go
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/textproto"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// maxSkippedBody is the size up to which the body of a request that is not
+// forwarded is skipped to keep the client connection.
+const maxSkippedBody = 64 << 10
+
+// hopHeaders are the hop-by-hop headers of HTTP/1.1, which a proxy must not
+// forward (RFC 9110, section 7.6.1).
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// removeHopHeaders removes the hop-by-hop headers from h, including those
+// listed in its Connection header.
+func removeHopHeaders(h http.Header) {
+	for _, v := range h.Values("Connection") {
+		for _, name := range strings.Split(v, ",") {
+			if name = textproto.TrimString(name); name != "" {
+				h.Del(name)
+			}
+		}
+	}
+	for _, name := range hopHeaders {
+		h.Del(name)
+	}
+}
+
+// upgradeType returns the protocol h asks to switch to, if any.
+func upgradeType(h http.Header) string {
+	for _, v := range h.Values("Connection") {
+		for _, name := range strings.Split(v, ",") {
+			if strings.EqualFold(textproto.TrimString(name), "upgrade") {
+				return h.Get("Upgrade")
+			}
+		}
+	}
+	return ""
+}
+
+// errMissingHost is returned for proxy requests without a destination.
+var errMissingHost = errors.New("missing host")
+
+// connectRequestKey is the context key of the ConnectRequest of a proxied
+// HTTP request.
+type connectRequestKey struct{}
+
+// httpForwarder forwards the plain HTTP requests of a client connection,
+// keeping a connection to each origin server open for reuse.
+type httpForwarder struct {
+	s         *LocalServer
+	conn      net.Conn
+	transport *http.Transport
+}
+
+// newHTTPForwarder returns a forwarder for the requests read from conn,
+// which connects to origin servers through handler.
+func (s *LocalServer) newHTTPForwarder(conn net.Conn, handler ProxyHandler) *httpForwarder {
+	f := &httpForwarder{s: s, conn: conn}
+	f.transport = &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			req, _ := ctx.Value(connectRequestKey{}).(*ConnectRequest)
+			if req == nil {
+				req = &ConnectRequest{Protocol: ProtocolHTTP}
+			}
+			req.Addr = addr
+			rwc, err := s.connect(handler, conn, req)
+			if err != nil {
+				return nil, err
+			}
+			return netConn(rwc, addr), nil
+		},
+		DisableCompression:    true,
+		ExpectContinueTimeout: time.Second,
+		IdleConnTimeout:       90 * time.Second,
+	}
+	return f
+}
+
+// close closes the connections to origin servers.
+func (f *httpForwarder) close() {
+	f.transport.CloseIdleConnections()
+}
+
+// roundTrip forwards req, read from the client for user, with body as its
+// body if not nil, and returns the response of the origin server.
+func (f *httpForwarder) roundTrip(req *http.Request, user string, body io.ReadCloser) (*http.Response, error) {
+	if req.URL.Host == "" {
+		req.URL.Host = req.Host
+	}
+	if req.URL.Scheme == "" {
+		req.URL.Scheme = "http"
+	}
+	if req.URL.Host == "" {
+		return nil, errMissingHost
+	}
+
+	ctx := context.WithValue(req.Context(), connectRequestKey{}, &ConnectRequest{
+		Protocol: ProtocolHTTP,
+		Method:   req.Method,
+		User:     user,
+		Header:   req.Header,
+	})
+	out := req.Clone(ctx)
+	out.RequestURI = ""
+	out.Close = false
+	upgrade := upgradeType(req.Header)
+	removeHopHeaders(out.Header)
+	if upgrade != "" {
+		out.Header.Set("Connection", "Upgrade")
+		out.Header.Set("Upgrade", upgrade)
+	}
+	addVia(out.Header, req.ProtoMajor, req.ProtoMinor)
+	if body != nil {
+		out.Body = body
+	}
+
+	res, err := f.transport.RoundTrip(out)
+	if err != nil {
+		return nil, err
+	}
+	f.s.Logger.Info("http",
+		"local", f.conn.RemoteAddr().String(),
+		"method", req.Method,
+		"url", req.URL.String(),
+		"proto", req.Proto,
+		"status", res.StatusCode)
+	return res, nil
+}
+
+// errorStatus returns the status of the response to a request that could
+// not be forwarded because of err.
+func errorStatus(err error) int {
+	switch {
+	case errors.Is(err, errMissingHost):
+		return http.StatusBadRequest
+	case errors.Is(err, ErrBlocked), errors.Is(err, ErrForbidden):
+		return http.StatusForbidden
+	}
+	return http.StatusBadGateway
+}
+
+// serve forwards req, read from br for user, and writes the response to the
+// client. It reports whether the client connection can carry another
+// request.
+func (f *httpForwarder) serve(br *bufio.Reader, req *http.Request, user string) (keepAlive bool, err error) {
+	var body *proxyBody
+	var rc io.ReadCloser
+	if req.Body != nil && req.Body != http.NoBody {
+		body = &proxyBody{
+			ReadCloser: req.Body,
+			conn:       f.conn,
+			expect:     strings.EqualFold(req.Header.Get("Expect"), "100-continue"),
+		}
+		rc = body
+	}
+	res, err := f.roundTrip(req, user, rc)
+	if err != nil {
+		writeHTTPStatus(f.conn, errorStatus(err), err.Error())
+		return false, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusSwitchingProtocols {
+		return false, f.switchProtocols(br, res)
+	}
+
+	removeHopHeaders(res.Header)
+	addVia(res.Header, res.ProtoMajor, res.ProtoMinor)
+	// the client connection is out of sync if its request body was not
+	// read to the end
+	keepAlive = !req.Close && (body == nil || body.done.Load())
+	// the version of the response is that of the hop to the client
+	res.Proto, res.ProtoMajor, res.ProtoMinor = "HTTP/1.1", 1, 1
+	if !req.ProtoAtLeast(1, 1) {
+		res.Proto, res.ProtoMajor, res.ProtoMinor = "HTTP/1.0", 1, 0
+		// HTTP/1.0 has no chunked encoding to delimit the body
+		keepAlive = keepAlive && res.ContentLength >= 0
+	}
+	res.Close = !keepAlive
+	if err := res.Write(f.conn); err != nil {
+		return false, err
+	}
+	return keepAlive, nil
+}
+
+// switchProtocols relays a connection the origin server switched to
+// another protocol, such as WebSocket.
+func (f *httpForwarder) switchProtocols(br *bufio.Reader, res *http.Response) error {
+	upstream, ok := res.Body.(io.ReadWriteCloser)
+	if !ok {
+		return errors.New("switching protocols: upstream connection is not writable")
+	}
+	res.Body = nil
+	addVia(res.Header, res.ProtoMajor, res.ProtoMinor)
+	if err := res.Write(f.conn); err != nil {
+		return err
+	}
+	return f.s.transport(&readerConn{Conn: f.conn, r: br}, upstream)
+}
+
+// dumpRequest returns the head of req for debug logs, with the values of
+// credential headers redacted.
+func dumpRequest(req *http.Request) string {
+	r := *req
+	r.Header = req.Header.Clone()
+	for _, key := range []string{"Authorization", "Proxy-Authorization"} {
+		if _, ok := r.Header[key]; ok {
+			r.Header.Set(key, "[redacted]")
+		}
+	}
+	dump, _ := httputil.DumpRequest(&r, false)
+	return string(dump)
+}
+
+// proxyUser returns the user req authenticates as with a Basic
+// Proxy-Authorization header, and removes the header. It reports whether
+// the credentials are valid, or not needed because users is empty.
+func proxyUser(req *http.Request, users map[string]string) (string, bool) {
+	auth := req.Header.Get("Proxy-Authorization")
+	req.Header.Del("Proxy-Authorization")
+	if len(users) == 0 {
+		return "", true
+	}
+	scheme, credentials, _ := strings.Cut(auth, " ")
+	if !strings.EqualFold(scheme, "Basic") {
+		return "", false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(credentials))
+	if err != nil {
+		return "", false
+	}
+	user, password, ok := strings.Cut(string(decoded), ":")
+	if !ok || !checkPassword(users, user, password) {
+		return "", false
+	}
+	return user, true
+}
+
+// requireProxyAuth answers req with 407 Proxy Authentication Required. It
+// reports whether the client connection can carry another request, which
+// is the case if the request body, if any, could be skipped.
+func requireProxyAuth(w io.Writer, req *http.Request) (keepAlive bool, err error) {
+	keepAlive = !req.Close && !strings.EqualFold(req.Header.Get("Expect"), "100-continue")
+	if keepAlive && req.Body != nil && req.Body != http.NoBody {
+		n, _ := io.Copy(io.Discard, io.LimitReader(req.Body, maxSkippedBody+1))
+		keepAlive = n <= maxSkippedBody
+	}
+	text := "proxy authentication required\n"
+	res := &http.Response{
+		StatusCode: http.StatusProxyAuthRequired,
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header: http.Header{
+			"Content-Type":       {"text/plain; charset=utf-8"},
+			"Proxy-Authenticate": {proxyAuthChallenge},
+		},
+		Body:          io.NopCloser(strings.NewReader(text)),
+		ContentLength: int64(len(text)),
+		Close:         !keepAlive,
+	}
+	if err := res.Write(w); err != nil {
+		return false, err
+	}
+	if !keepAlive {
+		return false, fmt.Errorf("%w: no valid credentials", ErrProxyAuth)
+	}
+	return true, nil
+}
+
+// addVia adds this proxy to the Via header of a message of the given
+// HTTP version.
+func addVia(h http.Header, major, minor int) {
+	h.Add("Via", fmt.Sprintf("%d.%d h2go", major, minor))
+}
+
+// writeHTTPStatus writes a response with the given status and text body
+// that closes the connection.
+func writeHTTPStatus(w io.Writer, code int, text string) error {
+	text += "\n"
+	res := &http.Response{
+		StatusCode:    code,
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": {"text/plain; charset=utf-8"}},
+		Body:          io.NopCloser(strings.NewReader(text)),
+		ContentLength: int64(len(text)),
+		Close:         true,
+	}
+	return res.Write(w)
+}
+
+// proxyBody is the body of a proxied request. If the client waits for
+// "100 Continue" before sending it, that is sent when the body is first
+// read, after the origin server asked for it.
+type proxyBody struct {
+	io.ReadCloser
+	conn   io.Writer
+	expect bool
+	once   sync.Once
+	done   atomic.Bool // the body was read to the end
+}
+
+func (b *proxyBody) Read(p []byte) (int, error) {
+	if b.expect {
+		var err error
+		b.once.Do(func() {
+			_, err = io.WriteString(b.conn, "HTTP/1.1 100 Continue\r\n\r\n")
+		})
+		if err != nil {
+			return 0, err
+		}
+	}
+	n, err := b.ReadCloser.Read(p)
+	if err == io.EOF {
+		b.done.Store(true)
+	}
+	return n, err
+}
+
+// readerConn is a net.Conn whose reads come from r, which buffers the
+// reads from the connection.
+type readerConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *readerConn) Read(b []byte) (int, error) { return c.r.Read(b) }
+
+// CloseWrite half-closes the connection if it supports it.
+func (c *readerConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return errors.ErrUnsupported
+}
+
+// netConn returns rwc, a connection to addr from a ProxyHandler, as a
+// net.Conn.
+func netConn(rwc io.ReadWriteCloser, addr string) net.Conn {
+	switch c := rwc.(type) {
+	case net.Conn:
+		return c
+	case *clientConnection:
+		return newTunnelConn(c, tunnelAddr(c.server), tunnelAddr(addr))
+	}
+	return &rwcConn{ReadWriteCloser: rwc, remote: tunnelAddr(addr)}
+}
+
+// rwcConn adapts an io.ReadWriteCloser to net.Conn. Deadlines are not
+// supported.
+type rwcConn struct {
+	io.ReadWriteCloser
+	remote net.Addr
+}
+
+func (c *rwcConn) LocalAddr() net.Addr                { return tunnelAddr("") }
+func (c *rwcConn) RemoteAddr() net.Addr               { return c.remote }
+func (c *rwcConn) SetDeadline(t time.Time) error      { return errors.ErrUnsupported }
+func (c *rwcConn) SetReadDeadline(t time.Time) error  { return errors.ErrUnsupported }
+func (c *rwcConn) SetWriteDeadline(t time.Time) error { return errors.ErrUnsupported }
+
+// CloseWrite half-closes the connection if it supports it.
+func (c *rwcConn) CloseWrite() error {
+	if cw, ok := c.ReadWriteCloser.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return errors.ErrUnsupported
+}
@@ -0,0 +1,281 @@
+package h2go
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// startOrigin starts an HTTP server that answers with its name, the
+// request URI, the Via header and the body, and counts its connections.
+func startOrigin(t *testing.T, name string) (*httptest.Server, *atomic.Int32) {
+	t.Helper()
+	var conns atomic.Int32
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Proxy-Connection") != "" {
+			http.Error(w, "hop-by-hop header forwarded", http.StatusBadRequest)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		fmt.Fprintf(w, "%s %s via=%q body=%q", name, r.RequestURI, r.Header.Get("Via"), body)
+	}))
+	ts.Config.ConnState = func(c net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			conns.Add(1)
+		}
+	}
+	ts.Start()
+	t.Cleanup(ts.Close)
+	return ts, &conns
+}
+
+// startHTTPProxy starts a LocalServer serving HTTP with a Direct handler and
+// returns its address.
+func startHTTPProxy(t *testing.T) string {
+	t.Helper()
+	addr := freeAddr(t)
+	s := NewLocalServer(
+		WithHTTPHandler(Direct{}),
+		WithListener(Listener{Addr: addr, Protocol: ProtocolHTTP}),
+	)
+	go s.ListenAndServe()
+	waitListening(t, "tcp", addr)
+	return addr
+}
+
+// readBody reads a response from br and returns its body.
+func readBody(t *testing.T, br *bufio.Reader) (*http.Response, string) {
+	t.Helper()
+	res, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatalf("ReadResponse() error = %v", err)
+	}
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatalf("reading body: %v", err)
+	}
+	return res, string(body)
+}
+
+func TestHTTPForwardProxy(t *testing.T) {
+	a, aConns := startOrigin(t, "a")
+	b, _ := startOrigin(t, "b")
+	proxyAddr := startHTTPProxy(t)
+
+	conn, err := net.Dial("tcp", proxyAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	br := bufio.NewReader(conn)
+
+	requests := []struct {
+		req  string
+		want string
+	}{
+		{
+			req:  "GET " + a.URL + "/one?x=1 HTTP/1.1\r\nHost: " + a.Listener.Addr().String() + "\r\nProxy-Connection: keep-alive\r\n\r\n",
+			want: `a /one?x=1 via="1.1 h2go" body=""`,
+		},
+		{
+			req:  "GET " + b.URL + "/two HTTP/1.1\r\nHost: " + b.Listener.Addr().String() + "\r\n\r\n",
+			want: `b /two via="1.1 h2go" body=""`,
+		},
+		{
+			req:  "POST " + a.URL + "/chunked HTTP/1.1\r\nHost: " + a.Listener.Addr().String() + "\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n6\r\n world\r\n0\r\n\r\n",
+			want: `a /chunked via="1.1 h2go" body="hello world"`,
+		},
+	}
+	for _, r := range requests {
+		if _, err := io.WriteString(conn, r.req); err != nil {
+			t.Fatal(err)
+		}
+		res, body := readBody(t, br)
+		if res.StatusCode != http.StatusOK || body != r.want {
+			t.Errorf("response = %d %q, want 200 %q", res.StatusCode, body, r.want)
+		}
+		if res.Header.Get("Via") == "" {
+			t.Errorf("response without Via header")
+		}
+	}
+	if n := aConns.Load(); n != 1 {
+		t.Errorf("origin a got %d connections, want 1 reused connection", n)
+	}
+}
+
+func TestHTTPForwardProxyExpectContinue(t *testing.T) {
+	a, _ := startOrigin(t, "a")
+	proxyAddr := startHTTPProxy(t)
+
+	conn, err := net.Dial("tcp", proxyAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	br := bufio.NewReader(conn)
+
+	io.WriteString(conn, "PUT "+a.URL+"/upload HTTP/1.1\r\nHost: "+a.Listener.Addr().String()+
+		"\r\nContent-Length: 4\r\nExpect: 100-continue\r\n\r\n")
+	line, err := br.ReadString('\n')
+	if err != nil || !strings.HasPrefix(line, "HTTP/1.1 100") {
+		t.Fatalf("interim response = %q, %v, want 100 Continue", line, err)
+	}
+	if _, err := br.ReadString('\n'); err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(conn, "data")
+	res, body := readBody(t, br)
+	if want := `a /upload via="1.1 h2go" body="data"`; res.StatusCode != http.StatusOK || body != want {
+		t.Errorf("response = %d %q, want 200 %q", res.StatusCode, body, want)
+	}
+}
+
+func TestHTTPForwardProxyErrors(t *testing.T) {
+	proxyAddr := startHTTPProxy(t)
+	unreachable := freeAddr(t)
+
+	conn, err := net.Dial("tcp", proxyAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	io.WriteString(conn, "GET http://"+unreachable+"/ HTTP/1.1\r\nHost: "+unreachable+"\r\n\r\n")
+	res, _ := readBody(t, bufio.NewReader(conn))
+	if res.StatusCode != http.StatusBadGateway {
+		t.Errorf("status = %d, want %d", res.StatusCode, http.StatusBadGateway)
+	}
+}
+
+func TestHTTPForwardProxyUpgrade(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Upgrade") != "echo" {
+			http.Error(w, "upgrade required", http.StatusUpgradeRequired)
+			return
+		}
+		conn, brw, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		brw.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+		brw.Flush()
+		io.Copy(conn, brw)
+	}))
+	defer origin.Close()
+	proxyAddr := startHTTPProxy(t)
+
+	conn, err := net.Dial("tcp", proxyAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	br := bufio.NewReader(conn)
+	io.WriteString(conn, "GET "+origin.URL+"/ HTTP/1.1\r\nHost: "+origin.Listener.Addr().String()+
+		"\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+	res, err := http.ReadResponse(br, nil)
+	if err != nil || res.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("response = %v, %v, want 101", res, err)
+	}
+	checkEcho(t, &readerConn{Conn: conn, r: br})
+}
+
+func TestHTTPProxyAuth(t *testing.T) {
+	echo := startEcho(t)
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Proxy-Authorization") != "" {
+			http.Error(w, "credentials forwarded", http.StatusBadRequest)
+		}
+	}))
+	defer origin.Close()
+	users := make(chan string, 2)
+	record := NewMiddleware(func(next ProxyHandler, ctx context.Context, req *ConnectRequest) (io.ReadWriteCloser, error) {
+		users <- req.User
+		return ConnectVia(ctx, next, req)
+	})
+	logs := &lockedBuffer{}
+	proxyAddr := freeAddr(t)
+	s := NewLocalServer(
+		WithHTTPHandler(Direct{}),
+		WithMiddleware(record),
+		WithListener(Listener{Addr: proxyAddr, Protocol: ProtocolHTTP, Users: map[string]string{"alice": "secret"}}),
+		WithLocalLogger(slog.New(slog.NewTextHandler(logs, &slog.HandlerOptions{Level: slog.LevelDebug}))),
+	)
+	go s.ListenAndServe()
+	waitListening(t, "tcp", proxyAddr)
+
+	conn, err := net.Dial("tcp", proxyAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	br := bufio.NewReader(conn)
+	host := origin.Listener.Addr().String()
+	get := "GET " + origin.URL + "/ HTTP/1.1\r\nHost: " + host + "\r\n"
+
+	for _, auth := range []string{"", "Proxy-Authorization: Basic " + base64.StdEncoding.EncodeToString([]byte("alice:wrong")) + "\r\n"} {
+		io.WriteString(conn, get+auth+"\r\n")
+		res, _ := readBody(t, br)
+		if res.StatusCode != http.StatusProxyAuthRequired || !strings.HasPrefix(res.Header.Get("Proxy-Authenticate"), "Basic ") {
+			t.Fatalf("response = %d %q, want 407 with a Basic challenge", res.StatusCode, res.Header.Get("Proxy-Authenticate"))
+		}
+	}
+
+	// the client retries on the same connection
+	valid := "Proxy-Authorization: Basic " + base64.StdEncoding.EncodeToString([]byte("alice:secret")) + "\r\n"
+	io.WriteString(conn, get+valid+"\r\n")
+	if res, body := readBody(t, br); res.StatusCode != http.StatusOK {
+		t.Fatalf("response = %d %q, want 200", res.StatusCode, body)
+	}
+	if user := <-users; user != "alice" {
+		t.Errorf("ConnectRequest.User = %q, want alice", user)
+	}
+
+	io.WriteString(conn, "CONNECT "+echo+" HTTP/1.1\r\nHost: "+echo+"\r\n"+valid+"\r\n")
+	res, err := http.ReadResponse(br, nil)
+	if err != nil || res.StatusCode != http.StatusOK {
+		t.Fatalf("CONNECT response = %v, %v, want 200", res, err)
+	}
+	if user := <-users; user != "alice" {
+		t.Errorf("ConnectRequest.User = %q, want alice", user)
+	}
+	checkEcho(t, &readerConn{Conn: conn, r: br})
+
+	if secret := base64.StdEncoding.EncodeToString([]byte("alice:secret")); strings.Contains(logs.String(), secret) {
+		t.Error("credentials were logged")
+	}
+}
+
+// lockedBuffer is a bytes.Buffer safe for concurrent use, e.g. by loggers.
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
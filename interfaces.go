@@ -9,6 +9,7 @@
 // The main interfaces are:
 //
 //   - Connector: For establishing proxy connections
+//   - ContextDialer: For dialing net.Conn connections with a context
 //   - Authenticator: For request authentication
 //   - HTTPClient: For making HTTP requests
 //
@@ -42,7 +43,9 @@
 package h2go
 
 import (
+	"context"
 	"io"
+	"net"
 	"net/http"
 )
 
@@ -57,6 +60,14 @@ type Connector interface {
 	Connect(addr string) (io.ReadWriteCloser, error)
 }
 
+// ContextDialer defines the interface for dialing connections with a
+// context. Client implements it, returning connections that support
+// deadlines and half-close, which Connect does not provide.
+type ContextDialer interface {
+	// DialContext connects to addr on the named network.
+	DialContext(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
 // Authenticator defines the interface for request authentication.
 // Implementations should provide methods for generating and verifying
 // authentication signatures.
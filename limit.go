@@ -0,0 +1,117 @@
+package h2go
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// Errors reported by the server when a tunnel is refused by a limit.
+var (
+	ErrTooManyTunnels     = errors.New("too many tunnels")
+	ErrConnectRateLimited = errors.New("connect rate exceeded")
+)
+
+// maxIdleBuckets is the number of per-client rate buckets kept before
+// full (idle) buckets are swept.
+const maxIdleBuckets = 1024
+
+// tokenBucket is a minimal token bucket rate limiter.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// connLimiter bounds the number of concurrent tunnels, globally and per
+// client, and the rate at which each client may open new tunnels.
+// A zero value for any limit disables it.
+type connLimiter struct {
+	mu           sync.Mutex
+	maxTotal     int
+	maxPerClient int
+	rate         float64
+	burst        int
+	total        int
+	perClient    map[string]int
+	buckets      map[string]*tokenBucket
+}
+
+func newConnLimiter() *connLimiter {
+	return &connLimiter{
+		perClient: make(map[string]int),
+		buckets:   make(map[string]*tokenBucket),
+	}
+}
+
+// acquire reserves a tunnel slot for client. Every successful call must be
+// paired with a call to release.
+func (l *connLimiter) acquire(client string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.maxTotal > 0 && l.total >= l.maxTotal {
+		return ErrTooManyTunnels
+	}
+	if l.maxPerClient > 0 && l.perClient[client] >= l.maxPerClient {
+		return ErrTooManyTunnels
+	}
+	if l.rate > 0 && !l.allow(client, time.Now()) {
+		return ErrConnectRateLimited
+	}
+
+	l.total++
+	l.perClient[client]++
+	return nil
+}
+
+// release frees a slot previously reserved with acquire.
+func (l *connLimiter) release(client string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.total--
+	if l.perClient[client] <= 1 {
+		delete(l.perClient, client)
+	} else {
+		l.perClient[client]--
+	}
+}
+
+// allow takes a token from the client's bucket. l.mu must be held.
+func (l *connLimiter) allow(client string, now time.Time) bool {
+	burst := float64(l.burst)
+	if burst < 1 {
+		burst = 1
+	}
+
+	b, ok := l.buckets[client]
+	if !ok {
+		if len(l.buckets) >= maxIdleBuckets {
+			l.sweep(now, burst)
+		}
+		b = &tokenBucket{tokens: burst, last: now}
+		l.buckets[client] = b
+	}
+
+	b.tokens += now.Sub(b.last).Seconds() * l.rate
+	if b.tokens > burst {
+		b.tokens = burst
+	}
+	b.last = now
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// sweep drops buckets that have refilled completely, since they carry no
+// state a fresh bucket would not. l.mu must be held.
+func (l *connLimiter) sweep(now time.Time, burst float64) {
+	for client, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= burst {
+			delete(l.buckets, client)
+		}
+	}
+}
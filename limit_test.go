@@ -0,0 +1,87 @@
+package h2go
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConnLimiterMaxTotal(t *testing.T) {
+	l := newConnLimiter()
+	l.maxTotal = 2
+
+	if err := l.acquire("a"); err != nil {
+		t.Fatalf("acquire() error = %v", err)
+	}
+	if err := l.acquire("b"); err != nil {
+		t.Fatalf("acquire() error = %v", err)
+	}
+	if err := l.acquire("c"); !errors.Is(err, ErrTooManyTunnels) {
+		t.Fatalf("acquire() error = %v, want %v", err, ErrTooManyTunnels)
+	}
+	l.release("a")
+	if err := l.acquire("c"); err != nil {
+		t.Fatalf("acquire() after release error = %v", err)
+	}
+}
+
+func TestConnLimiterPerClient(t *testing.T) {
+	l := newConnLimiter()
+	l.maxPerClient = 1
+
+	if err := l.acquire("a"); err != nil {
+		t.Fatalf("acquire() error = %v", err)
+	}
+	if err := l.acquire("a"); !errors.Is(err, ErrTooManyTunnels) {
+		t.Fatalf("acquire() error = %v, want %v", err, ErrTooManyTunnels)
+	}
+	if err := l.acquire("b"); err != nil {
+		t.Fatalf("acquire() for other client error = %v", err)
+	}
+	l.release("a")
+	if _, ok := l.perClient["a"]; ok {
+		t.Error("released client still tracked")
+	}
+}
+
+func TestConnLimiterRate(t *testing.T) {
+	l := newConnLimiter()
+	l.rate = 1
+	l.burst = 2
+
+	now := time.Now()
+	if !l.allow("a", now) || !l.allow("a", now) {
+		t.Fatal("burst connects should be allowed")
+	}
+	if l.allow("a", now) {
+		t.Fatal("connect beyond burst should be refused")
+	}
+	if !l.allow("b", now) {
+		t.Fatal("other clients should have their own bucket")
+	}
+	if !l.allow("a", now.Add(time.Second)) {
+		t.Fatal("bucket should refill over time")
+	}
+}
+
+func TestProxyServerTunnelLimit(t *testing.T) {
+	_, url := newTestProxyServer(t, WithMaxTunnelsPerClient(1))
+
+	client := NewClient(
+		WithServerURL(url),
+		WithSecret(testSecret),
+		WithInterval(time.Millisecond*20),
+	)
+
+	conn, err := client.Connect(strings.TrimPrefix(url, "http://"))
+	if err != nil {
+		t.Fatalf("Connect() error = %v", err)
+	}
+	defer conn.Close()
+
+	_, err = client.Connect(strings.TrimPrefix(url, "http://"))
+	if !errors.Is(err, ErrLimitExceeded) {
+		t.Fatalf("Connect() error = %v, want %v", err, ErrLimitExceeded)
+	}
+}
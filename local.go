@@ -11,12 +11,36 @@ import (
 	"log/slog"
 	"net/http"
 	"os"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"golang.org/x/net/http2"
 )
 
+// ErrLimitExceeded is returned by Client.Connect when the server refuses a
+// tunnel because a concurrency or connect rate limit was reached.
+var ErrLimitExceeded = errors.New("server limit exceeded")
+
+// ErrClockSkew is returned by Client.Connect when the server rejects the
+// request timestamps because the local clock differs too much from its own.
+var ErrClockSkew = errors.New("clock skew detected")
+
+// clockSkewError reports the offset of the server clock from the local one,
+// as derived from the server's time hint.
+type clockSkewError struct {
+	offset time.Duration
+}
+
+func (e *clockSkewError) Error() string {
+	return fmt.Sprintf("%v: server clock is %v ahead of the local clock", ErrClockSkew, e.offset.Round(time.Second))
+}
+
+func (e *clockSkewError) Unwrap() error {
+	return ErrClockSkew
+}
+
 // defaultHTTPClient is the default HTTP client used when none is provided.
 // It is initialized lazily when needed.
 var defaultHTTPClient HTTPClient
@@ -119,39 +143,59 @@ type clientConnection struct {
 	uuid          string
 	server        string
 	secret        string
+	user          string
 	source        io.ReadCloser
 	close         chan bool
 	closed        bool
 	closeMu       sync.Mutex
 	interval      time.Duration
+	timeout       time.Duration
+	heartbeat     time.Duration
+	clockOffset   *atomic.Int64
 	dst           io.WriteCloser
+	pushDone      chan struct{} // closed when the chunked push to dst ends
+	pushMu        sync.Mutex    // guards dst and pushDone
+	writeClosed   atomic.Bool   // set by CloseWrite
+	eof           bool          // the remote host is done sending
 	logger        *slog.Logger
 	httpClient    HTTPClient
 	authenticator Authenticator
 }
 
-// newClientConnection creates a new client connection.
-func newClientConnection(server, secret string, interval time.Duration, logger *slog.Logger, httpClient HTTPClient, auth Authenticator) *clientConnection {
+// newClientConnection creates a new client connection to server using the
+// settings of c.
+func newClientConnection(server string, c *Client) *clientConnection {
 	return &clientConnection{
 		server:        server,
-		secret:        secret,
-		interval:      interval,
-		logger:        logger,
-		httpClient:    httpClient,
-		authenticator: auth,
+		secret:        c.secret,
+		user:          c.user,
+		interval:      c.interval,
+		timeout:       c.timeout,
+		heartbeat:     c.heartbeat,
+		clockOffset:   &c.clockOffset,
+		logger:        c.logger,
+		httpClient:    c.httpClient,
+		authenticator: c.authenticator,
 	}
 }
 
 func (c *clientConnection) genSign(req *http.Request) {
-	ts := fmt.Sprintf("%d", time.Now().Unix())
+	now := time.Now().Add(time.Duration(c.clockOffset.Load()))
+	ts := fmt.Sprintf("%d", now.Unix())
 	req.Header.Set("UUID", c.uuid)
 	req.Header.Set("timestamp", ts)
 	req.Header.Set("sign", c.authenticator.Sign(ts))
+	if c.user != "" {
+		req.Header.Set("User", c.user)
+	}
 }
 
 func (c *clientConnection) chunkPush(data []byte, typ string) error {
+	c.pushMu.Lock()
 	if c.dst != nil {
-		_, err := c.dst.Write(data)
+		dst := c.dst
+		c.pushMu.Unlock()
+		_, err := dst.Write(data)
 		return err
 	}
 	wr, ww := io.Pipe()
@@ -170,7 +214,10 @@ func (c *clientConnection) chunkPush(data []byte, typ string) error {
 	req.Header.Set("Transfer-Encoding", "chunked")
 	c.genSign(req)
 	req.Header.Set("Content-Type", "image/jpeg")
+	pushDone := make(chan struct{})
+	c.pushDone = pushDone
 	go func() (err error) {
+		defer close(pushDone)
 		defer wr.Close()
 		defer ww.Close()
 		res, err := c.httpClient.Do(req)
@@ -195,13 +242,14 @@ func (c *clientConnection) chunkPush(data []byte, typ string) error {
 	}()
 
 	c.dst = ww
-	_, err = c.dst.Write(data)
+	c.pushMu.Unlock()
+	_, err = ww.Write(data)
 	return err
 }
 
 func (c *clientConnection) push(data []byte, typ string) error {
 	buf := bytes.NewBuffer(data)
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second*timeout)
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
 	defer cancel()
 	req, err := http.NewRequestWithContext(ctx, "POST", c.server+PUSH, buf)
 	if err != nil {
@@ -238,8 +286,10 @@ func (c *clientConnection) push(data []byte, typ string) error {
 	}
 }
 
-func (c *clientConnection) connect(dstHost, dstPort string) (uuid string, err error) {
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second*timeout)
+// connect asks the server to open a tunnel to dstHost:dstPort, sending the
+// metadata of src, and returns its id.
+func (c *clientConnection) connect(ctx context.Context, dstHost, dstPort string, src *ConnectRequest) (uuid string, err error) {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
 	defer cancel()
 	req, err := http.NewRequestWithContext(ctx, "GET", c.server+CONNECT, nil)
 	if err != nil {
@@ -248,6 +298,7 @@ func (c *clientConnection) connect(dstHost, dstPort string) (uuid string, err er
 	c.genSign(req)
 	req.Header.Set("DSTHOST", dstHost)
 	req.Header.Set("DSTPORT", dstPort)
+	src.setHeader(req.Header)
 	c.logger.Debug("connect",
 		"server", c.server+CONNECT,
 		"dstHost", dstHost,
@@ -261,11 +312,60 @@ func (c *clientConnection) connect(dstHost, dstPort string) (uuid string, err er
 		return "", err
 	}
 	res.Body.Close()
+	if err := responseError(res, body); err != nil {
+		return "", err
+	}
+	return string(body), nil
+}
+
+// listen asks the server to accept connections on host:port, or on the
+// virtual endpoint host if port is empty. The returned response streams the
+// ids of the tunnels of accepted connections until ctx is canceled.
+func (c *clientConnection) listen(ctx context.Context, host, port string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", c.server+LISTEN, nil)
+	if err != nil {
+		return nil, err
+	}
+	c.genSign(req)
+	req.Header.Set("DSTHOST", host)
+	req.Header.Set("DSTPORT", port)
+	c.logger.Debug("listen",
+		"server", c.server+LISTEN,
+		"host", host,
+		"port", port)
+	res, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
 	if res.StatusCode != HeadOK {
-		return "", fmt.Errorf("status code is %d, body is:%s", res.StatusCode, string(body))
+		body, err := io.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		return nil, responseError(res, body)
 	}
-	return string(body), err
+	return res, nil
+}
 
+// responseError returns the error a server response other than HeadOK
+// stands for.
+func responseError(res *http.Response, body []byte) error {
+	switch res.StatusCode {
+	case HeadOK:
+		return nil
+	case HeadForbidden:
+		return fmt.Errorf("%w: %s", ErrForbidden, string(body))
+	case HeadLimited:
+		return fmt.Errorf("%w: %s", ErrLimitExceeded, string(body))
+	}
+	if hint := res.Header.Get(serverTimeHeader); res.StatusCode == HeadNotFound && hint != "" {
+		serverTime, err := strconv.ParseInt(hint, 10, 64)
+		if err == nil {
+			return &clockSkewError{offset: time.Until(time.Unix(serverTime, 0))}
+		}
+	}
+	return fmt.Errorf("status code is %d, body is:%s", res.StatusCode, string(body))
 }
 
 func (c *clientConnection) pull() error {
@@ -277,7 +377,7 @@ func (c *clientConnection) pull() error {
 	req.Header.Set("Interval", fmt.Sprintf("%d", c.interval))
 	c.genSign(req)
 	if c.interval > 0 {
-		ctx, cancel := context.WithTimeout(context.Background(), time.Second*timeout)
+		ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
 		defer cancel()
 		req = req.WithContext(ctx)
 	}
@@ -288,6 +388,11 @@ func (c *clientConnection) pull() error {
 	if err != nil {
 		return err
 	}
+	if res.StatusCode == HeadQuit {
+		res.Body.Close()
+		c.eof = true
+		return io.EOF
+	}
 	if res.StatusCode != HeadOK {
 		body, err := io.ReadAll(res.Body)
 		if err != nil {
@@ -302,7 +407,9 @@ func (c *clientConnection) pull() error {
 
 // Read reads data from the connection.
 func (c *clientConnection) Read(b []byte) (n int, err error) {
-
+	if c.eof {
+		return 0, io.EOF
+	}
 	if c.source == nil {
 		if c.interval > 0 {
 			if err = c.pull(); err != nil {
@@ -324,15 +431,21 @@ func (c *clientConnection) Read(b []byte) (n int, err error) {
 		c.source.Close()
 		c.source = nil
 	}
-	if err == io.EOF && c.interval > 0 {
-		err = nil
+	if err == io.EOF {
+		if c.interval > 0 {
+			err = nil
+		} else {
+			c.eof = true
+		}
 	}
 	return
 }
 
 // Write writes data to the connection.
 func (c *clientConnection) Write(b []byte) (int, error) {
-
+	if c.writeClosed.Load() {
+		return 0, errWriteClosed
+	}
 	var err error
 	if c.interval > 0 {
 		err = c.push(b, DATA_TYP)
@@ -353,7 +466,7 @@ func (c *clientConnection) alive() {
 		select {
 		case <-c.close:
 			return
-		case <-time.After(time.Second * heartTTL / 2):
+		case <-time.After(c.heartbeat):
 			if err := c.push([]byte("alive"), HEART_TYP); err != nil {
 				return
 			}
@@ -382,9 +495,38 @@ func (c *clientConnection) Close() error {
 	c.logger.Debug("close",
 		"uuid", c.uuid)
 	close(c.close)
+	// let the server receive the pushed data before the tunnel ends
+	c.endPush()
 	return c.quit()
 }
 
+// CloseWrite tells the server that no more data will be written, once the
+// pushed data is delivered, so that it half-closes the connection to the
+// remote host. Reading is unaffected.
+func (c *clientConnection) CloseWrite() error {
+	if !c.writeClosed.CompareAndSwap(false, true) {
+		return nil
+	}
+	c.endPush()
+	return c.push([]byte("eof"), EOF_TYP)
+}
+
+// endPush ends the chunked push, if any, and waits for the server to
+// receive the pushed data.
+func (c *clientConnection) endPush() {
+	c.pushMu.Lock()
+	dst, done := c.dst, c.pushDone
+	c.pushMu.Unlock()
+	if dst == nil {
+		return
+	}
+	dst.Close()
+	select {
+	case <-done:
+	case <-time.After(c.timeout):
+	}
+}
+
 // Legacy types for backward compatibility
 
 // localProxyConn is an alias for clientConnection for backward compatibility.
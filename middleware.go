@@ -0,0 +1,275 @@
+package h2go
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Middleware wraps a ProxyHandler to change how it connects, e.g. to log,
+// retry or filter connections. Middleware can be stacked with Chain around
+// any ProxyHandler, including Client, and is applied by a LocalServer to
+// all its handlers with WithMiddleware.
+type Middleware func(next ProxyHandler) ProxyHandler
+
+// Chain wraps h in mws. The first middleware is the outermost, so it sees
+// each connection first.
+//
+// Example:
+//
+//	handler := h2go.Chain(client,
+//	    h2go.Logging(logger),
+//	    h2go.Retry(3, time.Second),
+//	    h2go.ConnectTimeout(5*time.Second),
+//	)
+func Chain(h ProxyHandler, mws ...Middleware) ProxyHandler {
+	for i := len(mws) - 1; i >= 0; i-- {
+		h = mws[i](h)
+	}
+	return h
+}
+
+// ConnectFunc adapts a function to a ProxyHandler whose Clean is a no-op.
+type ConnectFunc func(addr string) (io.ReadWriteCloser, error)
+
+// Connect calls f(addr).
+func (f ConnectFunc) Connect(addr string) (io.ReadWriteCloser, error) {
+	return f(addr)
+}
+
+// Clean is a no-op.
+func (f ConnectFunc) Clean() {}
+
+// wrapped is a ProxyHandler that connects with connect and passes Clean on
+// to next.
+type wrapped struct {
+	next    ProxyHandler
+	connect func(ctx context.Context, req *ConnectRequest) (io.ReadWriteCloser, error)
+}
+
+func (w *wrapped) Connect(addr string) (io.ReadWriteCloser, error) {
+	return w.connect(context.Background(), &ConnectRequest{Addr: addr})
+}
+
+func (w *wrapped) ConnectContext(ctx context.Context, req *ConnectRequest) (io.ReadWriteCloser, error) {
+	return w.connect(ctx, req)
+}
+
+func (w *wrapped) Clean() { w.next.Clean() }
+
+// NewMiddleware returns a Middleware that connects with connect, which is
+// given the handler it wraps as next. connect should pass the request on
+// with ConnectVia so that next sees its metadata.
+//
+// Example:
+//
+//	tagTeam := h2go.NewMiddleware(func(next h2go.ProxyHandler, ctx context.Context, req *h2go.ConnectRequest) (io.ReadWriteCloser, error) {
+//	    req.Metadata = map[string]string{"Team": "payments"}
+//	    return h2go.ConnectVia(ctx, next, req)
+//	})
+func NewMiddleware(connect func(next ProxyHandler, ctx context.Context, req *ConnectRequest) (io.ReadWriteCloser, error)) Middleware {
+	return func(next ProxyHandler) ProxyHandler {
+		return &wrapped{next: next, connect: func(ctx context.Context, req *ConnectRequest) (io.ReadWriteCloser, error) {
+			return connect(next, ctx, req)
+		}}
+	}
+}
+
+// Logging logs every connection attempt with its destination, duration and
+// error, if any.
+func Logging(logger *slog.Logger) Middleware {
+	return NewMiddleware(func(next ProxyHandler, ctx context.Context, req *ConnectRequest) (io.ReadWriteCloser, error) {
+		start := time.Now()
+		conn, err := ConnectVia(ctx, next, req)
+		if err != nil {
+			logger.Warn("connect failed",
+				"addr", req.Addr,
+				"duration", time.Since(start),
+				"msg", err)
+			return nil, err
+		}
+		logger.Info("connected",
+			"addr", req.Addr,
+			"duration", time.Since(start))
+		return conn, nil
+	})
+}
+
+// HandlerMetrics counts the connections of the handlers wrapped by Metrics.
+// It is safe for concurrent use.
+type HandlerMetrics struct {
+	Connects atomic.Int64 // connection attempts
+	Failures atomic.Int64 // failed connection attempts
+	Active   atomic.Int64 // open connections
+	BytesIn  atomic.Int64 // bytes read from destinations
+	BytesOut atomic.Int64 // bytes written to destinations
+}
+
+// Metrics records the connections of the wrapped handler in m.
+func Metrics(m *HandlerMetrics) Middleware {
+	return NewMiddleware(func(next ProxyHandler, ctx context.Context, req *ConnectRequest) (io.ReadWriteCloser, error) {
+		m.Connects.Add(1)
+		conn, err := ConnectVia(ctx, next, req)
+		if err != nil {
+			m.Failures.Add(1)
+			return nil, err
+		}
+		m.Active.Add(1)
+		return &metricsConn{ReadWriteCloser: conn, m: m}, nil
+	})
+}
+
+// metricsConn counts the traffic of a connection in m.
+type metricsConn struct {
+	io.ReadWriteCloser
+	m    *HandlerMetrics
+	once sync.Once
+}
+
+func (c *metricsConn) Read(b []byte) (int, error) {
+	n, err := c.ReadWriteCloser.Read(b)
+	c.m.BytesIn.Add(int64(n))
+	return n, err
+}
+
+func (c *metricsConn) Write(b []byte) (int, error) {
+	n, err := c.ReadWriteCloser.Write(b)
+	c.m.BytesOut.Add(int64(n))
+	return n, err
+}
+
+// CloseWrite half-closes the connection if it supports it.
+func (c *metricsConn) CloseWrite() error {
+	if cw, ok := c.ReadWriteCloser.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return errors.ErrUnsupported
+}
+
+func (c *metricsConn) Close() error {
+	c.once.Do(func() { c.m.Active.Add(-1) })
+	return c.ReadWriteCloser.Close()
+}
+
+// Retry retries failed connections up to attempts times in total, waiting
+// backoff before the first retry and doubling it after each. Connections
+// refused with ErrBlocked or ErrForbidden are not retried, and waiting ends
+// with the error of the context when it is done.
+func Retry(attempts int, backoff time.Duration) Middleware {
+	if attempts < 1 {
+		attempts = 1
+	}
+	return NewMiddleware(func(next ProxyHandler, ctx context.Context, req *ConnectRequest) (io.ReadWriteCloser, error) {
+		var err error
+		backoff := backoff
+		for i := 0; i < attempts; i++ {
+			if i > 0 {
+				if !sleepContext(ctx, backoff) {
+					return nil, ctx.Err()
+				}
+				backoff *= 2
+			}
+			var conn io.ReadWriteCloser
+			if conn, err = ConnectVia(ctx, next, req); err == nil {
+				return conn, nil
+			}
+			if errors.Is(err, ErrBlocked) || errors.Is(err, ErrForbidden) {
+				break
+			}
+		}
+		return nil, err
+	})
+}
+
+// ConnectTimeout fails connections that take longer than d to set up with
+// an error matching os.ErrDeadlineExceeded. The context passed on is
+// canceled at the timeout, and a connection that is set up after it anyway
+// is closed.
+func ConnectTimeout(d time.Duration) Middleware {
+	return NewMiddleware(func(next ProxyHandler, ctx context.Context, req *ConnectRequest) (io.ReadWriteCloser, error) {
+		type result struct {
+			conn io.ReadWriteCloser
+			err  error
+		}
+		ctx, cancel := context.WithTimeout(ctx, d)
+		defer cancel()
+		done := make(chan result, 1)
+		go func() {
+			conn, err := ConnectVia(ctx, next, req)
+			done <- result{conn, err}
+		}()
+		select {
+		case r := <-done:
+			if r.err == nil || !errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				return r.conn, r.err
+			}
+		case <-ctx.Done():
+			go func() {
+				if r := <-done; r.conn != nil {
+					r.conn.Close()
+				}
+			}()
+			if !errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				return nil, ctx.Err()
+			}
+		}
+		return nil, fmt.Errorf("connect %s: %w", req.Addr, os.ErrDeadlineExceeded)
+	})
+}
+
+// OverrideHosts replaces the host of destinations found in hosts with the
+// mapped host or IP address, keeping the port, like an /etc/hosts file
+// applied before the connection goes through the wrapped handler.
+func OverrideHosts(hosts map[string]string) Middleware {
+	return RewriteAddr(func(addr string) string {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return addr
+		}
+		if to, ok := hosts[host]; ok {
+			return net.JoinHostPort(to, port)
+		}
+		return addr
+	})
+}
+
+// RewriteAddr connects to rewrite(addr) instead of addr.
+func RewriteAddr(rewrite func(addr string) string) Middleware {
+	return NewMiddleware(func(next ProxyHandler, ctx context.Context, req *ConnectRequest) (io.ReadWriteCloser, error) {
+		rewritten := *req
+		rewritten.Addr = rewrite(req.Addr)
+		return ConnectVia(ctx, next, &rewritten)
+	})
+}
+
+// AllowHosts refuses connections to hosts m does not match with ErrBlocked.
+func AllowHosts(m *HostMatcher) Middleware {
+	return filterHosts(m, true)
+}
+
+// DenyHosts refuses connections to hosts m matches with ErrBlocked.
+func DenyHosts(m *HostMatcher) Middleware {
+	return filterHosts(m, false)
+}
+
+// filterHosts refuses connections to hosts for which m.Match differs from
+// allow.
+func filterHosts(m *HostMatcher, allow bool) Middleware {
+	return NewMiddleware(func(next ProxyHandler, ctx context.Context, req *ConnectRequest) (io.ReadWriteCloser, error) {
+		host, _, err := net.SplitHostPort(req.Addr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid address %q: %w", req.Addr, err)
+		}
+		if m.Match(host) != allow {
+			return nil, fmt.Errorf("%w: %s", ErrBlocked, req.Addr)
+		}
+		return ConnectVia(ctx, next, req)
+	})
+}
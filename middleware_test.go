@@ -0,0 +1,261 @@
+package h2go
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// recordingHandler records the addresses it is asked to connect to and
+// fails the first failures of them.
+type recordingHandler struct {
+	addrs    []string
+	failures int
+	delay    time.Duration
+	cleaned  bool
+}
+
+func (h *recordingHandler) Connect(addr string) (io.ReadWriteCloser, error) {
+	time.Sleep(h.delay)
+	h.addrs = append(h.addrs, addr)
+	if len(h.addrs) <= h.failures {
+		return nil, errors.New("connection refused")
+	}
+	c1, c2 := net.Pipe()
+	go func() {
+		defer c2.Close()
+		io.Copy(c2, c2)
+	}()
+	return c1, nil
+}
+
+func (h *recordingHandler) Clean() { h.cleaned = true }
+
+func TestChain(t *testing.T) {
+	var order []string
+	mark := func(name string) Middleware {
+		return NewMiddleware(func(next ProxyHandler, ctx context.Context, req *ConnectRequest) (io.ReadWriteCloser, error) {
+			order = append(order, name)
+			return ConnectVia(ctx, next, req)
+		})
+	}
+	h := &recordingHandler{}
+	chained := Chain(h, mark("outer"), mark("inner"))
+	conn, err := chained.Connect("example.com:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if strings.Join(order, ",") != "outer,inner" {
+		t.Errorf("middleware ran in order %v, want outer, inner", order)
+	}
+	chained.Clean()
+	if !h.cleaned {
+		t.Error("Clean() was not passed on to the handler")
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	internal, _ := NewHostMatcher(".corp.example.com")
+	tests := []struct {
+		name      string
+		mw        Middleware
+		handler   *recordingHandler
+		addr      string
+		wantAddrs []string
+		wantErr   error
+	}{
+		{
+			name:      "retry",
+			mw:        Retry(3, time.Millisecond),
+			handler:   &recordingHandler{failures: 2},
+			addr:      "example.com:80",
+			wantAddrs: []string{"example.com:80", "example.com:80", "example.com:80"},
+		},
+		{
+			name:      "retry exhausted",
+			mw:        Retry(2, time.Millisecond),
+			handler:   &recordingHandler{failures: 5},
+			addr:      "example.com:80",
+			wantAddrs: []string{"example.com:80", "example.com:80"},
+			wantErr:   errors.New("connection refused"),
+		},
+		{
+			name:    "timeout",
+			mw:      ConnectTimeout(10 * time.Millisecond),
+			handler: &recordingHandler{delay: time.Second},
+			addr:    "example.com:80",
+			wantErr: os.ErrDeadlineExceeded,
+		},
+		{
+			name:      "override hosts",
+			mw:        OverrideHosts(map[string]string{"example.com": "192.0.2.1"}),
+			handler:   &recordingHandler{},
+			addr:      "example.com:443",
+			wantAddrs: []string{"192.0.2.1:443"},
+		},
+		{
+			name:      "rewrite",
+			mw:        RewriteAddr(func(addr string) string { return "[::1]:8080" }),
+			handler:   &recordingHandler{},
+			addr:      "example.com:443",
+			wantAddrs: []string{"[::1]:8080"},
+		},
+		{
+			name:      "allow",
+			mw:        AllowHosts(internal),
+			handler:   &recordingHandler{},
+			addr:      "git.corp.example.com:22",
+			wantAddrs: []string{"git.corp.example.com:22"},
+		},
+		{
+			name:    "allow refused",
+			mw:      AllowHosts(internal),
+			handler: &recordingHandler{},
+			addr:    "example.com:22",
+			wantErr: ErrBlocked,
+		},
+		{
+			name:    "deny",
+			mw:      DenyHosts(internal),
+			handler: &recordingHandler{},
+			addr:    "git.corp.example.com:22",
+			wantErr: ErrBlocked,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, err := tt.mw(tt.handler).Connect(tt.addr)
+			switch {
+			case tt.wantErr == nil && err != nil:
+				t.Fatalf("Connect() error = %v", err)
+			case tt.wantErr != nil && err == nil:
+				conn.Close()
+				t.Fatalf("Connect() succeeded, want %v", tt.wantErr)
+			case tt.wantErr != nil && !errors.Is(err, tt.wantErr) && err.Error() != tt.wantErr.Error():
+				t.Fatalf("Connect() error = %v, want %v", err, tt.wantErr)
+			}
+			if conn != nil {
+				conn.Close()
+			}
+			if tt.wantAddrs != nil && strings.Join(tt.handler.addrs, " ") != strings.Join(tt.wantAddrs, " ") {
+				t.Errorf("connected to %v, want %v", tt.handler.addrs, tt.wantAddrs)
+			}
+		})
+	}
+}
+
+// blockingHandler waits for the context of connections to be done, and
+// sends its error to done.
+type blockingHandler struct {
+	recordingHandler
+	done chan error
+}
+
+func (h *blockingHandler) ConnectContext(ctx context.Context, req *ConnectRequest) (io.ReadWriteCloser, error) {
+	<-ctx.Done()
+	h.done <- ctx.Err()
+	return nil, ctx.Err()
+}
+
+func TestMiddlewareContext(t *testing.T) {
+	t.Run("timeout cancels", func(t *testing.T) {
+		h := &blockingHandler{done: make(chan error, 1)}
+		if _, err := ConnectTimeout(10 * time.Millisecond)(h).Connect("example.com:80"); !errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Fatalf("Connect() error = %v, want %v", err, os.ErrDeadlineExceeded)
+		}
+		select {
+		case err := <-h.done:
+			if !errors.Is(err, context.DeadlineExceeded) {
+				t.Errorf("handler context error = %v, want %v", err, context.DeadlineExceeded)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("handler context was not canceled")
+		}
+	})
+
+	t.Run("retry canceled", func(t *testing.T) {
+		h := &recordingHandler{failures: 5}
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		start := time.Now()
+		_, err := ConnectVia(ctx, Retry(3, time.Hour)(h), &ConnectRequest{Addr: "example.com:80"})
+		if !errors.Is(err, context.DeadlineExceeded) || time.Since(start) > 5*time.Second {
+			t.Errorf("Connect() error = %v after %v, want %v", err, time.Since(start), context.DeadlineExceeded)
+		}
+		if len(h.addrs) != 1 {
+			t.Errorf("connected %d times, want 1", len(h.addrs))
+		}
+	})
+}
+
+func TestMetricsAndLogging(t *testing.T) {
+	var m HandlerMetrics
+	var logs bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&logs, nil))
+	h := Chain(&recordingHandler{failures: 1}, Logging(logger), Metrics(&m))
+
+	if _, err := h.Connect("example.com:80"); err == nil {
+		t.Fatal("Connect() succeeded, want the first attempt to fail")
+	}
+	conn, err := h.Connect("example.com:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Active.Load() != 1 {
+		t.Errorf("Active = %d, want 1", m.Active.Load())
+	}
+	checkEcho(t, conn)
+	conn.Close()
+	conn.Close()
+
+	for _, c := range []struct {
+		name      string
+		got, want int64
+	}{
+		{"Connects", m.Connects.Load(), 2},
+		{"Failures", m.Failures.Load(), 1},
+		{"Active", m.Active.Load(), 0},
+		{"BytesIn", m.BytesIn.Load(), 4},
+		{"BytesOut", m.BytesOut.Load(), 4},
+	} {
+		if c.got != c.want {
+			t.Errorf("%s = %d, want %d", c.name, c.got, c.want)
+		}
+	}
+	if !strings.Contains(logs.String(), "connect failed") || !strings.Contains(logs.String(), "connected") {
+		t.Errorf("logs = %q, want a failed and a successful connection", logs.String())
+	}
+}
+
+func TestLocalServerMiddleware(t *testing.T) {
+	echo := startEcho(t)
+	addr := freeAddr(t)
+	h := &echoHandler{echo: echo, addrs: make(chan string, 2)}
+
+	s := NewLocalServer(
+		WithSocks5Handler(h),
+		WithMiddleware(RewriteAddr(func(string) string { return "db.internal:5432" })),
+		WithListener(Listener{Addr: addr, Protocol: ProtocolForward, Target: "web.internal:80"}),
+	)
+	go s.ListenAndServe()
+
+	waitListening(t, "tcp", addr)
+	<-h.addrs // the probe of waitListening
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkEcho(t, conn)
+	conn.Close()
+	if got := <-h.addrs; got != "db.internal:5432" {
+		t.Errorf("connected to %s, want the rewritten db.internal:5432", got)
+	}
+}
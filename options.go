@@ -1,6 +1,7 @@
 package h2go
 
 import (
+	"crypto/tls"
 	"log/slog"
 	"time"
 )
@@ -56,6 +57,77 @@ func WithAuthenticator(auth Authenticator) ClientOption {
 	}
 }
 
+// WithRequestTimeout sets the timeout for individual requests to the server,
+// such as opening a tunnel or pushing data. The default is 10 seconds.
+// Non-positive values are ignored.
+func WithRequestTimeout(d time.Duration) ClientOption {
+	return func(c *Client) {
+		if d > 0 {
+			c.timeout = d
+		}
+	}
+}
+
+// WithHeartbeatInterval sets how often the client sends heartbeats for each
+// open tunnel. It must be shorter than the server's heartbeat TTL and any
+// idle timeout enforced by the network in between. The default is 30 seconds.
+// Non-positive values are ignored.
+func WithHeartbeatInterval(d time.Duration) ClientOption {
+	return func(c *Client) {
+		if d > 0 {
+			c.heartbeat = d
+		}
+	}
+}
+
+// WithClockSkewCorrection controls whether the client adopts the server's
+// time hint and retries when a tunnel is refused for clock skew.
+// It is enabled by default.
+func WithClockSkewCorrection(enabled bool) ClientOption {
+	return func(c *Client) {
+		c.skewCorrection = enabled
+	}
+}
+
+// WithServerCA trusts the PEM certificates in caPath, in addition to the
+// system roots, when verifying the server. It is ignored if a custom HTTP
+// client is set with WithHTTPClient.
+func WithServerCA(caPath string) ClientOption {
+	return func(c *Client) {
+		c.caPath = caPath
+	}
+}
+
+// WithClientCertificate presents the given certificate and key to servers
+// that require mutual TLS. It is ignored if a custom HTTP client is set with
+// WithHTTPClient.
+func WithClientCertificate(certPath, keyPath string) ClientOption {
+	return func(c *Client) {
+		c.certPath = certPath
+		c.keyPath = keyPath
+	}
+}
+
+// WithPinnedSPKI accepts the server only if its certificate, or a CA
+// certificate it presents that issued it for the server name, has a public
+// key matching one of pins, as returned by SPKIPin. Several pins can be given
+// to rotate keys. Pinning replaces CA verification, so self-signed
+// server certificates can be pinned too. It is ignored if a custom HTTP
+// client is set with WithHTTPClient.
+func WithPinnedSPKI(pins ...string) ClientOption {
+	return func(c *Client) {
+		c.pins = append(c.pins, pins...)
+	}
+}
+
+// WithUser signs requests with the secret of the named server user instead of
+// the shared secret; see WithServerUser. The secret is set with WithSecret.
+func WithUser(name string) ClientOption {
+	return func(c *Client) {
+		c.user = name
+	}
+}
+
 // ServerOption is a function that configures a ProxyServer.
 type ServerOption func(*ProxyServer)
 
@@ -66,6 +138,17 @@ func WithListenAddr(addr string) ServerOption {
 	}
 }
 
+// WithListenAddrs sets several addresses for the server to listen on. All
+// of them share the server's TLS settings, limits and tunnels.
+func WithListenAddrs(addrs ...string) ServerOption {
+	return func(s *ProxyServer) {
+		if len(addrs) > 0 {
+			s.addr = addrs[0]
+			s.extraAddrs = addrs[1:]
+		}
+	}
+}
+
 // WithServerSecret sets the shared secret for authentication.
 func WithServerSecret(secret string) ServerOption {
 	return func(s *ProxyServer) {
@@ -94,6 +177,53 @@ func WithTLSKey(keyPath string) ServerOption {
 	}
 }
 
+// WithTLSCertPair adds a certificate and key to serve in addition to the one
+// set with WithTLSCert and WithTLSKey, if any. The certificate matching the
+// SNI of the client hello is served, falling back to the first one.
+func WithTLSCertPair(certPath, keyPath string) ServerOption {
+	return func(s *ProxyServer) {
+		s.extraCerts = append(s.extraCerts, certPair{certPath: certPath, keyPath: keyPath})
+	}
+}
+
+// WithCertReloadInterval sets how often certificate files are checked for
+// changes, which are then loaded without restarting the server. A value of 0
+// disables the checks; ReloadCertificates still reloads on demand.
+// The default is 30 seconds.
+func WithCertReloadInterval(d time.Duration) ServerOption {
+	return func(s *ProxyServer) {
+		s.certReload = d
+	}
+}
+
+// WithCertExpiryWarning sets how long before expiry a warning is logged for
+// a certificate. The default is 14 days.
+func WithCertExpiryWarning(d time.Duration) ServerOption {
+	return func(s *ProxyServer) {
+		s.certExpiryWarning = d
+	}
+}
+
+// WithServerUser adds a user that signs its requests with its own secret.
+// The user name is the client identity used for limits, ACLs and logs. If
+// users are added and no shared secret is set, only users are accepted.
+func WithServerUser(name, secret string) ServerOption {
+	return func(s *ProxyServer) {
+		WithServerUserAuthenticator(name, NewHMACAuthenticator(secret))(s)
+	}
+}
+
+// WithServerUserAuthenticator adds a user whose requests are verified by
+// auth, e.g. one returned by NewAuthenticator. See WithServerUser.
+func WithServerUserAuthenticator(name string, auth Authenticator) ServerOption {
+	return func(s *ProxyServer) {
+		if s.users == nil {
+			s.users = make(map[string]Authenticator)
+		}
+		s.users[name] = auth
+	}
+}
+
 // WithServerLogger sets a custom logger for the server.
 // If nil is provided, the default logger will be used.
 func WithServerLogger(logger *slog.Logger) ServerOption {
@@ -111,6 +241,200 @@ func WithServerAuthenticator(auth Authenticator) ServerOption {
 	}
 }
 
+// WithMaxTunnels limits the number of concurrent tunnels across all clients.
+// A value of 0 means no limit.
+func WithMaxTunnels(n int) ServerOption {
+	return func(s *ProxyServer) {
+		s.limits.maxTotal = n
+	}
+}
+
+// WithMaxTunnelsPerClient limits the number of concurrent tunnels a single
+// client may hold open. A value of 0 means no limit.
+func WithMaxTunnelsPerClient(n int) ServerOption {
+	return func(s *ProxyServer) {
+		s.limits.maxPerClient = n
+	}
+}
+
+// WithConnectRate limits how many tunnels per second a single client may
+// open, allowing bursts of up to burst connects. A rate of 0 means no limit.
+func WithConnectRate(perSecond float64, burst int) ServerOption {
+	return func(s *ProxyServer) {
+		s.limits.rate = perSecond
+		s.limits.burst = burst
+	}
+}
+
+// WithDialTimeout sets the timeout for dialing tunnel destinations.
+// The default is 10 seconds. Non-positive values are ignored.
+func WithDialTimeout(d time.Duration) ServerOption {
+	return func(s *ProxyServer) {
+		if d > 0 {
+			s.dialTimeout = d
+		}
+	}
+}
+
+// WithSignTTL sets how old a request signature may be before it is rejected.
+// The default is 10 seconds. Non-positive values are ignored.
+func WithSignTTL(d time.Duration) ServerOption {
+	return func(s *ProxyServer) {
+		if d > 0 {
+			s.signTTL = d
+		}
+	}
+}
+
+// WithClockSkew sets how far a client's clock may differ from the server's.
+// Request timestamps are accepted from signTTL+skew in the past to skew in
+// the future. The default is 10 seconds.
+func WithClockSkew(d time.Duration) ServerOption {
+	return func(s *ProxyServer) {
+		s.clockSkew = d
+	}
+}
+
+// WithHeartbeatTTL sets how long a tunnel is kept without a heartbeat from
+// the client. The default is 60 seconds. Non-positive values are ignored.
+func WithHeartbeatTTL(d time.Duration) ServerOption {
+	return func(s *ProxyServer) {
+		if d > 0 {
+			s.heartTTL = d
+		}
+	}
+}
+
+// WithIdleTimeout closes tunnels that carry no data in either direction for
+// the given duration. Heartbeats do not count as data. A value of 0 disables
+// the idle timeout.
+func WithIdleTimeout(d time.Duration) ServerOption {
+	return func(s *ProxyServer) {
+		s.idleTimeout = d
+	}
+}
+
+// WithMaxTunnelLifetime closes tunnels once they have been open for the given
+// duration, regardless of activity. A value of 0 means no limit.
+func WithMaxTunnelLifetime(d time.Duration) ServerOption {
+	return func(s *ProxyServer) {
+		s.maxLifetime = d
+	}
+}
+
+// WithReverseTunnels allows clients to register reverse tunnels, making
+// the server accept connections on their behalf; see Client.Listen. The ACL
+// sees registrations as tunnel requests with Reverse set.
+func WithReverseTunnels(enabled bool) ServerOption {
+	return func(s *ProxyServer) {
+		s.reverse = enabled
+	}
+}
+
+// WithClientCA requires HTTPS clients to present a certificate signed by one
+// of the PEM certificates in caPath. The identity in a verified certificate
+// is used for per-client limits, ACLs and logs.
+func WithClientCA(caPath string) ServerOption {
+	return func(s *ProxyServer) {
+		s.clientCAPath = caPath
+	}
+}
+
+// WithClientCertAuth accepts a verified client certificate in place of the
+// shared secret, so clients with a certificate need not sign their requests.
+// It only has an effect together with WithClientCA.
+func WithClientCertAuth(enabled bool) ServerOption {
+	return func(s *ProxyServer) {
+		s.certAuth = enabled
+	}
+}
+
+// WithACL sets the access control list consulted before opening a tunnel.
+func WithACL(acl ACL) ServerOption {
+	return func(s *ProxyServer) {
+		s.acl = acl
+	}
+}
+
+// WithResolver sets the resolver of destination host names, e.g. a
+// DNSResolver or a HostsResolver. The default is the resolver of the
+// operating system. Names are only resolved for clients the ACL and the
+// limits allow. The addresses are then passed to the ACL in
+// TunnelRequest.Addrs and dialed in order, so that the ACL decides on the
+// addresses actually connected to.
+func WithResolver(r Resolver) ServerOption {
+	return func(s *ProxyServer) {
+		s.resolver = r
+	}
+}
+
+// WithDNSPreference sets the address family dialed first, PreferIPv4 or
+// PreferIPv6, or the only one resolved, OnlyIPv4 or OnlyIPv6. By default
+// the addresses are dialed in the order the resolver returns them.
+func WithDNSPreference(preference string) ServerOption {
+	return func(s *ProxyServer) {
+		s.dnsPreference = preference
+	}
+}
+
+// WithBlockPrivateAddrs refuses tunnels to destinations that resolve to a
+// private address, see IsPrivateAddr, so that clients cannot reach the
+// network of the server. Reverse tunnels are not affected.
+func WithBlockPrivateAddrs(block bool) ServerOption {
+	return func(s *ProxyServer) {
+		s.blockPrivate = block
+	}
+}
+
+// WithACME obtains and renews the HTTPS certificates for the given domains
+// automatically from an ACME CA (Let's Encrypt by default), replacing
+// WithTLSCert and WithTLSKey. TLS-ALPN-01 challenges are answered on the
+// HTTPS listener; see WithACMEHTTPAddr for HTTP-01.
+func WithACME(domains ...string) ServerOption {
+	return func(s *ProxyServer) {
+		s.acme.domains = domains
+	}
+}
+
+// WithACMEEmail sets the contact email registered with the ACME account.
+func WithACMEEmail(email string) ServerOption {
+	return func(s *ProxyServer) {
+		s.acme.email = email
+	}
+}
+
+// WithACMECacheDir sets the directory ACME certificates and account keys are
+// stored in. It defaults to h2go/acme under the user cache directory.
+func WithACMECacheDir(dir string) ServerOption {
+	return func(s *ProxyServer) {
+		s.acme.cacheDir = dir
+	}
+}
+
+// WithACMEDirectory sets the ACME directory URL, e.g. a staging
+// environment or a local Pebble instance.
+func WithACMEDirectory(url string) ServerOption {
+	return func(s *ProxyServer) {
+		s.acme.directory = url
+	}
+}
+
+// WithACMEDirectoryCA trusts the PEM certificates in caPath when talking to
+// the ACME directory, as needed for test CAs such as Pebble.
+func WithACMEDirectoryCA(caPath string) ServerOption {
+	return func(s *ProxyServer) {
+		s.acme.directoryCA = caPath
+	}
+}
+
+// WithACMEHTTPAddr answers ACME HTTP-01 challenges on the given address
+// (usually ":80"), redirecting other plain HTTP requests to HTTPS.
+func WithACMEHTTPAddr(addr string) ServerOption {
+	return func(s *ProxyServer) {
+		s.acme.httpAddr = addr
+	}
+}
+
 // LocalServerOption is a function that configures a LocalServer.
 type LocalServerOption func(*LocalServer)
 
@@ -121,6 +445,45 @@ func WithLocalListenAddr(addr string) LocalServerOption {
 	}
 }
 
+// WithListener adds a listener to the local server, next to its listen
+// address. If no listen address is set, only the listeners are used.
+func WithListener(l Listener) LocalServerOption {
+	return func(s *LocalServer) {
+		s.Listeners = append(s.Listeners, l)
+	}
+}
+
+// WithReverse exposes a local service through a server; see Reverse.
+func WithReverse(r Reverse) LocalServerOption {
+	return func(s *LocalServer) {
+		s.Reverses = append(s.Reverses, r)
+	}
+}
+
+// WithLocalTLS makes the listen address accept TLS connections with config,
+// so that clients can use https:// proxy URLs; see Listener.TLS.
+func WithLocalTLS(config *tls.Config) LocalServerOption {
+	return func(s *LocalServer) {
+		s.TLS = config
+	}
+}
+
+// WithLocalUsers requires SOCKS5 and HTTP clients connecting to the listen
+// address to authenticate with one of the given user names and passwords.
+func WithLocalUsers(users map[string]string) LocalServerOption {
+	return func(s *LocalServer) {
+		s.Users = users
+	}
+}
+
+// WithMiddleware wraps the handlers of all connections of the local server
+// in mws, after any middleware added before. See Chain.
+func WithMiddleware(mws ...Middleware) LocalServerOption {
+	return func(s *LocalServer) {
+		s.Middleware = append(s.Middleware, mws...)
+	}
+}
+
 // WithSocks5Handler sets the handler for SOCKS5 proxy requests.
 func WithSocks5Handler(handler ProxyHandler) LocalServerOption {
 	return func(s *LocalServer) {
@@ -0,0 +1,76 @@
+package h2go
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrPinMismatch is returned from the TLS handshake when neither the server
+// certificate nor a CA certificate that issued it matches a pinned public
+// key.
+var ErrPinMismatch = errors.New("server certificate does not match any pinned public key")
+
+// SPKIPin returns the pin of a certificate: the base64 encoded SHA-256 hash of
+// its Subject Public Key Info. The pin stays the same when a certificate is
+// renewed with the same key.
+func SPKIPin(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// pinLen is the length of a base64 encoded SHA-256 hash.
+const pinLen = 44
+
+// normalizePin strips the optional "sha256/" or "sha256//" prefix of a pin.
+// Pins may start with a slash themselves, so the second slash is only part
+// of the prefix if the pin is too long otherwise.
+func normalizePin(pin string) string {
+	pin = strings.TrimPrefix(pin, "sha256/")
+	if len(pin) == pinLen+1 && pin[0] == '/' {
+		return pin[1:]
+	}
+	return pin
+}
+
+// verifyPins returns a tls.Config.VerifyConnection function accepting the
+// handshake only if the server certificate matches one of pins, or was issued
+// for the server name by a presented CA or intermediate certificate that
+// does.
+func verifyPins(pins []string) func(tls.ConnectionState) error {
+	allowed := make(map[string]bool, len(pins))
+	for _, pin := range pins {
+		allowed[normalizePin(pin)] = true
+	}
+	return func(cs tls.ConnectionState) error {
+		if len(cs.PeerCertificates) == 0 {
+			return ErrPinMismatch
+		}
+		leaf := cs.PeerCertificates[0]
+		if allowed[SPKIPin(leaf)] {
+			return nil
+		}
+		// anyone can append a pinned certificate to their chain, so it only
+		// counts if the chain up to it verifies
+		roots, intermediates := x509.NewCertPool(), x509.NewCertPool()
+		for _, cert := range cs.PeerCertificates[1:] {
+			if allowed[SPKIPin(cert)] {
+				roots.AddCert(cert)
+			} else {
+				intermediates.AddCert(cert)
+			}
+		}
+		if _, err := leaf.Verify(x509.VerifyOptions{
+			DNSName:       cs.ServerName,
+			Roots:         roots,
+			Intermediates: intermediates,
+		}); err != nil {
+			return fmt.Errorf("%w: %v", ErrPinMismatch, err)
+		}
+		return nil
+	}
+}
@@ -7,12 +7,14 @@ import (
 
 // HTTP status codes used by the proxy protocol.
 const (
-	HeadError    = 500
-	HeadOK       = 200
-	HeadData     = 201
-	HeadHeart    = 202
-	HeadQuit     = 203
-	HeadNotFound = 404
+	HeadError     = 500
+	HeadOK        = 200
+	HeadData      = 201
+	HeadHeart     = 202
+	HeadQuit      = 203
+	HeadForbidden = 403
+	HeadNotFound  = 404
+	HeadLimited   = 429
 )
 
 // WriteHTTPError writes an HTTP error response with status 500.
@@ -50,3 +52,17 @@ func WriteHTTPHeart(w http.ResponseWriter, data string) {
 	w.WriteHeader(HeadHeart)
 	fmt.Fprintf(w, "%s", data)
 }
+
+// WriteHTTPForbidden writes an HTTP response with status 403, used when a
+// tunnel is refused by the server's ACL.
+func WriteHTTPForbidden(w http.ResponseWriter, message string) {
+	w.WriteHeader(HeadForbidden)
+	fmt.Fprintf(w, "%s", message)
+}
+
+// WriteHTTPLimited writes an HTTP response with status 429, used when a
+// tunnel is refused because a connection or rate limit was reached.
+func WriteHTTPLimited(w http.ResponseWriter, message string) {
+	w.WriteHeader(HeadLimited)
+	fmt.Fprintf(w, "%s", message)
+}
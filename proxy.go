@@ -1,28 +1,45 @@
 package h2go
 
 import (
+	"errors"
+	"io"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// Reasons a proxy connection ends without being closed by the client.
+var (
+	errHeartbeatTimeout = errors.New("heartbeat timeout")
+	errIdleTimeout      = errors.New("idle timeout")
+	errMaxLifetime      = errors.New("max tunnel lifetime reached")
+)
+
 // proxyConn represents a proxy connection to a remote host.
 // It manages the lifecycle of the connection including heartbeat handling.
 type proxyConn struct {
-	remote    net.Conn
-	uuid      string
-	close     chan struct{}
-	heart     chan struct{}
-	mu        sync.Mutex
-	hasClosed bool
+	remote      net.Conn
+	uuid        string
+	close       chan struct{}
+	heart       chan struct{}
+	mu          sync.Mutex
+	hasClosed   bool
+	heartTTL    time.Duration
+	idleTimeout time.Duration
+	maxLifetime time.Duration
+	lastActive  atomic.Int64
 }
 
 // newProxyConn creates a new proxy connection.
 func newProxyConn(remote net.Conn, uuid string) *proxyConn {
-	return &proxyConn{remote: remote, uuid: uuid,
-		close: make(chan struct{}),
-		heart: make(chan struct{}),
+	pc := &proxyConn{remote: remote, uuid: uuid,
+		close:    make(chan struct{}),
+		heart:    make(chan struct{}),
+		heartTTL: defaultHeartTTL,
 	}
+	pc.Touch()
+	return pc
 }
 
 // Close closes the proxy connection.
@@ -36,6 +53,16 @@ func (pc *proxyConn) Close() {
 	}
 }
 
+// CloseWrite shuts down the writing side of the remote connection, passing
+// on the end of the client's data while the remote host can still reply.
+// It does nothing if the remote connection does not support half-close.
+func (pc *proxyConn) CloseWrite() error {
+	if cw, ok := pc.remote.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
 // IsClosed returns whether the connection is closed.
 func (pc *proxyConn) IsClosed() bool {
 	pc.mu.Lock()
@@ -51,18 +78,64 @@ func (pc *proxyConn) Heart() {
 	}
 }
 
-// Do runs the connection lifecycle, waiting for close or heartbeat timeout.
-func (pc *proxyConn) Do() {
+// Touch records data activity on the connection, resetting its idle timer.
+func (pc *proxyConn) Touch() {
+	pc.lastActive.Store(time.Now().UnixNano())
+}
+
+// Do runs the connection lifecycle, waiting for close, heartbeat timeout,
+// idle timeout or the end of the tunnel's maximum lifetime. It returns the
+// reason the connection ended, or nil if it was closed explicitly.
+func (pc *proxyConn) Do() error {
 	defer pc.remote.Close()
 
+	heart := time.NewTimer(pc.heartTTL)
+	defer heart.Stop()
+
+	var idle, lifetime <-chan time.Time
+	var idleTimer *time.Timer
+	if pc.idleTimeout > 0 {
+		idleTimer = time.NewTimer(pc.idleTimeout)
+		defer idleTimer.Stop()
+		idle = idleTimer.C
+	}
+	if pc.maxLifetime > 0 {
+		t := time.NewTimer(pc.maxLifetime)
+		defer t.Stop()
+		lifetime = t.C
+	}
+
 	for {
 		select {
-		case <-time.After(time.Second * heartTTL):
-			return
+		case <-heart.C:
+			return errHeartbeatTimeout
 		case <-pc.close:
-			return
+			return nil
 		case <-pc.heart:
-			continue
+			heart.Reset(pc.heartTTL)
+		case <-idle:
+			since := time.Since(time.Unix(0, pc.lastActive.Load()))
+			if since >= pc.idleTimeout {
+				return errIdleTimeout
+			}
+			idleTimer.Reset(pc.idleTimeout - since)
+		case <-lifetime:
+			return errMaxLifetime
 		}
 	}
 }
+
+// activityReader touches its proxy connection on every successful read, so
+// long-lived chunked pushes keep the tunnel from going idle.
+type activityReader struct {
+	r  io.Reader
+	pc *proxyConn
+}
+
+func (a activityReader) Read(p []byte) (int, error) {
+	n, err := a.r.Read(p)
+	if n > 0 {
+		a.pc.Touch()
+	}
+	return n, err
+}
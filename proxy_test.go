@@ -0,0 +1,72 @@
+package h2go
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func runProxyConn(pc *proxyConn) chan error {
+	done := make(chan error, 1)
+	go func() { done <- pc.Do() }()
+	return done
+}
+
+func waitProxyConn(t *testing.T, done chan error, want error) {
+	t.Helper()
+	select {
+	case err := <-done:
+		if err != want {
+			t.Errorf("Do() = %v, want %v", err, want)
+		}
+	case <-time.After(time.Second * 2):
+		t.Fatal("timeout waiting for Do() to return")
+	}
+}
+
+func TestProxyConnHeartbeatTimeout(t *testing.T) {
+	remote, _ := net.Pipe()
+	pc := newProxyConn(remote, "test")
+	pc.heartTTL = time.Millisecond * 50
+
+	waitProxyConn(t, runProxyConn(pc), errHeartbeatTimeout)
+}
+
+func TestProxyConnIdleTimeout(t *testing.T) {
+	remote, _ := net.Pipe()
+	pc := newProxyConn(remote, "test")
+	pc.idleTimeout = time.Millisecond * 100
+
+	done := runProxyConn(pc)
+	// activity postpones the idle timeout
+	time.Sleep(time.Millisecond * 60)
+	pc.Touch()
+	time.Sleep(time.Millisecond * 60)
+	select {
+	case err := <-done:
+		t.Fatalf("Do() returned early with %v", err)
+	default:
+	}
+	waitProxyConn(t, done, errIdleTimeout)
+}
+
+func TestProxyConnMaxLifetime(t *testing.T) {
+	remote, _ := net.Pipe()
+	pc := newProxyConn(remote, "test")
+	pc.maxLifetime = time.Millisecond * 50
+
+	done := runProxyConn(pc)
+	pc.Touch()
+	pc.Heart()
+	waitProxyConn(t, done, errMaxLifetime)
+}
+
+func TestProxyConnClose(t *testing.T) {
+	remote, _ := net.Pipe()
+	pc := newProxyConn(remote, "test")
+
+	done := runProxyConn(pc)
+	time.Sleep(time.Millisecond * 10)
+	pc.Close()
+	waitProxyConn(t, done, nil)
+}
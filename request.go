@@ -0,0 +1,105 @@
+package h2go
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// Headers carrying the metadata of a ConnectRequest to the server.
+const (
+	srcAddrHeader    = "SRCADDR"
+	srcProtoHeader   = "SRCPROTO"
+	srcMethodHeader  = "SRCMETHOD"
+	srcUserHeader    = "SRCUSER"
+	metaHeaderPrefix = "Meta-"
+)
+
+// ConnectRequest describes a connection a LocalServer asks its handler
+// for: the destination and what triggered it.
+type ConnectRequest struct {
+	// Addr is the destination in "host:port" format.
+	Addr string
+
+	// Protocol is the protocol of the local connection: ProtocolSOCKS5,
+	// ProtocolHTTP, ProtocolRedirect, ProtocolTProxy or ProtocolForward.
+	Protocol string
+
+	// Method is the HTTP method of HTTP proxy requests, "CONNECT" for
+	// tunnels.
+	Method string
+
+	// ClientAddr is the address of the local application.
+	ClientAddr string
+
+	// User is the user the local application authenticated as, if any.
+	User string
+
+	// Header holds the header of HTTP proxy requests. It is not sent to the
+	// server; copy the fields the server should see to Metadata.
+	Header http.Header
+
+	// Metadata is sent to the server, which passes it to its ACL in
+	// TunnelRequest.Source. Keys are canonicalized like HTTP header names.
+	Metadata map[string]string
+}
+
+// ContextConnector is implemented by handlers that use the metadata of a
+// connection and a context bounding its setup, such as Client. A
+// LocalServer calls ConnectContext instead of Connect on such handlers.
+type ContextConnector interface {
+	ConnectContext(ctx context.Context, req *ConnectRequest) (io.ReadWriteCloser, error)
+}
+
+// ConnectVia connects to req.Addr through h, passing the metadata on if h
+// is a ContextConnector.
+func ConnectVia(ctx context.Context, h ProxyHandler, req *ConnectRequest) (io.ReadWriteCloser, error) {
+	if cc, ok := h.(ContextConnector); ok {
+		return cc.ConnectContext(ctx, req)
+	}
+	return h.Connect(req.Addr)
+}
+
+// setHeader sets the headers carrying the metadata of req on an outgoing
+// request.
+func (req *ConnectRequest) setHeader(h http.Header) {
+	for key, value := range map[string]string{
+		srcAddrHeader:   req.ClientAddr,
+		srcProtoHeader:  req.Protocol,
+		srcMethodHeader: req.Method,
+		srcUserHeader:   req.User,
+	} {
+		if value != "" {
+			h.Set(key, value)
+		}
+	}
+	for key, value := range req.Metadata {
+		h.Set(metaHeaderPrefix+key, value)
+	}
+}
+
+// tunnelSource returns the metadata of a ConnectRequest sent in h.
+func tunnelSource(h http.Header) TunnelSource {
+	return TunnelSource{
+		Addr:     h.Get(srcAddrHeader),
+		Protocol: h.Get(srcProtoHeader),
+		Method:   h.Get(srcMethodHeader),
+		User:     h.Get(srcUserHeader),
+		Metadata: metadata(h),
+	}
+}
+
+// metadata returns the ConnectRequest.Metadata sent in h.
+func metadata(h http.Header) map[string]string {
+	var m map[string]string
+	for key, values := range h {
+		if name, ok := strings.CutPrefix(key, metaHeaderPrefix); ok && name != "" && len(values) > 0 {
+			if m == nil {
+				m = make(map[string]string)
+			}
+			m[name] = values[0]
+		}
+	}
+	return m
+}
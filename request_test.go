@@ -0,0 +1,79 @@
+package h2go
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+
+	"golang.org/x/net/proxy"
+)
+
+func TestConnectRequestMetadata(t *testing.T) {
+	echo := startEcho(t)
+	sources := make(chan TunnelSource, 1)
+	client := startReverseServer(t, WithACL(ACLFunc(func(req *TunnelRequest) error {
+		if len(req.Addrs) == 0 { // the first, name-based check
+			sources <- req.Source
+		}
+		return nil
+	})))
+
+	// copy a header of HTTP requests to the metadata the server sees
+	forwardAgent := NewMiddleware(func(next ProxyHandler, ctx context.Context, req *ConnectRequest) (io.ReadWriteCloser, error) {
+		if ua := req.Header.Get("User-Agent"); ua != "" {
+			req.Metadata = map[string]string{"Agent": ua}
+		}
+		return ConnectVia(ctx, next, req)
+	})
+
+	socksAddr, httpAddr := freeAddr(t), freeAddr(t)
+	s := NewLocalServer(
+		WithSocks5Handler(client),
+		WithHTTPHandler(client),
+		WithMiddleware(forwardAgent),
+		WithListener(Listener{Addr: socksAddr, Protocol: ProtocolSOCKS5, Users: map[string]string{"alice": "secret"}}),
+		WithListener(Listener{Addr: httpAddr, Protocol: ProtocolHTTP}),
+	)
+	go s.ListenAndServe()
+	waitListening(t, "tcp", socksAddr)
+	waitListening(t, "tcp", httpAddr)
+
+	t.Run("socks5", func(t *testing.T) {
+		dialer, err := proxy.SOCKS5("tcp", socksAddr, &proxy.Auth{User: "alice", Password: "secret"}, proxy.Direct)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn, err := dialer.Dial("tcp", echo)
+		if err != nil {
+			t.Fatalf("Dial() error = %v", err)
+		}
+		defer conn.Close()
+		checkEcho(t, conn)
+
+		got := <-sources
+		if got.Protocol != ProtocolSOCKS5 || got.User != "alice" || got.Addr != conn.LocalAddr().String() {
+			t.Errorf("Source = %+v, want socks5 from alice at %s", got, conn.LocalAddr())
+		}
+	})
+
+	t.Run("http connect", func(t *testing.T) {
+		conn, err := net.Dial("tcp", httpAddr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conn.Write([]byte("CONNECT " + echo + " HTTP/1.1\r\nHost: " + echo + "\r\nUser-Agent: curl/8.0\r\n\r\n"))
+		res, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil || res.StatusCode != http.StatusOK {
+			t.Fatalf("CONNECT response = %v, %v", res, err)
+		}
+
+		got := <-sources
+		if got.Protocol != ProtocolHTTP || got.Method != "CONNECT" || got.Metadata["Agent"] != "curl/8.0" {
+			t.Errorf("Source = %+v, want an http CONNECT with agent curl/8.0", got)
+		}
+	})
+}
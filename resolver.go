@@ -0,0 +1,693 @@
+package h2go
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// Resolver resolves the host names of tunnel destinations on the server.
+// network is "ip", "ip4" or "ip6". *net.Resolver implements it.
+type Resolver interface {
+	LookupNetIP(ctx context.Context, network, host string) ([]netip.Addr, error)
+}
+
+// DNS address family preferences of the server; see WithDNSPreference.
+const (
+	PreferIPv4 = "ipv4"     // dial IPv4 addresses first
+	PreferIPv6 = "ipv6"     // dial IPv6 addresses first
+	OnlyIPv4   = "ipv4only" // resolve and dial IPv4 addresses only
+	OnlyIPv6   = "ipv6only" // resolve and dial IPv6 addresses only
+)
+
+// errPrivateAddr is why the server refuses destinations that resolve to a
+// private address; see WithBlockPrivateAddrs. Clients get ErrForbidden.
+var errPrivateAddr = errors.New("destination resolves to a private address")
+
+// IsPrivateAddr reports whether addr is not a public unicast address:
+// loopback, private (RFC 1918, RFC 4193), link-local, unspecified, CGNAT
+// (RFC 6598), benchmarking, documentation, reserved, broadcast or
+// multicast. IPv4-mapped, NAT64 (RFC 6052) and 6to4 addresses are judged
+// by the IPv4 address they embed.
+func IsPrivateAddr(addr netip.Addr) bool {
+	addr = addr.Unmap().WithZone("")
+	switch b := addr.As16(); {
+	case nat64.Contains(addr):
+		return IsPrivateAddr(netip.AddrFrom4([4]byte(b[12:16])))
+	case sixToFour.Contains(addr):
+		return IsPrivateAddr(netip.AddrFrom4([4]byte(b[2:6])))
+	}
+	for _, prefix := range privatePrefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// IPv6 prefixes embedding an IPv4 address.
+var (
+	nat64     = netip.MustParsePrefix("64:ff9b::/96")
+	sixToFour = netip.MustParsePrefix("2002::/16")
+)
+
+// privatePrefixes are the prefixes of IsPrivateAddr.
+var privatePrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),       // this network
+	netip.MustParsePrefix("10.0.0.0/8"),      // private
+	netip.MustParsePrefix("100.64.0.0/10"),   // CGNAT
+	netip.MustParsePrefix("127.0.0.0/8"),     // loopback
+	netip.MustParsePrefix("169.254.0.0/16"),  // link-local
+	netip.MustParsePrefix("172.16.0.0/12"),   // private
+	netip.MustParsePrefix("192.0.0.0/24"),    // protocol assignments
+	netip.MustParsePrefix("192.0.2.0/24"),    // documentation
+	netip.MustParsePrefix("192.168.0.0/16"),  // private
+	netip.MustParsePrefix("198.18.0.0/15"),   // benchmarking
+	netip.MustParsePrefix("198.51.100.0/24"), // documentation
+	netip.MustParsePrefix("203.0.113.0/24"),  // documentation
+	netip.MustParsePrefix("224.0.0.0/4"),     // multicast
+	netip.MustParsePrefix("240.0.0.0/4"),     // reserved and broadcast
+	netip.MustParsePrefix("::/96"),           // unspecified, loopback, IPv4-compatible
+	netip.MustParsePrefix("64:ff9b:1::/48"),  // local-use NAT64
+	netip.MustParsePrefix("100::/64"),        // discard
+	netip.MustParsePrefix("2001:db8::/32"),   // documentation
+	netip.MustParsePrefix("fc00::/7"),        // unique local
+	netip.MustParsePrefix("fe80::/10"),       // link-local
+	netip.MustParsePrefix("ff00::/8"),        // multicast
+}
+
+// HostsResolver answers host names found in Hosts and passes the others on
+// to Next, or fails for them if Next is nil.
+type HostsResolver struct {
+	// Hosts maps lower case host names to their addresses.
+	Hosts map[string][]netip.Addr
+	Next  Resolver
+}
+
+// LoadHostsFile reads a hosts file, in the format of /etc/hosts, into a
+// HostsResolver that passes other names on to next.
+func LoadHostsFile(path string, next Resolver) (*HostsResolver, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r := &HostsResolver{Hosts: make(map[string][]netip.Addr), Next: next}
+	sc := bufio.NewScanner(f)
+	for line := 1; sc.Scan(); line++ {
+		text, _, _ := strings.Cut(sc.Text(), "#")
+		fields := strings.Fields(text)
+		if len(fields) == 0 {
+			continue
+		}
+		addr, err := netip.ParseAddr(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+		for _, name := range fields[1:] {
+			name = strings.TrimSuffix(strings.ToLower(name), ".")
+			r.Hosts[name] = append(r.Hosts[name], addr)
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// LookupNetIP returns the addresses of host in Hosts, or else those Next
+// finds.
+func (r *HostsResolver) LookupNetIP(ctx context.Context, network, host string) ([]netip.Addr, error) {
+	if addrs, ok := r.Hosts[strings.TrimSuffix(strings.ToLower(host), ".")]; ok {
+		if addrs = filterFamily(network, addrs); len(addrs) > 0 {
+			return addrs, nil
+		}
+		return nil, notFound(host)
+	}
+	if r.Next == nil {
+		return nil, notFound(host)
+	}
+	return r.Next.LookupNetIP(ctx, network, host)
+}
+
+// filterFamily returns the addresses of addrs that belong to network.
+func filterFamily(network string, addrs []netip.Addr) []netip.Addr {
+	if network == "ip" {
+		return addrs
+	}
+	var out []netip.Addr
+	for _, a := range addrs {
+		if a.Unmap().Is4() == (network == "ip4") {
+			out = append(out, a)
+		}
+	}
+	return out
+}
+
+// notFound returns the error of a lookup of a host without addresses.
+func notFound(host string) error {
+	return &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+}
+
+// DNS cache limits.
+const (
+	dnsCacheSize   = 4096
+	dnsMaxTTL      = 24 * time.Hour
+	dnsNegativeTTL = 30 * time.Second // for answers without an SOA record
+	dnsUDPSize     = 1232             // the EDNS buffer size of DNS flag day 2020
+)
+
+// DNSResolver resolves host names with DNS servers instead of the resolver
+// of the operating system, and caches the answers for their TTL. It
+// implements Resolver.
+type DNSResolver struct {
+	// TLSConfig is used for DNS over TLS and HTTPS servers. If nil, the
+	// system roots verify them.
+	TLSConfig *tls.Config
+
+	// Timeout bounds each query. The default is 5 seconds.
+	Timeout time.Duration
+
+	servers []dnsServer
+	client  *http.Client
+
+	mu    sync.Mutex
+	cache map[dnsCacheKey]dnsCacheEntry
+}
+
+// dnsServer is a DNS server and the protocol to reach it with: "udp",
+// "tcp", "tls" or "https".
+type dnsServer struct {
+	proto string
+	addr  string // host:port, or the URL for https
+}
+
+type dnsCacheKey struct {
+	name  string
+	qtype dnsmessage.Type
+}
+
+type dnsCacheEntry struct {
+	addrs   []netip.Addr
+	expires time.Time
+}
+
+// NewDNSResolver returns a resolver querying servers in order until one
+// answers. A server is an IP address with an optional port, or a URL:
+// udp://host[:port] or tcp://host[:port] for plain DNS (port 53),
+// tls://host[:port] for DNS over TLS (RFC 7858, port 853) and an https
+// URL for DNS over HTTPS (RFC 8484). UDP answers that are truncated are
+// asked again over TCP.
+//
+// Example:
+//
+//	r, err := h2go.NewDNSResolver("https://cloudflare-dns.com/dns-query", "tls://9.9.9.9")
+func NewDNSResolver(servers ...string) (*DNSResolver, error) {
+	if len(servers) == 0 {
+		return nil, errors.New("no DNS servers")
+	}
+	r := &DNSResolver{cache: make(map[dnsCacheKey]dnsCacheEntry)}
+	for _, s := range servers {
+		server, err := parseDNSServer(s)
+		if err != nil {
+			return nil, err
+		}
+		r.servers = append(r.servers, server)
+	}
+	return r, nil
+}
+
+// parseDNSServer parses a server given to NewDNSResolver.
+func parseDNSServer(s string) (dnsServer, error) {
+	if addr, err := netip.ParseAddr(s); err == nil {
+		return dnsServer{proto: "udp", addr: netip.AddrPortFrom(addr, 53).String()}, nil
+	}
+	if addr, err := netip.ParseAddrPort(s); err == nil {
+		return dnsServer{proto: "udp", addr: addr.String()}, nil
+	}
+	u, err := url.Parse(s)
+	if err != nil || u.Host == "" {
+		return dnsServer{}, fmt.Errorf("DNS server %q should be an address or a URL", s)
+	}
+	port := map[string]string{"udp": "53", "tcp": "53", "tls": "853"}[u.Scheme]
+	switch {
+	case u.Scheme == "https":
+		return dnsServer{proto: "https", addr: s}, nil
+	case port == "":
+		return dnsServer{}, fmt.Errorf("DNS server %q: unknown scheme %q, use udp, tcp, tls or https", s, u.Scheme)
+	case u.Port() != "":
+		port = u.Port()
+	}
+	return dnsServer{proto: u.Scheme, addr: net.JoinHostPort(u.Hostname(), port)}, nil
+}
+
+// LookupNetIP returns the addresses of host, from the cache if the answer
+// has not expired. network "ip" asks for both A and AAAA records.
+func (r *DNSResolver) LookupNetIP(ctx context.Context, network, host string) ([]netip.Addr, error) {
+	if addr, err := netip.ParseAddr(host); err == nil {
+		return filterFamily(network, []netip.Addr{addr}), nil
+	}
+	name := strings.TrimSuffix(strings.ToLower(host), ".") + "."
+	var qtypes []dnsmessage.Type
+	switch network {
+	case "ip4":
+		qtypes = []dnsmessage.Type{dnsmessage.TypeA}
+	case "ip6":
+		qtypes = []dnsmessage.Type{dnsmessage.TypeAAAA}
+	default:
+		qtypes = []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA}
+	}
+
+	type result struct {
+		addrs []netip.Addr
+		err   error
+	}
+	results := make([]result, len(qtypes))
+	var wg sync.WaitGroup
+	for i, qtype := range qtypes {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i].addrs, results[i].err = r.lookup(ctx, name, qtype)
+		}()
+	}
+	wg.Wait()
+
+	var addrs []netip.Addr
+	var err error
+	for _, res := range results {
+		addrs = append(addrs, res.addrs...)
+		if res.err != nil {
+			err = res.err
+		}
+	}
+	if len(addrs) > 0 {
+		return addrs, nil
+	}
+	if err != nil {
+		return nil, &net.DNSError{Err: err.Error(), Name: host}
+	}
+	return nil, notFound(host)
+}
+
+// lookup returns the records of type qtype of name.
+func (r *DNSResolver) lookup(ctx context.Context, name string, qtype dnsmessage.Type) ([]netip.Addr, error) {
+	key := dnsCacheKey{name, qtype}
+	r.mu.Lock()
+	entry, ok := r.cache[key]
+	r.mu.Unlock()
+	if ok && time.Now().Before(entry.expires) {
+		return entry.addrs, nil
+	}
+
+	var err error
+	for _, server := range r.servers {
+		var addrs []netip.Addr
+		var ttl time.Duration
+		addrs, ttl, err = r.query(ctx, server, name, qtype)
+		if err == nil {
+			r.store(key, addrs, ttl)
+			return addrs, nil
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, err
+}
+
+// store caches addrs under key for ttl.
+func (r *DNSResolver) store(key dnsCacheKey, addrs []netip.Addr, ttl time.Duration) {
+	if ttl <= 0 {
+		return
+	}
+	now := time.Now()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.cache) >= dnsCacheSize {
+		for k, e := range r.cache {
+			if now.After(e.expires) {
+				delete(r.cache, k)
+			}
+		}
+		for k := range r.cache {
+			if len(r.cache) < dnsCacheSize {
+				break
+			}
+			delete(r.cache, k)
+		}
+	}
+	r.cache[key] = dnsCacheEntry{addrs: addrs, expires: now.Add(min(ttl, dnsMaxTTL))}
+}
+
+// query asks server for the records of type qtype of name, and returns
+// them with the time they may be cached for. A name without records is not
+// an error.
+func (r *DNSResolver) query(ctx context.Context, server dnsServer, name string, qtype dnsmessage.Type) ([]netip.Addr, time.Duration, error) {
+	timeout := r.Timeout
+	if timeout <= 0 {
+		timeout = 5 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	var id uint16
+	if server.proto != "https" {
+		// DNS over HTTPS uses id 0 so that answers can be cached
+		binary.Read(rand.Reader, binary.BigEndian, &id)
+	}
+	q, err := newDNSQuery(id, name, qtype)
+	if err != nil {
+		return nil, 0, err
+	}
+	var answer []byte
+	switch server.proto {
+	case "udp":
+		answer, err = r.exchangeUDP(ctx, server.addr, q)
+		if err == errTruncated {
+			answer, err = r.exchangeStream(ctx, "tcp", server.addr, q)
+		}
+	case "tcp", "tls":
+		answer, err = r.exchangeStream(ctx, server.proto, server.addr, q)
+	case "https":
+		answer, err = r.exchangeHTTPS(ctx, server.addr, q)
+	}
+	if err != nil {
+		return nil, 0, fmt.Errorf("%s://%s: %w", server.proto, server.addr, err)
+	}
+	addrs, ttl, err := parseDNSAnswer(answer, id, name, qtype)
+	if err != nil {
+		return nil, 0, fmt.Errorf("%s://%s: %w", server.proto, server.addr, err)
+	}
+	return addrs, ttl, nil
+}
+
+// errTruncated is returned for UDP answers that did not fit.
+var errTruncated = errors.New("truncated DNS answer")
+
+// newDNSQuery returns a recursive query for the records of type qtype of
+// name.
+func newDNSQuery(id uint16, name string, qtype dnsmessage.Type) ([]byte, error) {
+	n, err := dnsmessage.NewName(name)
+	if err != nil {
+		return nil, err
+	}
+	b := dnsmessage.NewBuilder(make([]byte, 2, 512), dnsmessage.Header{ID: id, RecursionDesired: true})
+	b.EnableCompression()
+	if err := b.StartQuestions(); err != nil {
+		return nil, err
+	}
+	if err := b.Question(dnsmessage.Question{Name: n, Type: qtype, Class: dnsmessage.ClassINET}); err != nil {
+		return nil, err
+	}
+	if err := b.StartAdditionals(); err != nil {
+		return nil, err
+	}
+	var opt dnsmessage.ResourceHeader
+	if err := opt.SetEDNS0(dnsUDPSize, dnsmessage.RCodeSuccess, false); err != nil {
+		return nil, err
+	}
+	if err := b.OPTResource(opt, dnsmessage.OPTResource{}); err != nil {
+		return nil, err
+	}
+	msg, err := b.Finish()
+	if err != nil {
+		return nil, err
+	}
+	// the first two bytes hold the length of the message over streams
+	binary.BigEndian.PutUint16(msg, uint16(len(msg)-2))
+	return msg, nil
+}
+
+// exchangeUDP sends the query q to addr over UDP and returns the answer.
+func (r *DNSResolver) exchangeUDP(ctx context.Context, addr string, q []byte) ([]byte, error) {
+	conn, err := (&net.Dialer{}).DialContext(ctx, "udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if _, err := conn.Write(q[2:]); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, dnsUDPSize)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		var h dnsmessage.Header
+		var p dnsmessage.Parser
+		if h, err = p.Start(buf[:n]); err != nil || h.ID != binary.BigEndian.Uint16(q[2:]) {
+			continue // not the answer, e.g. spoofed
+		}
+		if h.Truncated {
+			return nil, errTruncated
+		}
+		return buf[:n], nil
+	}
+}
+
+// exchangeStream sends the query q to addr over TCP, or TLS if network is
+// "tls", and returns the answer.
+func (r *DNSResolver) exchangeStream(ctx context.Context, network, addr string, q []byte) ([]byte, error) {
+	var conn net.Conn
+	var err error
+	if network == "tls" {
+		conn, err = (&tls.Dialer{Config: r.TLSConfig}).DialContext(ctx, "tcp", addr)
+	} else {
+		conn, err = (&net.Dialer{}).DialContext(ctx, "tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if _, err := conn.Write(q); err != nil {
+		return nil, err
+	}
+	var length uint16
+	if err := binary.Read(conn, binary.BigEndian, &length); err != nil {
+		return nil, err
+	}
+	answer := make([]byte, length)
+	if _, err := io.ReadFull(conn, answer); err != nil {
+		return nil, err
+	}
+	return answer, nil
+}
+
+// exchangeHTTPS posts the query q to the DNS over HTTPS endpoint u and
+// returns the answer.
+func (r *DNSResolver) exchangeHTTPS(ctx context.Context, u string, q []byte) ([]byte, error) {
+	r.mu.Lock()
+	if r.client == nil {
+		r.client = &http.Client{Transport: &http.Transport{
+			TLSClientConfig:   r.TLSConfig,
+			ForceAttemptHTTP2: true,
+			IdleConnTimeout:   90 * time.Second,
+		}}
+	}
+	client := r.client
+	r.mu.Unlock()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, bytes.NewReader(q[2:]))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("HTTP status %s", res.Status)
+	}
+	return io.ReadAll(io.LimitReader(res.Body, 65535))
+}
+
+// parseDNSAnswer returns the addresses in the answer to the query id for
+// the records of type qtype of name, and the time the answer may be cached
+// for: the lowest TTL of its records, or for answers without addresses the
+// negative caching TTL of the zone (RFC 2308).
+func parseDNSAnswer(msg []byte, id uint16, name string, qtype dnsmessage.Type) ([]netip.Addr, time.Duration, error) {
+	var p dnsmessage.Parser
+	h, err := p.Start(msg)
+	if err != nil {
+		return nil, 0, err
+	}
+	if h.ID != id || !h.Response {
+		return nil, 0, errors.New("answer does not match the query")
+	}
+	questions, err := p.AllQuestions()
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(questions) != 1 || !strings.EqualFold(questions[0].Name.String(), name) || questions[0].Type != qtype {
+		return nil, 0, errors.New("answer does not match the query")
+	}
+	if h.RCode != dnsmessage.RCodeSuccess && h.RCode != dnsmessage.RCodeNameError {
+		return nil, 0, fmt.Errorf("DNS error %s", h.RCode)
+	}
+
+	var addrs []netip.Addr
+	ttl := uint32(dnsMaxTTL / time.Second)
+	for {
+		rh, err := p.AnswerHeader()
+		if err == dnsmessage.ErrSectionDone {
+			break
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		// the records of a CNAME chain all count for the TTL
+		ttl = min(ttl, rh.TTL)
+		switch {
+		case rh.Type == dnsmessage.TypeA && qtype == dnsmessage.TypeA:
+			a, err := p.AResource()
+			if err != nil {
+				return nil, 0, err
+			}
+			addrs = append(addrs, netip.AddrFrom4(a.A))
+		case rh.Type == dnsmessage.TypeAAAA && qtype == dnsmessage.TypeAAAA:
+			a, err := p.AAAAResource()
+			if err != nil {
+				return nil, 0, err
+			}
+			addrs = append(addrs, netip.AddrFrom16(a.AAAA))
+		default:
+			if err := p.SkipAnswer(); err != nil {
+				return nil, 0, err
+			}
+		}
+	}
+	if len(addrs) > 0 {
+		return addrs, time.Duration(ttl) * time.Second, nil
+	}
+
+	negative := dnsNegativeTTL
+	for {
+		rh, err := p.AuthorityHeader()
+		if err != nil {
+			break
+		}
+		if rh.Type != dnsmessage.TypeSOA {
+			if p.SkipAuthority() != nil {
+				break
+			}
+			continue
+		}
+		soa, err := p.SOAResource()
+		if err != nil {
+			break
+		}
+		negative = time.Duration(min(rh.TTL, soa.MinTTL)) * time.Second
+		break
+	}
+	return nil, negative, nil
+}
+
+// resolve returns the addresses of host, a destination of the server, in
+// the order they are dialed.
+func (s *ProxyServer) resolve(ctx context.Context, host string) ([]netip.Addr, error) {
+	network := "ip"
+	switch s.dnsPreference {
+	case OnlyIPv4:
+		network = "ip4"
+	case OnlyIPv6:
+		network = "ip6"
+	}
+	var addrs []netip.Addr
+	if addr, err := netip.ParseAddr(host); err == nil {
+		addrs = filterFamily(network, []netip.Addr{addr})
+	} else {
+		r := s.resolver
+		if r == nil {
+			r = net.DefaultResolver
+		}
+		ctx, cancel := context.WithTimeout(ctx, s.dialTimeout)
+		defer cancel()
+		if addrs, err = r.LookupNetIP(ctx, network, host); err != nil {
+			return nil, err
+		}
+	}
+	if len(addrs) == 0 {
+		return nil, notFound(host)
+	}
+	if s.dnsPreference == PreferIPv4 || s.dnsPreference == PreferIPv6 {
+		first4 := s.dnsPreference == PreferIPv4
+		// the resolver may share its slice, e.g. a HostsResolver entry
+		addrs = slices.Clone(addrs)
+		slices.SortStableFunc(addrs, func(a, b netip.Addr) int {
+			if a.Unmap().Is4() == b.Unmap().Is4() {
+				return 0
+			}
+			if a.Unmap().Is4() == first4 {
+				return -1
+			}
+			return 1
+		})
+	}
+	return addrs, nil
+}
+
+// allowAddrs checks the addresses the destination of req resolved to
+// against the private address block and the ACL.
+func (s *ProxyServer) allowAddrs(req *TunnelRequest) error {
+	if s.blockPrivate && slices.ContainsFunc(req.Addrs, IsPrivateAddr) {
+		return errPrivateAddr
+	}
+	if s.acl != nil {
+		return s.acl.Allow(req)
+	}
+	return nil
+}
+
+// dial connects to port on the first of addrs that accepts. Like the
+// dialer of the net package, it gives each address an equal share of the
+// dial timeout, but at least 2 seconds while time is left.
+func (s *ProxyServer) dial(addrs []netip.Addr, port string) (net.Conn, error) {
+	deadline := time.Now().Add(s.dialTimeout)
+	err := error(os.ErrDeadlineExceeded)
+	for i, a := range addrs {
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			break
+		}
+		timeout := remaining / time.Duration(len(addrs)-i)
+		if timeout < 2*time.Second {
+			timeout = min(2*time.Second, remaining)
+		}
+		conn, dialErr := net.DialTimeout("tcp", net.JoinHostPort(a.String(), port), timeout)
+		if dialErr == nil {
+			return conn, nil
+		}
+		if i == 0 {
+			err = dialErr
+		}
+	}
+	return nil, err
+}
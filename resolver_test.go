@@ -0,0 +1,353 @@
+package h2go
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// testRecords are the records of the test DNS server: the addresses of each
+// name, answered with TTL ttl. Names starting with "big." are truncated
+// over UDP.
+type testRecords struct {
+	addrs   map[string][]netip.Addr
+	ttl     uint32
+	queries atomic.Int32
+}
+
+// answer returns the answer to the query q.
+func (tr *testRecords) answer(t *testing.T, q []byte, udp bool) []byte {
+	t.Helper()
+	tr.queries.Add(1)
+	var p dnsmessage.Parser
+	h, err := p.Start(q)
+	if err != nil {
+		t.Errorf("bad query: %v", err)
+		return nil
+	}
+	question, err := p.Question()
+	if err != nil {
+		t.Errorf("bad question: %v", err)
+		return nil
+	}
+	name := question.Name.String()
+	addrs, ok := tr.addrs[name]
+	res := dnsmessage.Header{ID: h.ID, Response: true, RecursionAvailable: true}
+	if !ok {
+		res.RCode = dnsmessage.RCodeNameError
+	}
+	if udp && strings.HasPrefix(name, "big.") {
+		res.Truncated = true
+		addrs = nil
+	}
+	b := dnsmessage.NewBuilder(nil, res)
+	b.StartQuestions()
+	b.Question(question)
+	b.StartAnswers()
+	for _, a := range addrs {
+		rh := dnsmessage.ResourceHeader{Name: question.Name, Class: dnsmessage.ClassINET, TTL: tr.ttl}
+		switch {
+		case a.Is4() && question.Type == dnsmessage.TypeA:
+			b.AResource(rh, dnsmessage.AResource{A: a.As4()})
+		case a.Is6() && question.Type == dnsmessage.TypeAAAA:
+			b.AAAAResource(rh, dnsmessage.AAAAResource{AAAA: a.As16()})
+		}
+	}
+	msg, err := b.Finish()
+	if err != nil {
+		t.Errorf("building answer: %v", err)
+	}
+	return msg
+}
+
+// startDNS starts a DNS server answering from tr over UDP and TCP on the
+// same port, and returns its address.
+func startDNS(t *testing.T, tr *testRecords) string {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	ln, err := net.Listen("tcp", pc.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			pc.WriteTo(tr.answer(t, buf[:n], true), addr)
+		}
+	}()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				var length uint16
+				if binary.Read(conn, binary.BigEndian, &length) != nil {
+					return
+				}
+				q := make([]byte, length)
+				if _, err := io.ReadFull(conn, q); err != nil {
+					return
+				}
+				msg := tr.answer(t, q, false)
+				conn.Write(binary.BigEndian.AppendUint16(nil, uint16(len(msg))))
+				conn.Write(msg)
+			}()
+		}
+	}()
+	return pc.LocalAddr().String()
+}
+
+func newTestRecords(ttl uint32) *testRecords {
+	return &testRecords{
+		ttl: ttl,
+		addrs: map[string][]netip.Addr{
+			"a.test.":   {netip.MustParseAddr("192.0.2.1"), netip.MustParseAddr("2001:db8::1")},
+			"big.test.": {netip.MustParseAddr("192.0.2.2")},
+		},
+	}
+}
+
+func TestDNSResolver(t *testing.T) {
+	records := newTestRecords(60)
+	addr := startDNS(t, records)
+	r, err := NewDNSResolver(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	addrs, err := r.LookupNetIP(ctx, "ip", "A.test")
+	if err != nil {
+		t.Fatalf("LookupNetIP() error = %v", err)
+	}
+	if len(addrs) != 2 {
+		t.Errorf("addrs = %v, want an A and an AAAA address", addrs)
+	}
+	queries := records.queries.Load()
+	if _, err := r.LookupNetIP(ctx, "ip", "a.test."); err != nil {
+		t.Fatal(err)
+	}
+	if n := records.queries.Load(); n != queries {
+		t.Errorf("cached lookup sent %d queries", n-queries)
+	}
+
+	addrs, err = r.LookupNetIP(ctx, "ip6", "a.test")
+	if err != nil || len(addrs) != 1 || !addrs[0].Is6() {
+		t.Errorf("ip6 lookup = %v, %v, want the AAAA address", addrs, err)
+	}
+
+	addrs, err = r.LookupNetIP(ctx, "ip4", "big.test")
+	if err != nil || len(addrs) != 1 || addrs[0] != netip.MustParseAddr("192.0.2.2") {
+		t.Errorf("truncated lookup = %v, %v, want the answer over TCP", addrs, err)
+	}
+
+	var dnsErr *net.DNSError
+	if _, err := r.LookupNetIP(ctx, "ip", "missing.test"); !errors.As(err, &dnsErr) || !dnsErr.IsNotFound {
+		t.Errorf("lookup of a missing name error = %v, want not found", err)
+	}
+}
+
+func TestDNSResolverTTL(t *testing.T) {
+	records := newTestRecords(0)
+	r, err := NewDNSResolver("udp://" + startDNS(t, records))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for range 2 {
+		if _, err := r.LookupNetIP(context.Background(), "ip4", "a.test"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := records.queries.Load(); n != 2 {
+		t.Errorf("sent %d queries for an answer with TTL 0, want 2", n)
+	}
+}
+
+func TestDNSResolverHTTPS(t *testing.T) {
+	records := newTestRecords(60)
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/dns-message" {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		q, _ := io.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "application/dns-message")
+		w.Write(records.answer(t, q, false))
+	}))
+	defer ts.Close()
+
+	r, err := NewDNSResolver("https://unreachable.invalid/dns-query", ts.URL+"/dns-query")
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(ts.Certificate())
+	r.TLSConfig = &tls.Config{RootCAs: roots}
+	addrs, err := r.LookupNetIP(context.Background(), "ip4", "a.test")
+	if err != nil || len(addrs) != 1 || addrs[0] != netip.MustParseAddr("192.0.2.1") {
+		t.Errorf("LookupNetIP() = %v, %v, want 192.0.2.1 from the second server", addrs, err)
+	}
+}
+
+func TestNewDNSResolverErrors(t *testing.T) {
+	for _, server := range []string{"dns.example", "quic://9.9.9.9", "udp://"} {
+		if _, err := NewDNSResolver(server); err == nil {
+			t.Errorf("NewDNSResolver(%q) error = nil", server)
+		}
+	}
+}
+
+func TestLoadHostsFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "hosts")
+	os.WriteFile(path, []byte("# comment\n10.0.0.1 db.internal db # primary\n::1 db.internal\n"), 0o600)
+	r, err := LoadHostsFile(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addrs, err := r.LookupNetIP(context.Background(), "ip", "DB.internal.")
+	if err != nil || len(addrs) != 2 {
+		t.Errorf("LookupNetIP() = %v, %v, want 2 addresses", addrs, err)
+	}
+	if addrs, err := r.LookupNetIP(context.Background(), "ip4", "db"); err != nil || addrs[0] != netip.MustParseAddr("10.0.0.1") {
+		t.Errorf("LookupNetIP(ip4) = %v, %v, want 10.0.0.1", addrs, err)
+	}
+	if _, err := r.LookupNetIP(context.Background(), "ip", "other"); err == nil {
+		t.Errorf("lookup of a name not in the file succeeded without a next resolver")
+	}
+}
+
+func TestIsPrivateAddr(t *testing.T) {
+	for addr, want := range map[string]bool{
+		"127.0.0.1":        true,
+		"10.1.2.3":         true,
+		"172.16.0.1":       true,
+		"169.254.169.254":  true,
+		"100.64.0.1":       true,
+		"0.0.0.0":          true,
+		"::1":              true,
+		"fd00::1":          true,
+		"::ffff:10.0.0.1":  true,
+		"ff02::1":          true,
+		"fe80::1%eth0":     true,
+		"0.1.2.3":          true,
+		"198.18.0.1":       true,
+		"240.0.0.1":        true,
+		"255.255.255.255":  true,
+		"64:ff9b::a00:1":   true,
+		"2002:c0a8:101::":  true,
+		"64:ff9b::808:808": false,
+		"2002:808:808::1":  false,
+		"172.32.0.1":       false,
+		"93.184.216.34":    false,
+		"2606:4700::1111":  false,
+	} {
+		if got := IsPrivateAddr(netip.MustParseAddr(addr)); got != want {
+			t.Errorf("IsPrivateAddr(%s) = %v, want %v", addr, got, want)
+		}
+	}
+}
+
+func TestServerResolver(t *testing.T) {
+	echo := startEcho(t)
+	_, port, _ := net.SplitHostPort(echo)
+	hosts := &HostsResolver{Hosts: map[string][]netip.Addr{
+		"echo.test": {netip.MustParseAddr("::1"), netip.MustParseAddr("127.0.0.1")},
+	}}
+	seen := make(chan []netip.Addr, 1)
+	acl := ACLFunc(func(req *TunnelRequest) error {
+		if len(req.Addrs) > 0 {
+			seen <- req.Addrs
+		}
+		return nil
+	})
+
+	t.Run("resolved", func(t *testing.T) {
+		client := startReverseServer(t, WithResolver(hosts), WithDNSPreference(PreferIPv4), WithACL(acl))
+		conn, err := client.Connect(net.JoinHostPort("echo.test", port))
+		if err != nil {
+			t.Fatalf("Connect() error = %v", err)
+		}
+		defer conn.Close()
+		if addrs := <-seen; !slices.Equal(addrs, []netip.Addr{netip.MustParseAddr("127.0.0.1"), netip.MustParseAddr("::1")}) {
+			t.Errorf("ACL saw %v, want 127.0.0.1 first", addrs)
+		}
+		if first := hosts.Hosts["echo.test"][0]; first != netip.MustParseAddr("::1") {
+			t.Errorf("sorting changed the hosts entry to start with %v", first)
+		}
+	})
+
+	t.Run("private", func(t *testing.T) {
+		client := startReverseServer(t, WithResolver(hosts), WithBlockPrivateAddrs(true))
+		_, err := client.Connect(net.JoinHostPort("echo.test", port))
+		if !errors.Is(err, ErrForbidden) || !strings.Contains(err.Error(), "private") {
+			t.Errorf("Connect() error = %v, want ErrForbidden for a private address", err)
+		}
+	})
+
+	t.Run("no lookups when denied", func(t *testing.T) {
+		counting := &countingResolver{Resolver: hosts}
+		client := startReverseServer(t,
+			WithResolver(counting),
+			WithMaxTunnelsPerClient(1),
+			WithACL(ACLFunc(func(req *TunnelRequest) error {
+				if req.Host == "denied.test" {
+					return errors.New("denied")
+				}
+				return nil
+			})),
+		)
+		if _, err := client.Connect(net.JoinHostPort("denied.test", port)); !errors.Is(err, ErrForbidden) {
+			t.Errorf("Connect() error = %v, want ErrForbidden", err)
+		}
+		conn, err := client.Connect(net.JoinHostPort("echo.test", port))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		if _, err := client.Connect(net.JoinHostPort("echo.test", port)); err == nil {
+			t.Error("Connect() over the tunnel limit succeeded")
+		}
+		if n := counting.lookups.Load(); n != 1 {
+			t.Errorf("server resolved %d times, want 1 for the allowed tunnel", n)
+		}
+	})
+}
+
+// countingResolver counts the lookups of the Resolver it wraps.
+type countingResolver struct {
+	Resolver
+	lookups atomic.Int32
+}
+
+func (r *countingResolver) LookupNetIP(ctx context.Context, network, host string) ([]netip.Addr, error) {
+	r.lookups.Add(1)
+	return r.Resolver.LookupNetIP(ctx, network, host)
+}
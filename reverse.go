@@ -0,0 +1,445 @@
+package h2go
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// reverseAddrHeader carries the address a reverse tunnel registration
+// listens on, e.g. the port picked by the server for port 0.
+const reverseAddrHeader = "Reverse-Addr"
+
+// reverseRegistration is a client's registration of a reverse tunnel on the
+// server. Connections sent to conns are handed to the client as tunnels.
+type reverseRegistration struct {
+	conns chan net.Conn
+	done  chan struct{} // closed when the registration ends
+}
+
+// dial connects to the client of a virtual endpoint registration.
+func (reg *reverseRegistration) dial(timeout time.Duration) (net.Conn, error) {
+	local, remote := net.Pipe()
+	select {
+	case reg.conns <- remote:
+		return local, nil
+	case <-reg.done:
+		local.Close()
+		remote.Close()
+		return nil, errors.New("endpoint closed")
+	case <-time.After(timeout):
+		local.Close()
+		remote.Close()
+		return nil, errors.New("endpoint not accepting connections")
+	}
+}
+
+// endpointSuffix is the domain of virtual endpoints: clients reach the
+// endpoint "demo" as "demo.h2go". It keeps endpoints from shadowing the host
+// names of the server's network, so that a client cannot intercept the
+// connections of others to them.
+const endpointSuffix = ".h2go"
+
+// validEndpointName reports whether name can name a virtual endpoint. Names
+// have no dots or colons, and localhost is reserved.
+func validEndpointName(name string) bool {
+	return name != "" && !strings.ContainsAny(name, ".:[]") && !strings.EqualFold(name, "localhost")
+}
+
+// endpoint returns the registration of the virtual endpoint host, if any.
+func (s *ProxyServer) endpoint(host string) *reverseRegistration {
+	name, ok := strings.CutSuffix(strings.ToLower(host), endpointSuffix)
+	if !ok {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.endpoints[name]
+}
+
+// handleListen serves reverse tunnel registrations. It accepts connections
+// on the requested address, or on a virtual endpoint, and streams the ids
+// of their tunnels to the client, one per line followed by the remote
+// address, until the client goes away.
+func (s *ProxyServer) handleListen(w http.ResponseWriter, r *http.Request) {
+	if err := s.before(w, r); err != nil {
+		return
+	}
+	host := r.Header.Get("DSTHOST")
+	port := r.Header.Get("DSTPORT")
+	client := s.clientID(r)
+	if !s.reverse {
+		WriteHTTPForbidden(w, "reverse tunnels are disabled")
+		return
+	}
+	if s.acl != nil {
+		req := &TunnelRequest{
+			Client:      client,
+			User:        s.user(r),
+			RemoteAddr:  r.RemoteAddr,
+			Certificate: peerCertificate(r),
+			Host:        host,
+			Port:        port,
+			Reverse:     true,
+		}
+		if err := s.acl.Allow(req); err != nil {
+			s.logger.Warn("listen denied",
+				"client", client,
+				"host", host,
+				"port", port,
+				"msg", err)
+			WriteHTTPForbidden(w, err.Error())
+			return
+		}
+	}
+	if err := s.limits.acquire(client); err != nil {
+		s.logger.Warn("listen rejected",
+			"client", client,
+			"host", host,
+			"port", port,
+			"msg", err)
+		WriteHTTPLimited(w, err.Error())
+		return
+	}
+	defer s.limits.release(client)
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		WriteHTTPError(w, "streaming not supported")
+		return
+	}
+
+	reg := &reverseRegistration{
+		conns: make(chan net.Conn),
+		done:  make(chan struct{}),
+	}
+	defer close(reg.done)
+	var bound string
+	if port == "" {
+		if !validEndpointName(host) {
+			WriteHTTPError(w, fmt.Sprintf("invalid endpoint name %q", host))
+			return
+		}
+		name := strings.ToLower(host)
+		s.mu.Lock()
+		_, taken := s.endpoints[name]
+		if !taken {
+			s.endpoints[name] = reg
+		}
+		s.mu.Unlock()
+		if taken {
+			WriteHTTPError(w, fmt.Sprintf("endpoint %s is already registered", host))
+			return
+		}
+		defer func() {
+			s.mu.Lock()
+			delete(s.endpoints, name)
+			s.mu.Unlock()
+		}()
+		bound = name + endpointSuffix
+	} else {
+		ln, err := net.Listen("tcp", net.JoinHostPort(host, port))
+		if err != nil {
+			WriteHTTPError(w, fmt.Sprintf("listen %s %v", net.JoinHostPort(host, port), err))
+			return
+		}
+		defer ln.Close()
+		go func() {
+			for {
+				conn, err := ln.Accept()
+				if err != nil {
+					return
+				}
+				select {
+				case reg.conns <- conn:
+				case <-reg.done:
+					conn.Close()
+					return
+				}
+			}
+		}()
+		bound = ln.Addr().String()
+	}
+
+	s.logger.Info("reverse tunnel registered", "addr", bound, "client", client)
+	defer s.logger.Info("reverse tunnel closed", "addr", bound, "client", client)
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set(reverseAddrHeader, bound)
+	w.WriteHeader(HeadOK)
+	flusher.Flush()
+
+	// keep idle registrations from being dropped by intermediaries
+	keepalive := time.NewTicker(s.heartTTL / 2)
+	defer keepalive.Stop()
+	for {
+		var line string
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepalive.C:
+			line = "\n"
+		case conn := <-reg.conns:
+			if err := s.limits.acquire(client); err != nil {
+				s.logger.Warn("reverse connection rejected",
+					"client", client,
+					"addr", bound,
+					"msg", err)
+				conn.Close()
+				continue
+			}
+			remote := conn.RemoteAddr().String()
+			line = s.openTunnel(conn, client, remote) + " " + remote + "\n"
+		}
+		if _, err := io.WriteString(w, line); err != nil {
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+// reverseListener is the net.Listener returned by Client.Listen.
+type reverseListener struct {
+	client *Client
+	addr   tunnelAddr
+	body   io.ReadCloser
+	cancel context.CancelFunc
+	conns  chan net.Conn
+	done   chan struct{}
+	once   sync.Once
+	err    error // why conns was closed, set before closing it
+}
+
+// Listen asks the server to accept connections on addr on behalf of the
+// client, and returns a listener whose Accept returns them. addr is a
+// "host:port" to listen on, or the name of a virtual endpoint, without
+// dots or colons, which other clients of the server reach by connecting to
+// "name.h2go:port" with any port. The server must allow reverse tunnels, see
+// WithReverseTunnels.
+//
+// The registration ends when the listener is closed or the connection to
+// the server is lost, after which Accept returns an error.
+func (c *Client) Listen(addr string) (net.Listener, error) {
+	if c.err != nil {
+		return nil, fmt.Errorf("client configuration: %w", c.err)
+	}
+	host, port := addr, ""
+	if strings.Contains(addr, ":") {
+		var err error
+		if host, port, err = net.SplitHostPort(addr); err != nil {
+			return nil, fmt.Errorf("invalid address %q: %w", addr, err)
+		}
+	}
+	conn := newClientConnection(strings.TrimSuffix(c.serverURL, "/"), c)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	// only the registration is bounded by the timeout, not the stream
+	timer := time.AfterFunc(c.timeout, cancel)
+	res, err := conn.listen(ctx, host, port)
+	var skew *clockSkewError
+	if errors.As(err, &skew) && c.skewCorrection {
+		c.logger.Warn("clock skew detected, retrying with server time",
+			"offset", skew.offset)
+		c.clockOffset.Store(int64(skew.offset))
+		res, err = conn.listen(ctx, host, port)
+	}
+	if !timer.Stop() && err == nil {
+		res.Body.Close()
+		err = context.DeadlineExceeded
+	}
+	if err != nil {
+		cancel()
+		return nil, fmt.Errorf("listen %s: %w", addr, err)
+	}
+
+	l := &reverseListener{
+		client: c,
+		addr:   tunnelAddr(res.Header.Get(reverseAddrHeader)),
+		body:   res.Body,
+		cancel: cancel,
+		conns:  make(chan net.Conn),
+		done:   make(chan struct{}),
+	}
+	go l.run()
+	return l, nil
+}
+
+// run opens the tunnels the server announces and queues them for Accept.
+func (l *reverseListener) run() {
+	defer close(l.conns)
+	sc := bufio.NewScanner(l.body)
+	for sc.Scan() {
+		id, remote, _ := strings.Cut(strings.TrimSpace(sc.Text()), " ")
+		if id == "" {
+			continue // keepalive
+		}
+		conn := newClientConnection(strings.TrimSuffix(l.client.serverURL, "/"), l.client)
+		if err := l.client.open(conn, id); err != nil {
+			l.client.logger.Warn("error opening reverse tunnel",
+				"addr", l.addr,
+				"err", err)
+			continue
+		}
+		select {
+		case l.conns <- newTunnelConn(conn, l.addr, tunnelAddr(remote)):
+		case <-l.done:
+			conn.Close()
+			return
+		}
+	}
+	l.err = sc.Err()
+	if l.err == nil {
+		l.err = io.EOF
+	}
+}
+
+// Accept waits for the next connection the server accepted.
+func (l *reverseListener) Accept() (net.Conn, error) {
+	conn, ok := <-l.conns
+	if ok {
+		return conn, nil
+	}
+	select {
+	case <-l.done:
+		return nil, net.ErrClosed
+	default:
+		return nil, fmt.Errorf("reverse tunnel %s: %w", l.addr, l.err)
+	}
+}
+
+// Close ends the registration.
+func (l *reverseListener) Close() error {
+	l.once.Do(func() {
+		close(l.done)
+		l.cancel()
+		l.body.Close()
+	})
+	return nil
+}
+
+// Addr returns the address the server listens on, or the host name of the
+// virtual endpoint, e.g. "demo.h2go".
+func (l *reverseListener) Addr() net.Addr {
+	return l.addr
+}
+
+// Reverse exposes a local service through a server: connections the server
+// accepts on Addr, see Client.Listen, are forwarded to Target.
+type Reverse struct {
+	// Client is the client of the server to register with.
+	Client *Client
+
+	// Addr is the "host:port" the server listens on, or the name of a
+	// virtual endpoint.
+	Addr string
+
+	// Target is the "host:port" of the local service.
+	Target string
+}
+
+// ParseReverse parses a remote port forwarding in the form of ssh -R,
+// "[bind_address:]port:host:hostport", into a Reverse without a client.
+// The bind address defaults to 127.0.0.1 of the server. In place of
+// "[bind_address:]port", a virtual endpoint name can be given, as in
+// "demo:localhost:3000".
+func ParseReverse(spec string) (Reverse, error) {
+	fields, err := splitForward(spec)
+	if err != nil {
+		return Reverse{}, fmt.Errorf("invalid forwarding %q: %w", spec, err)
+	}
+	if _, err := strconv.ParseUint(fields[0], 10, 16); err != nil && len(fields) == 3 {
+		name, host, port := fields[0], fields[1], fields[2]
+		if !validEndpointName(name) {
+			return Reverse{}, fmt.Errorf("invalid forwarding %q: invalid endpoint name %q", spec, name)
+		}
+		if p, err := strconv.ParseUint(port, 10, 16); err != nil || p == 0 || host == "" {
+			return Reverse{}, fmt.Errorf("invalid forwarding %q: invalid target %q", spec, net.JoinHostPort(host, port))
+		}
+		return Reverse{Addr: name, Target: net.JoinHostPort(host, port)}, nil
+	}
+	l, err := ParseForward(spec)
+	if err != nil {
+		return Reverse{}, err
+	}
+	return Reverse{Addr: l.Addr, Target: l.Target}, nil
+}
+
+// Reverse registration retry delays of serveReverse.
+const (
+	minReverseRetry = time.Second
+	maxReverseRetry = time.Minute
+)
+
+// serveReverse keeps r registered with its server and forwards the
+// connections it receives to r.Target until ctx is done.
+func (s *LocalServer) serveReverse(ctx context.Context, r Reverse) {
+	retry := minReverseRetry
+	for {
+		ln, err := r.Client.Listen(r.Addr)
+		if err != nil {
+			s.Logger.Error("reverse tunnel",
+				"addr", r.Addr,
+				"msg", err,
+				"retry", retry)
+			if !sleepContext(ctx, retry) {
+				return
+			}
+			retry = min(2*retry, maxReverseRetry)
+			continue
+		}
+		stop := context.AfterFunc(ctx, func() { ln.Close() })
+		retry = minReverseRetry
+		s.Logger.Info("reverse tunnel registered",
+			"addr", ln.Addr().String(),
+			"target", r.Target)
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				if ctx.Err() == nil {
+					s.Logger.Error("reverse tunnel",
+						"addr", r.Addr,
+						"msg", err)
+				}
+				break
+			}
+			go func() {
+				defer conn.Close()
+				target, err := Direct{}.Connect(r.Target)
+				if err != nil {
+					s.Logger.Error("reverse tunnel",
+						"target", r.Target,
+						"msg", err)
+					return
+				}
+				defer target.Close()
+				s.Logger.Info("reverse",
+					"remote", conn.RemoteAddr().String(),
+					"target", r.Target)
+				s.transport(conn, target)
+			}()
+		}
+		stop()
+		ln.Close()
+		if !sleepContext(ctx, retry) {
+			return
+		}
+	}
+}
+
+// sleepContext waits for d, and reports whether it did before ctx was done.
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
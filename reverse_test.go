@@ -0,0 +1,180 @@
+package h2go
+
+import (
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// startReverseServer starts a proxy server that allows reverse tunnels and
+// returns a client for it.
+func startReverseServer(t *testing.T, opts ...ServerOption) *Client {
+	t.Helper()
+	addr := freeAddr(t)
+	s := NewProxyServer(append([]ServerOption{
+		WithListenAddr(addr),
+		WithServerSecret(testSecret),
+		WithReverseTunnels(true),
+	}, opts...)...)
+	go s.ListenAndServe()
+	waitListening(t, "tcp", addr)
+	return NewClient(
+		WithServerURL("http://"+addr),
+		WithSecret(testSecret),
+	)
+}
+
+// serveEcho echoes the connections ln accepts.
+func serveEcho(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			io.Copy(conn, conn)
+		}()
+	}
+}
+
+func TestClientListen(t *testing.T) {
+	client := startReverseServer(t)
+
+	ln, err := client.Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+	defer ln.Close()
+	go serveEcho(ln)
+
+	for i := 0; i < 3; i++ {
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		checkEcho(t, conn)
+		conn.Close()
+	}
+
+	ln.Close()
+	if _, err := ln.Accept(); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("Accept() after Close error = %v, want net.ErrClosed", err)
+	}
+}
+
+func TestClientListenEndpoint(t *testing.T) {
+	client := startReverseServer(t)
+
+	ln, err := client.Listen("demo")
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+	defer ln.Close()
+	go serveEcho(ln)
+
+	if _, err := client.Listen("demo"); err == nil {
+		t.Error("Listen() registered an endpoint name twice")
+	}
+	if ln.Addr().String() != "demo.h2go" {
+		t.Errorf("Addr() = %s, want demo.h2go", ln.Addr())
+	}
+
+	conn, err := client.Connect("Demo.h2go:80")
+	if err != nil {
+		t.Fatalf("Connect() error = %v", err)
+	}
+	defer conn.Close()
+	checkEcho(t, conn)
+}
+
+func TestClientListenEndpointShadowing(t *testing.T) {
+	echo := startEcho(t)
+	_, port, _ := net.SplitHostPort(echo)
+	victim := startReverseServer(t)
+	attacker := NewClient(WithServerURL(victim.serverURL), WithSecret(testSecret))
+
+	if ln, err := attacker.Listen("localhost"); err == nil {
+		ln.Close()
+		t.Fatal("Listen() registered localhost")
+	}
+	ln, err := attacker.Listen("echo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		if conn, err := ln.Accept(); err == nil {
+			t.Error("endpoint received a connection to a host name")
+			conn.Close()
+		}
+	}()
+
+	for _, addr := range []string{net.JoinHostPort("localhost", port), net.JoinHostPort("echo", port)} {
+		conn, err := victim.Connect(addr)
+		if err != nil {
+			continue // not a host name of the server's network
+		}
+		checkEcho(t, conn)
+		conn.Close()
+	}
+}
+
+func TestClientListenForbidden(t *testing.T) {
+	client := startReverseServer(t, WithReverseTunnels(false))
+	if _, err := client.Listen("127.0.0.1:0"); !errors.Is(err, ErrForbidden) {
+		t.Errorf("Listen() error = %v, want ErrForbidden", err)
+	}
+
+	client = startReverseServer(t, WithACL(ACLFunc(func(req *TunnelRequest) error {
+		if req.Reverse {
+			return errors.New("no reverse tunnels")
+		}
+		return nil
+	})))
+	if _, err := client.Listen("demo"); !errors.Is(err, ErrForbidden) {
+		t.Errorf("Listen() error = %v, want ErrForbidden", err)
+	}
+}
+
+func TestClientListenLimited(t *testing.T) {
+	client := startReverseServer(t, WithMaxTunnelsPerClient(1))
+	ln, err := client.Listen("demo")
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+	if _, err := client.Listen("other"); !errors.Is(err, ErrLimitExceeded) {
+		t.Errorf("Listen() over the tunnel limit error = %v, want ErrLimitExceeded", err)
+	}
+	ln.Close()
+}
+
+func TestParseReverse(t *testing.T) {
+	tests := []struct {
+		spec    string
+		want    Reverse
+		wantErr bool
+	}{
+		{spec: "8080:localhost:3000", want: Reverse{Addr: "127.0.0.1:8080", Target: "localhost:3000"}},
+		{spec: "0.0.0.0:8080:localhost:3000", want: Reverse{Addr: "0.0.0.0:8080", Target: "localhost:3000"}},
+		{spec: "demo:localhost:3000", want: Reverse{Addr: "demo", Target: "localhost:3000"}},
+		{spec: "demo.example.com:localhost:3000", wantErr: true},
+		{spec: "localhost:localhost:3000", wantErr: true},
+		{spec: "demo:localhost", wantErr: true},
+		{spec: "demo::3000", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.spec, func(t *testing.T) {
+			got, err := ParseReverse(tt.spec)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseReverse() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && got != tt.want {
+				t.Errorf("ParseReverse() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,200 @@
+package h2go
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// ErrBlocked is returned by Block, and by a Router without a fallback, for
+// destinations that must not be reached.
+var ErrBlocked = errors.New("destination blocked")
+
+// HostMatcher matches destination hosts against a list of patterns:
+//
+//   - "*" matches every host
+//   - "example.com" matches that host only
+//   - "*.example.com" matches the subdomains of example.com
+//   - ".example.com" matches example.com and its subdomains
+//   - "192.0.2.1" matches that IP address
+//   - "10.0.0.0/8" matches IP addresses in that network
+//
+// Host names are compared case-insensitively.
+type HostMatcher struct {
+	any      bool
+	exact    map[string]bool
+	suffixes []string
+	nets     []*net.IPNet
+}
+
+// NewHostMatcher parses patterns into a HostMatcher.
+func NewHostMatcher(patterns ...string) (*HostMatcher, error) {
+	m := &HostMatcher{exact: make(map[string]bool)}
+	for _, p := range patterns {
+		p = strings.ToLower(strings.TrimSpace(p))
+		switch {
+		case p == "":
+			return nil, errors.New("empty host pattern")
+		case p == "*":
+			m.any = true
+		case strings.Contains(p, "/"):
+			_, ipnet, err := net.ParseCIDR(p)
+			if err != nil {
+				return nil, fmt.Errorf("invalid network %q: %w", p, err)
+			}
+			m.nets = append(m.nets, ipnet)
+		case strings.HasPrefix(p, "*."):
+			m.suffixes = append(m.suffixes, p[1:])
+		case strings.HasPrefix(p, "."):
+			m.exact[p[1:]] = true
+			m.suffixes = append(m.suffixes, p)
+		case strings.Contains(p, "*"):
+			return nil, fmt.Errorf("invalid host pattern %q: wildcards are only allowed as a leading \"*.\"", p)
+		default:
+			if ip := net.ParseIP(p); ip != nil {
+				p = ip.String()
+			}
+			m.exact[strings.TrimSuffix(p, ".")] = true
+		}
+	}
+	return m, nil
+}
+
+// Match reports whether host matches any of the patterns.
+func (m *HostMatcher) Match(host string) bool {
+	if m.any {
+		return true
+	}
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	if ip := net.ParseIP(host); ip != nil {
+		for _, n := range m.nets {
+			if n.Contains(ip) {
+				return true
+			}
+		}
+		return m.exact[ip.String()]
+	}
+	if m.exact[host] {
+		return true
+	}
+	for _, suffix := range m.suffixes {
+		if strings.HasSuffix(host, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Route sends connections to destinations matching Hosts through Handler.
+type Route struct {
+	Hosts   *HostMatcher
+	Handler ProxyHandler
+}
+
+// Router is a ProxyHandler that picks the handler for each connection by
+// matching the destination host against its routes in order. Destinations
+// no route matches go to the fallback handler.
+type Router struct {
+	routes   []Route
+	fallback ProxyHandler
+}
+
+// Ensure Router implements the ProxyHandler and ContextConnector interfaces.
+var (
+	_ ProxyHandler     = (*Router)(nil)
+	_ ContextConnector = (*Router)(nil)
+)
+
+// NewRouter creates a router with the given routes. A nil fallback blocks
+// destinations no route matches.
+//
+// Example:
+//
+//	internal, _ := h2go.NewHostMatcher(".corp.example.com", "10.0.0.0/8")
+//	router := h2go.NewRouter(client,
+//	    h2go.Route{Hosts: internal, Handler: h2go.Direct{}},
+//	)
+func NewRouter(fallback ProxyHandler, routes ...Route) *Router {
+	if fallback == nil {
+		fallback = Block{}
+	}
+	return &Router{routes: routes, fallback: fallback}
+}
+
+// Handler returns the handler connections to host are sent to.
+func (r *Router) Handler(host string) ProxyHandler {
+	for _, route := range r.routes {
+		if route.Hosts.Match(host) {
+			return route.Handler
+		}
+	}
+	return r.fallback
+}
+
+// Connect connects to addr through the handler of the first matching route.
+func (r *Router) Connect(addr string) (io.ReadWriteCloser, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid address %q: %w", addr, err)
+	}
+	return r.Handler(host).Connect(addr)
+}
+
+// ConnectContext connects to req.Addr through the handler of the first
+// matching route, passing the metadata on.
+func (r *Router) ConnectContext(ctx context.Context, req *ConnectRequest) (io.ReadWriteCloser, error) {
+	host, _, err := net.SplitHostPort(req.Addr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid address %q: %w", req.Addr, err)
+	}
+	return ConnectVia(ctx, r.Handler(host), req)
+}
+
+// Clean calls Clean on the handlers of all routes and the fallback.
+func (r *Router) Clean() {
+	for _, route := range r.routes {
+		route.Handler.Clean()
+	}
+	r.fallback.Clean()
+}
+
+// Direct is a ProxyHandler that connects to destinations directly, without
+// going through a proxy server.
+type Direct struct {
+	// Timeout is the dial timeout. Zero means 10 seconds.
+	Timeout time.Duration
+}
+
+// Connect dials addr over TCP.
+func (d Direct) Connect(addr string) (io.ReadWriteCloser, error) {
+	return d.ConnectContext(context.Background(), &ConnectRequest{Addr: addr})
+}
+
+// ConnectContext dials req.Addr over TCP, with ctx bounding the dial
+// together with the timeout.
+func (d Direct) ConnectContext(ctx context.Context, req *ConnectRequest) (io.ReadWriteCloser, error) {
+	timeout := d.Timeout
+	if timeout == 0 {
+		timeout = defaultTimeout
+	}
+	dialer := net.Dialer{Timeout: timeout}
+	return dialer.DialContext(ctx, "tcp", req.Addr)
+}
+
+// Clean is a no-op.
+func (d Direct) Clean() {}
+
+// Block is a ProxyHandler that refuses every connection with ErrBlocked.
+type Block struct{}
+
+// Connect returns ErrBlocked.
+func (Block) Connect(addr string) (io.ReadWriteCloser, error) {
+	return nil, fmt.Errorf("%w: %s", ErrBlocked, addr)
+}
+
+// Clean is a no-op.
+func (Block) Clean() {}
@@ -0,0 +1,84 @@
+package h2go
+
+import (
+	"errors"
+	"io"
+	"testing"
+)
+
+func TestHostMatcher(t *testing.T) {
+	m, err := NewHostMatcher("example.com", "*.corp.example", ".internal.example", "10.0.0.0/8", "2001:DB8::1")
+	if err != nil {
+		t.Fatalf("NewHostMatcher() error = %v", err)
+	}
+	tests := []struct {
+		host string
+		want bool
+	}{
+		{"example.com", true},
+		{"EXAMPLE.com.", true},
+		{"www.example.com", false},
+		{"a.corp.example", true},
+		{"corp.example", false},
+		{"internal.example", true},
+		{"a.b.internal.example", true},
+		{"10.1.2.3", true},
+		{"11.1.2.3", false},
+		{"2001:db8::1", true},
+	}
+	for _, tt := range tests {
+		if got := m.Match(tt.host); got != tt.want {
+			t.Errorf("Match(%q) = %v, want %v", tt.host, got, tt.want)
+		}
+	}
+
+	for _, p := range []string{"", "a*.example.com", "10.0.0.0/33"} {
+		if _, err := NewHostMatcher(p); err == nil {
+			t.Errorf("NewHostMatcher(%q) error = nil, want an error", p)
+		}
+	}
+}
+
+// namedHandler is a ProxyHandler that records the addresses it was asked to
+// connect to.
+type namedHandler struct {
+	addrs []string
+}
+
+func (h *namedHandler) Connect(addr string) (io.ReadWriteCloser, error) {
+	h.addrs = append(h.addrs, addr)
+	return nil, nil
+}
+
+func (h *namedHandler) Clean() {}
+
+func TestRouter(t *testing.T) {
+	internal, err := NewHostMatcher(".internal.example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	blocked, err := NewHostMatcher("blocked.example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fallback, direct := &namedHandler{}, &namedHandler{}
+	r := NewRouter(fallback,
+		Route{Hosts: internal, Handler: direct},
+		Route{Hosts: blocked, Handler: Block{}},
+	)
+
+	r.Connect("db.internal.example:5432")
+	r.Connect("example.com:443")
+	if len(direct.addrs) != 1 || direct.addrs[0] != "db.internal.example:5432" {
+		t.Errorf("direct route got %v", direct.addrs)
+	}
+	if len(fallback.addrs) != 1 || fallback.addrs[0] != "example.com:443" {
+		t.Errorf("fallback got %v", fallback.addrs)
+	}
+	if _, err := r.Connect("blocked.example:80"); !errors.Is(err, ErrBlocked) {
+		t.Errorf("Connect() error = %v, want %v", err, ErrBlocked)
+	}
+	if _, err := NewRouter(nil).Connect("example.com:80"); !errors.Is(err, ErrBlocked) {
+		t.Errorf("Connect() without fallback error = %v, want %v", err, ErrBlocked)
+	}
+}
@@ -2,18 +2,29 @@ package h2go
 
 import (
 	"bufio"
+	"bytes"
 	"context"
+	"crypto/subtle"
+	"crypto/tls"
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"io"
+	"io/fs"
 	"log/slog"
 	"net"
 	"net/http"
-	"net/http/httputil"
+	"os"
 	"strconv"
-	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/net/http2"
 )
 
+// tlsHandshakeTimeout bounds the TLS handshake of local connections.
+const tlsHandshakeTimeout = 10 * time.Second
+
 // SOCKS5 address types.
 const (
 	typeIPv4 = 1 // type is ipv4 address
@@ -30,6 +41,8 @@ var (
 	ErrAddrType             = errors.New("socks addr type not supported")
 	ErrVersion              = errors.New("socks version not supported")
 	ErrReqExtraData         = errors.New("socks request get extra data")
+	ErrSocksAuth            = errors.New("socks authentication failed")
+	ErrProxyAuth            = errors.New("http proxy authentication failed")
 )
 
 // Legacy error variables for backward compatibility.
@@ -59,13 +72,92 @@ func (r *reqReader) Read(p []byte) (n int, err error) {
 	return
 }
 
+// Protocols a Listener serves.
+const (
+	ProtocolAuto   = "auto"
+	ProtocolSOCKS5 = "socks5"
+	ProtocolHTTP   = "http"
+
+	// ProtocolRedirect serves connections sent to the listener by an
+	// iptables REDIRECT rule, on Linux only.
+	ProtocolRedirect = "redirect"
+
+	// ProtocolTProxy serves connections sent to the listener by an
+	// iptables TPROXY rule, on Linux only. Listening needs CAP_NET_ADMIN.
+	ProtocolTProxy = "tproxy"
+
+	// ProtocolForward connects every connection to the listener's Target.
+	ProtocolForward = "forward"
+)
+
+// Listener is an address a LocalServer accepts connections on, with its own
+// protocol, handler and authentication.
+type Listener struct {
+	// Network is "tcp" or "unix". Empty means "tcp".
+	Network string
+
+	// Addr is the address to listen on, or the socket path for "unix".
+	Addr string
+
+	// Protocol is ProtocolSOCKS5, ProtocolHTTP, ProtocolAuto which detects
+	// the protocol from the first byte, one of the transparent protocols
+	// ProtocolRedirect and ProtocolTProxy, or ProtocolForward. Empty means
+	// ProtocolAuto.
+	Protocol string
+
+	// Target is the "host:port" a ProtocolForward listener connects to.
+	Target string
+
+	// Sniff makes transparent listeners connect to the host name found in
+	// the TLS server name or HTTP Host header the client sends first,
+	// instead of the original IP address, so that routes match by name.
+	Sniff bool
+
+	// Handler handles the listener's connections. If nil, the server's
+	// Socks5Handler or HTTPHandler is used; transparent and forwarding
+	// listeners use the Socks5Handler.
+	Handler ProxyHandler
+
+	// Users maps user names to the passwords clients must authenticate
+	// with: SOCKS5 clients with RFC 1929 username/password authentication,
+	// HTTP clients with a Basic Proxy-Authorization header. If empty, no
+	// authentication is required.
+	Users map[string]string
+
+	// TLS makes the listener accept TLS connections with this
+	// configuration, so that clients can use https:// proxy URLs. Unless
+	// NextProtos is set, SOCKS5 listeners offer no ALPN protocols and the
+	// others h2 and http/1.1; a client that negotiates h2 is served as
+	// HTTP/2. Transparent and forwarding listeners do not use TLS.
+	TLS *tls.Config
+
+	bound net.Addr // the address listened on, set by ListenAndServe
+}
+
 // LocalServer is a local SOCKS5/HTTP proxy server that forwards connections
 // through a remote proxy server. It accepts connections from local applications
 // and forwards them to the configured proxy handlers.
 type LocalServer struct {
-	// Addr is the local address to listen on.
+	// Addr is the local address to listen on. It detects the protocol of
+	// each connection from its first byte.
 	Addr string
 
+	// Users maps user names to the passwords clients connecting to Addr
+	// must authenticate with, as for Listener.Users. If empty, no
+	// authentication is required.
+	Users map[string]string
+
+	// TLS makes Addr accept TLS connections, as for Listener.TLS.
+	TLS *tls.Config
+
+	// Listeners are further addresses to listen on, each with its own
+	// protocol, handler and authentication. Addr is not listened on if it
+	// is empty and there are listeners or reverse tunnels.
+	Listeners []Listener
+
+	// Reverses are local services exposed through servers.
+	Reverses []Reverse
+
 	// Socks5Handler handles SOCKS5 proxy requests.
 	Socks5Handler ProxyHandler
 
@@ -81,6 +173,10 @@ type LocalServer struct {
 	// DisableHTTPCONNECT disables HTTP CONNECT method support.
 	DisableHTTPCONNECT bool
 
+	// Middleware wraps the handlers of all connections, the first being
+	// the outermost. See Chain.
+	Middleware []Middleware
+
 	// Logger is the logger for the server.
 	Logger *slog.Logger
 }
@@ -111,102 +207,216 @@ func NewLocalServer(opts ...LocalServerOption) *LocalServer {
 	return s
 }
 
-func (s *LocalServer) handleConn(conn net.Conn) (err error) {
+// handlerFor returns the handler of connections accepted on l, or def if l
+// has none, wrapped in the server's middleware. It returns nil if there is
+// no handler.
+func (s *LocalServer) handlerFor(l *Listener, def ProxyHandler) ProxyHandler {
+	handler := l.Handler
+	if handler == nil {
+		handler = def
+	}
+	if handler == nil {
+		return nil
+	}
+	return Chain(handler, s.Middleware...)
+}
 
+// serveConn serves a connection accepted on l, detecting the protocol from
+// the first byte unless l serves a single protocol.
+func (s *LocalServer) serveConn(conn net.Conn, l *Listener) (err error) {
 	defer conn.Close()
-	var (
-		conn2 io.ReadWriteCloser
-		n     int
-	)
 
+	if tc, ok := conn.(*tls.Conn); ok {
+		tc.SetDeadline(time.Now().Add(tlsHandshakeTimeout))
+		if err := tc.Handshake(); err != nil {
+			return err
+		}
+		tc.SetDeadline(time.Time{})
+		if tc.ConnectionState().NegotiatedProtocol == http2.NextProtoTLS {
+			handler := s.handlerFor(l, s.HTTPHandler)
+			if s.DisableHTTP || (handler == nil) {
+				return ErrNotSupportedProtocol
+			}
+			defer handler.Clean()
+			return s.serveHTTP2(conn, l, handler, false)
+		}
+	}
+
+	switch l.Protocol {
+	case ProtocolHTTP:
+		return s.handleHTTP(conn, nil, l)
+	case ProtocolRedirect, ProtocolTProxy:
+		return s.handleTransparent(conn, l)
+	case ProtocolForward:
+		return s.handleForward(conn, l)
+	}
 	buf := make([]byte, 258)
-	n, err = io.ReadAtLeast(conn, buf, 2)
+	n, err := io.ReadAtLeast(conn, buf, 2)
 	if err != nil {
 		return err
 	}
 	if buf[0] == 0x05 {
-		if s.DisableSocks5 || (s.Socks5Handler == nil) {
-			return ErrNotSupportedProtocol
-		}
-		nmethod := int(buf[1])
-		msgLen := nmethod + 2
-		if n == msgLen {
-			// common case
-		} else if n < msgLen {
-			if _, err = io.ReadFull(conn, buf[n:msgLen]); err != nil {
-				return
-			}
-		} else {
-			return ErrAuthExtraData
-		}
-		// send confirmation: version 5, no authentication required
-		if _, err = conn.Write([]byte{0x05, 0x00}); err != nil {
-			return
-		}
+		return s.handleSocks5(conn, buf, n, l)
+	}
+	if l.Protocol == ProtocolSOCKS5 {
+		return ErrVersion
+	}
+	return s.handleHTTP(conn, buf[:n], l)
+}
 
-		buf := make([]byte, 263)
-		if n, err = io.ReadAtLeast(conn, buf, 5); err != nil {
+// handleSocks5 serves a SOCKS5 connection whose first n bytes were read
+// into buf.
+func (s *LocalServer) handleSocks5(conn net.Conn, buf []byte, n int, l *Listener) (err error) {
+	handler := s.handlerFor(l, s.Socks5Handler)
+	if s.DisableSocks5 || (handler == nil) {
+		return ErrNotSupportedProtocol
+	}
+	var user string
+	nmethod := int(buf[1])
+	msgLen := nmethod + 2
+	if n == msgLen {
+		// common case
+	} else if n < msgLen {
+		if _, err = io.ReadFull(conn, buf[n:msgLen]); err != nil {
 			return
 		}
-		if buf[0] != 0x05 {
-			return ErrVersion
-		}
-		if buf[1] != 0x01 {
-			return ErrCommand
-		}
-		reqLen := -1
-		var (
-			addr string
-			host string
-		)
-		switch buf[3] {
-		case typeIPv4:
-			reqLen = net.IPv4len + 6
-		case typeIPv6:
-			reqLen = net.IPv6len + 6
-		case typeDm:
-			reqLen = int(buf[4]) + 7
-		default:
-			return ErrAddrType
+	} else {
+		return ErrAuthExtraData
+	}
+	if len(l.Users) > 0 {
+		// RFC 1929 username/password authentication
+		if !bytes.Contains(buf[2:msgLen], []byte{0x02}) {
+			conn.Write([]byte{0x05, 0xff})
+			return fmt.Errorf("%w: client does not offer username/password", ErrSocksAuth)
 		}
-		if n == reqLen {
-			// common case, do nothing
-		} else if n < reqLen { // rare case
-			if _, err = io.ReadFull(conn, buf[n:reqLen]); err != nil {
-				return
-			}
-		} else {
-			return ErrReqExtraData
+		if _, err = conn.Write([]byte{0x05, 0x02}); err != nil {
+			return
 		}
-		switch buf[3] {
-		case typeIPv4:
-			host = net.IP(buf[4 : 4+net.IPv4len]).String()
-		case typeIPv6:
-			host = net.IP(buf[4 : 4+net.IPv6len]).String()
-		case typeDm:
-			host = string(buf[5 : 5+buf[4]])
+		if user, err = s.socks5Authenticate(conn, l.Users); err != nil {
+			return
 		}
-		port := binary.BigEndian.Uint16(buf[reqLen-2 : reqLen])
-		addr = net.JoinHostPort(host, strconv.Itoa(int(port)))
-		s.Logger.Info("socks5",
-			"addr", addr)
-		conn2, err = s.Socks5Handler.Connect(addr)
-		if err != nil {
+	} else {
+		// send confirmation: version 5, no authentication required
+		if _, err = conn.Write([]byte{0x05, 0x00}); err != nil {
 			return
 		}
-		conn.Write([]byte{0x05, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x08, 0x43})
-		s.Logger.Info("socks5",
-			"local", conn.RemoteAddr().String(),
-			"remote", addr)
+	}
 
-		defer s.Socks5Handler.Clean()
-	} else {
-		if s.DisableHTTP || (s.HTTPHandler == nil) {
-			return ErrNotSupportedProtocol
+	buf = make([]byte, 263)
+	if n, err = io.ReadAtLeast(conn, buf, 5); err != nil {
+		return
+	}
+	if buf[0] != 0x05 {
+		return ErrVersion
+	}
+	if buf[1] != 0x01 {
+		return ErrCommand
+	}
+	reqLen := -1
+	var (
+		addr string
+		host string
+	)
+	switch buf[3] {
+	case typeIPv4:
+		reqLen = net.IPv4len + 6
+	case typeIPv6:
+		reqLen = net.IPv6len + 6
+	case typeDm:
+		reqLen = int(buf[4]) + 7
+	default:
+		return ErrAddrType
+	}
+	if n == reqLen {
+		// common case, do nothing
+	} else if n < reqLen { // rare case
+		if _, err = io.ReadFull(conn, buf[n:reqLen]); err != nil {
+			return
 		}
+	} else {
+		return ErrReqExtraData
+	}
+	switch buf[3] {
+	case typeIPv4:
+		host = net.IP(buf[4 : 4+net.IPv4len]).String()
+	case typeIPv6:
+		host = net.IP(buf[4 : 4+net.IPv6len]).String()
+	case typeDm:
+		host = string(buf[5 : 5+buf[4]])
+	}
+	port := binary.BigEndian.Uint16(buf[reqLen-2 : reqLen])
+	addr = net.JoinHostPort(host, strconv.Itoa(int(port)))
+	s.Logger.Info("socks5",
+		"addr", addr)
+	conn2, err := s.connect(handler, conn, &ConnectRequest{Addr: addr, Protocol: ProtocolSOCKS5, User: user})
+	if err != nil {
+		return
+	}
+	defer handler.Clean()
+	defer conn2.Close()
+	conn.Write([]byte{0x05, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x08, 0x43})
+	s.Logger.Info("socks5",
+		"local", conn.RemoteAddr().String(),
+		"remote", addr)
 
-		req, err := http.ReadRequest(bufio.NewReader(&reqReader{b: buf[:n], r: conn}))
+	return s.transport(conn, conn2)
+}
+
+// socks5Authenticate runs the username/password subnegotiation of RFC 1929,
+// accepting the credentials in users, and returns the user name.
+func (s *LocalServer) socks5Authenticate(conn net.Conn, users map[string]string) (user string, err error) {
+	// VER ULEN UNAME PLEN PASSWD
+	buf := make([]byte, 513)
+	if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+		return "", err
+	}
+	if buf[0] != 0x01 {
+		return "", fmt.Errorf("%w: unsupported subnegotiation version %d", ErrSocksAuth, buf[0])
+	}
+	ulen := int(buf[1])
+	if _, err := io.ReadFull(conn, buf[:ulen+1]); err != nil {
+		return "", err
+	}
+	user = string(buf[:ulen])
+	plen := int(buf[ulen])
+	if _, err := io.ReadFull(conn, buf[:plen]); err != nil {
+		return "", err
+	}
+	if !checkPassword(users, user, string(buf[:plen])) {
+		conn.Write([]byte{0x01, 0x01})
+		return "", fmt.Errorf("%w: invalid credentials for user %q", ErrSocksAuth, user)
+	}
+	_, err = conn.Write([]byte{0x01, 0x00})
+	return user, err
+}
+
+// checkPassword reports whether password is the password of user in users.
+func checkPassword(users map[string]string, user, password string) bool {
+	want, ok := users[user]
+	return ok && subtle.ConstantTimeCompare([]byte(want), []byte(password)) == 1
+}
+
+// handleHTTP serves an HTTP proxy connection. prefix holds bytes already
+// read from conn. Plain requests are forwarded one by one, so that each
+// can go to another host, until the connection ends or turns into a tunnel
+// with CONNECT. A connection that starts with the HTTP/2 connection preface
+// is served as HTTP/2 instead. If l has users, every request must
+// authenticate with a Basic Proxy-Authorization header.
+func (s *LocalServer) handleHTTP(conn net.Conn, prefix []byte, l *Listener) error {
+	handler := s.handlerFor(l, s.HTTPHandler)
+	if s.DisableHTTP || (handler == nil) {
+		return ErrNotSupportedProtocol
+	}
+	defer handler.Clean()
+
+	br := bufio.NewReader(&reqReader{b: prefix, r: conn})
+	var forwarder *httpForwarder
+	for first := true; ; first = false {
+		req, err := http.ReadRequest(br)
 		if err != nil {
+			if !first && err == io.EOF {
+				return nil
+			}
 			return err
 		}
 		s.Logger.Info("http",
@@ -221,86 +431,233 @@ func (s *LocalServer) handleConn(conn net.Conn) (err error) {
 		}
 
 		if s.Logger.Enabled(context.Background(), slog.LevelDebug) {
-			dump, _ := httputil.DumpRequest(req, false)
-			s.Logger.Debug("http", "dump", string(dump))
+			s.Logger.Debug("http", "dump", dumpRequest(req))
 		}
 
 		if req.Method == "PRI" && req.ProtoMajor == 2 {
-			conn.Write([]byte("HTTP/1.1 400 Bad Request\r\n\r\n"))
-			return ErrNotSupportedNow
-		}
-		addr := req.Host
-		if !strings.Contains(addr, ":") {
-			addr += ":80"
+			if !first {
+				conn.Write([]byte("HTTP/1.1 400 Bad Request\r\n\r\n"))
+				return ErrNotSupportedNow
+			}
+			// the rest of the HTTP/2 connection preface follows the
+			// request line
+			rest := make([]byte, len(h2PrefaceRest))
+			if _, err := io.ReadFull(br, rest); err != nil {
+				return err
+			}
+			if string(rest) != h2PrefaceRest {
+				return fmt.Errorf("bad HTTP/2 connection preface %q", rest)
+			}
+			return s.serveHTTP2(&readerConn{Conn: conn, r: br}, l, handler, true)
 		}
-		conn2, err = s.HTTPHandler.Connect(addr)
-		if err != nil {
-			return err
+
+		user, ok := proxyUser(req, l.Users)
+		if !ok {
+			keepAlive, err := requireProxyAuth(conn, req)
+			if err != nil || !keepAlive {
+				return err
+			}
+			continue
 		}
+
 		if req.Method == "CONNECT" {
-			conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
-		} else {
-			// bug here
-			req.Header.Del("Proxy-Connection")
-			req.Header.Set("Connection", "Keep-Alive")
-			req.Write(conn2)
+			return s.handleHTTPConnect(conn, br, req, handler, user)
+		}
+
+		if forwarder == nil {
+			forwarder = s.newHTTPForwarder(conn, handler)
+			defer forwarder.close()
+		}
+		keepAlive, err := forwarder.serve(br, req, user)
+		if err != nil || !keepAlive {
+			return err
 		}
-		s.Logger.Info("http",
-			"local", conn.RemoteAddr().String(),
-			"remote", addr)
-		defer s.HTTPHandler.Clean()
+	}
+}
+
+// handleHTTPConnect serves a CONNECT request read from br for user,
+// tunneling the rest of the connection to the requested host.
+func (s *LocalServer) handleHTTPConnect(conn net.Conn, br *bufio.Reader, req *http.Request, handler ProxyHandler, user string) error {
+	addr := req.Host
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, "443")
+	}
+	conn2, err := s.connect(handler, conn, &ConnectRequest{
+		Addr:     addr,
+		Protocol: ProtocolHTTP,
+		Method:   req.Method,
+		User:     user,
+		Header:   req.Header,
+	})
+	if err != nil {
+		conn.Write([]byte("HTTP/1.1 502 Bad Gateway\r\n\r\n"))
+		return err
 	}
 	defer conn2.Close()
-	return s.transport(conn, conn2)
+	conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+	s.Logger.Info("http",
+		"local", conn.RemoteAddr().String(),
+		"remote", addr)
+	// the client may have sent data after the request, e.g. a TLS ClientHello
+	return s.transport(&readerConn{Conn: conn, r: br}, conn2)
+}
+
+// connect connects to req.Addr through handler for the local connection
+// conn, passing the metadata of the connection on to handlers that accept
+// it.
+func (s *LocalServer) connect(handler ProxyHandler, conn net.Conn, req *ConnectRequest) (io.ReadWriteCloser, error) {
+	req.ClientAddr = conn.RemoteAddr().String()
+	return ConnectVia(context.Background(), handler, req)
 }
 
+// transport copies data between conn1 and conn2 until either direction
+// fails or both end. When one side is done sending, the end of data is
+// passed on with CloseWrite if the other side supports it, and the copy in
+// the other direction goes on.
 func (s *LocalServer) transport(conn1 io.ReadWriter, conn2 io.ReadWriter) (err error) {
-	errChan := make(chan error, 2)
+	type result struct {
+		err        error
+		halfClosed bool
+	}
+	results := make(chan result, 2)
 
-	go func() {
-		_, err := io.Copy(conn1, conn2)
+	pipe := func(dst, src io.ReadWriter) {
+		_, err := io.Copy(dst, src)
 		if err != nil {
 			s.Logger.Error("copy", "msg", err)
+			results <- result{err: err}
+			return
 		}
-		errChan <- err
-	}()
-
-	go func() {
-		_, err := io.Copy(conn2, conn1)
-		if err != nil {
-			s.Logger.Error("copy", "msg", err)
+		// pass the end of data on and keep the other direction open
+		if cw, ok := dst.(interface{ CloseWrite() error }); ok && cw.CloseWrite() == nil {
+			results <- result{halfClosed: true}
+			return
 		}
-		errChan <- err
-	}()
-	err = <-errChan
-	return
+		results <- result{}
+	}
+	go pipe(conn1, conn2)
+	go pipe(conn2, conn1)
+
+	r := <-results
+	if r.halfClosed {
+		r = <-results
+	}
+	return r.err
 }
 
-// ListenAndServe starts the local proxy server.
-// It accepts both SOCKS5 and HTTP proxy connections.
+// ListenAndServe starts the local proxy server on Addr and all Listeners,
+// and registers the reverse tunnels. It returns when any of the listeners
+// fails, ending the reverse tunnels; reverse tunnels are registered again
+// when they fail.
 func (s *LocalServer) ListenAndServe() error {
-	l, err := net.Listen("tcp", s.Addr)
-	if err != nil {
-		return err
-	}
 	if s.Logger == nil {
 		s.Logger = DefaultLogger()
 	}
-	s.Logger.Info("socks5/http proxy started",
-		"addr", l.Addr().(*net.TCPAddr).String())
+	var listeners []Listener
+	if s.Addr != "" || (len(s.Listeners) == 0 && len(s.Reverses) == 0) {
+		listeners = append(listeners, Listener{Addr: s.Addr, Users: s.Users, TLS: s.TLS})
+	}
+	listeners = append(listeners, s.Listeners...)
+
+	opened := make([]net.Listener, 0, len(listeners))
+	for _, l := range listeners {
+		ln, err := listen(l)
+		if err != nil {
+			for _, o := range opened {
+				o.Close()
+			}
+			return err
+		}
+		opened = append(opened, ln)
+		listeners[len(opened)-1].bound = ln.Addr()
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	for _, r := range s.Reverses {
+		go s.serveReverse(ctx, r)
+	}
+	errc := make(chan error, len(opened))
+	for i, ln := range opened {
+		go func() {
+			errc <- s.serve(ln, &listeners[i])
+		}()
+	}
+	err := <-errc
+	for _, ln := range opened {
+		ln.Close()
+	}
+	return err
+}
+
+// listen opens the network listener of l. Stale Unix sockets left behind by
+// a previous run are removed first.
+func listen(l Listener) (net.Listener, error) {
+	network := l.Network
+	if network == "" {
+		network = "tcp"
+	}
+	var lc net.ListenConfig
+	switch {
+	case network == "unix":
+		if err := removeStaleSocket(l.Addr); err != nil {
+			return nil, err
+		}
+	case l.Protocol == ProtocolTProxy:
+		lc.Control = transparentControl
+	}
+	ln, err := lc.Listen(context.Background(), network, l.Addr)
+	if err != nil || l.TLS == nil {
+		return ln, err
+	}
+	config := l.TLS.Clone()
+	if len(config.NextProtos) == 0 && l.Protocol != ProtocolSOCKS5 {
+		config.NextProtos = []string{http2.NextProtoTLS, "http/1.1"}
+	}
+	return tls.NewListener(ln, config), nil
+}
+
+// removeStaleSocket removes the Unix socket at path if nothing listens on it
+// anymore. A socket still in use is reported as an address in use rather
+// than taken over.
+func removeStaleSocket(path string) error {
+	if fi, err := os.Stat(path); err != nil || fi.Mode().Type() != fs.ModeSocket {
+		return nil
+	}
+	conn, err := net.DialTimeout("unix", path, time.Second)
+	if err == nil {
+		conn.Close()
+		return fmt.Errorf("listen unix %s: %w", path, syscall.EADDRINUSE)
+	}
+	if errors.Is(err, syscall.ECONNREFUSED) {
+		return os.Remove(path)
+	}
+	return err
+}
+
+// serve accepts connections on ln until it is closed.
+func (s *LocalServer) serve(ln net.Listener, l *Listener) error {
+	protocol := l.Protocol
+	if protocol == "" {
+		protocol = ProtocolAuto
+	}
+	s.Logger.Info("local proxy started",
+		"addr", ln.Addr().String(),
+		"protocol", protocol)
 	for {
-		if conn, err := l.Accept(); err == nil {
+		if conn, err := ln.Accept(); err == nil {
 			go func() {
-				if err := s.handleConn(conn); err != nil {
+				if err := s.serveConn(conn, l); err != nil {
 					s.Logger.Error("handle conn",
 						"from", conn.RemoteAddr().String(),
 						"msg", err)
 				}
 			}()
+		} else if errors.Is(err, net.ErrClosed) {
+			return err
 		} else {
 			s.Logger.Error("accept", "msg", err)
 		}
-
 	}
 }
 
@@ -0,0 +1,188 @@
+package h2go
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+// startEcho starts a TCP server that echoes what it reads and returns its
+// address.
+func startEcho(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// freeAddr returns a TCP address nothing listens on.
+func freeAddr(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().String()
+}
+
+// waitListening waits until addr accepts connections.
+func waitListening(t *testing.T, network, addr string) {
+	t.Helper()
+	for i := 0; i < 100; i++ {
+		if conn, err := net.Dial(network, addr); err == nil {
+			conn.Close()
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("%s %s is not listening", network, addr)
+}
+
+// checkEcho writes through conn and expects the echo back.
+func checkEcho(t *testing.T, conn io.ReadWriter) {
+	t.Helper()
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("read = %q, %v, want ping", buf, err)
+	}
+}
+
+func TestLocalServerUnixSocketInUse(t *testing.T) {
+	sock := filepath.Join(t.TempDir(), "h2go.sock")
+	other, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+
+	s := NewLocalServer(
+		WithHTTPHandler(Direct{}),
+		WithListener(Listener{Network: "unix", Addr: sock, Protocol: ProtocolHTTP}),
+	)
+	if err := s.ListenAndServe(); !errors.Is(err, syscall.EADDRINUSE) {
+		t.Errorf("ListenAndServe() error = %v, want address in use", err)
+	}
+	if conn, err := net.Dial("unix", sock); err != nil {
+		t.Errorf("socket in use was taken over: %v", err)
+	} else {
+		conn.Close()
+	}
+
+	// a socket nobody listens on anymore is replaced
+	other.(*net.UnixListener).SetUnlinkOnClose(false)
+	other.Close()
+	go s.ListenAndServe()
+	waitListening(t, "unix", sock)
+}
+
+func TestLocalServerListeners(t *testing.T) {
+	echo := startEcho(t)
+	socksAddr := freeAddr(t)
+	sock := filepath.Join(t.TempDir(), "h2go.sock")
+
+	s := NewLocalServer(
+		WithSocks5Handler(Direct{}),
+		WithHTTPHandler(Direct{}),
+		WithListener(Listener{Addr: socksAddr, Protocol: ProtocolSOCKS5, Users: map[string]string{"alice": "secret"}}),
+		WithListener(Listener{Network: "unix", Addr: sock, Protocol: ProtocolHTTP}),
+	)
+	go s.ListenAndServe()
+	waitListening(t, "tcp", socksAddr)
+	waitListening(t, "unix", sock)
+
+	t.Run("socks5 auth", func(t *testing.T) {
+		dialer, err := proxy.SOCKS5("tcp", socksAddr, &proxy.Auth{User: "alice", Password: "secret"}, proxy.Direct)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn, err := dialer.Dial("tcp", echo)
+		if err != nil {
+			t.Fatalf("Dial() error = %v", err)
+		}
+		defer conn.Close()
+		checkEcho(t, conn)
+	})
+
+	t.Run("socks5 wrong password", func(t *testing.T) {
+		dialer, err := proxy.SOCKS5("tcp", socksAddr, &proxy.Auth{User: "alice", Password: "wrong"}, proxy.Direct)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if conn, err := dialer.Dial("tcp", echo); err == nil {
+			conn.Close()
+			t.Fatal("Dial() succeeded with a wrong password")
+		}
+	})
+
+	t.Run("socks5 without auth", func(t *testing.T) {
+		dialer, err := proxy.SOCKS5("tcp", socksAddr, nil, proxy.Direct)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if conn, err := dialer.Dial("tcp", echo); err == nil {
+			conn.Close()
+			t.Fatal("Dial() succeeded without credentials")
+		}
+	})
+
+	t.Run("http over unix socket", func(t *testing.T) {
+		conn, err := net.Dial("unix", sock)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conn.Write([]byte("CONNECT " + echo + " HTTP/1.1\r\nHost: " + echo + "\r\n\r\n"))
+		br := bufio.NewReader(conn)
+		resp, err := http.ReadResponse(br, nil)
+		if err != nil || resp.StatusCode != http.StatusOK {
+			t.Fatalf("CONNECT response = %v, %v", resp, err)
+		}
+		if _, err := conn.Write([]byte("ping")); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, 4)
+		if _, err := io.ReadFull(br, buf); err != nil || string(buf) != "ping" {
+			t.Fatalf("read = %q, %v, want ping", buf, err)
+		}
+	})
+
+	t.Run("http on socks5 listener", func(t *testing.T) {
+		conn, err := net.Dial("tcp", socksAddr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conn.Write([]byte("CONNECT " + echo + " HTTP/1.1\r\nHost: " + echo + "\r\n\r\n"))
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if n, err := conn.Read(make([]byte, 1)); err != io.EOF {
+			t.Fatalf("Read() = %d, %v, want the connection closed", n, err)
+		}
+	})
+}
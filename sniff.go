@@ -0,0 +1,110 @@
+package h2go
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"net/http"
+	"strings"
+
+	"golang.org/x/crypto/cryptobyte"
+)
+
+// maxSniffLen is the most bytes buffered while looking for a host name.
+const maxSniffLen = 16 << 10
+
+// sniffHost looks for the destination host name in the first bytes the
+// client sends: the server name of a TLS ClientHello or the Host header of
+// an HTTP request. It returns "" if none is found before r fails, e.g.
+// because of a read deadline. The bytes stay buffered in r.
+func sniffHost(r *bufio.Reader) string {
+	first, err := r.Peek(1)
+	if err != nil {
+		return ""
+	}
+	if first[0] == 0x16 {
+		// TLS handshake record: type(1) version(2) length(2)
+		hdr, err := r.Peek(5)
+		if err != nil {
+			return ""
+		}
+		n := int(hdr[3])<<8 | int(hdr[4])
+		record, err := r.Peek(min(5+n, r.Size()))
+		if err != nil {
+			return ""
+		}
+		return serverName(record[5:])
+	}
+
+	for n := r.Buffered(); ; n = r.Buffered() + 1 {
+		if n > r.Size() {
+			return ""
+		}
+		head, err := r.Peek(n)
+		if err != nil {
+			return ""
+		}
+		if !bytes.Contains(head, []byte("\r\n\r\n")) {
+			continue
+		}
+		req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(head)))
+		if err != nil {
+			return ""
+		}
+		host := req.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		return strings.Trim(host, "[]")
+	}
+}
+
+// serverName returns the server name indication of the ClientHello in msg,
+// or "" if msg is not a ClientHello with a host name.
+func serverName(msg []byte) string {
+	s := cryptobyte.String(msg)
+	var (
+		msgType uint8
+		hello   cryptobyte.String
+		skip    cryptobyte.String
+		exts    cryptobyte.String
+	)
+	if !s.ReadUint8(&msgType) || msgType != 1 ||
+		!s.ReadUint24LengthPrefixed(&hello) ||
+		!hello.Skip(2+32) || // version, random
+		!hello.ReadUint8LengthPrefixed(&skip) || // session id
+		!hello.ReadUint16LengthPrefixed(&skip) || // cipher suites
+		!hello.ReadUint8LengthPrefixed(&skip) || // compression methods
+		!hello.ReadUint16LengthPrefixed(&exts) {
+		return ""
+	}
+	for !exts.Empty() {
+		var (
+			extType uint16
+			ext     cryptobyte.String
+		)
+		if !exts.ReadUint16(&extType) || !exts.ReadUint16LengthPrefixed(&ext) {
+			return ""
+		}
+		if extType != 0 { // server_name
+			continue
+		}
+		var names cryptobyte.String
+		if !ext.ReadUint16LengthPrefixed(&names) {
+			return ""
+		}
+		for !names.Empty() {
+			var (
+				nameType uint8
+				name     cryptobyte.String
+			)
+			if !names.ReadUint8(&nameType) || !names.ReadUint16LengthPrefixed(&name) {
+				return ""
+			}
+			if nameType == 0 { // host_name
+				return string(name)
+			}
+		}
+	}
+	return ""
+}
@@ -0,0 +1,240 @@
+package h2go
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"time"
+
+	"golang.org/x/crypto/acme"
+)
+
+// loadCertPool reads PEM certificates from path into a pool. If withSystem is
+// set, the certificates are added on top of the system pool.
+func loadCertPool(path string, withSystem bool) (*x509.CertPool, error) {
+	pool := x509.NewCertPool()
+	if withSystem {
+		if sys, err := x509.SystemCertPool(); err == nil {
+			pool = sys
+		}
+	}
+	pem, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading CA file: %w", err)
+	}
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", path)
+	}
+	return pool, nil
+}
+
+// newTLSConfig builds the TLS configuration used to reach the server from the
+// client's TLS options.
+func (c *Client) newTLSConfig() (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		NextProtos: []string{"h2", "http/1.1"},
+	}
+	if c.caPath != "" {
+		pool, err := loadCertPool(c.caPath, true)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if c.certPath != "" || c.keyPath != "" {
+		cert, err := tls.LoadX509KeyPair(c.certPath, c.keyPath)
+		if err != nil {
+			return nil, fmt.Errorf("error loading client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	if len(c.pins) > 0 {
+		// the pins replace chain verification, so pinned self-signed
+		// certificates are accepted as well
+		tlsConfig.InsecureSkipVerify = true
+		tlsConfig.VerifyConnection = verifyPins(c.pins)
+	}
+	return tlsConfig, nil
+}
+
+// newTLSConfig builds the TLS configuration of the HTTPS listener from the
+// server's TLS options.
+func (s *ProxyServer) newTLSConfig() (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		NextProtos: []string{"h2", "http/1.1"},
+	}
+	if s.clientCAPath != "" {
+		pool, err := loadCertPool(s.clientCAPath, false)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	m, err := s.acmeManager()
+	if err != nil {
+		return nil, err
+	}
+	if certs := s.certFiles(); certs != nil {
+		if err := certs.Reload(); err != nil {
+			return nil, err
+		}
+		tlsConfig.GetCertificate = certs.GetCertificate
+	}
+	if m != nil {
+		// answer TLS-ALPN-01 challenges on the HTTPS listener itself
+		tlsConfig.GetCertificate = m.GetCertificate
+		tlsConfig.NextProtos = append(tlsConfig.NextProtos, acme.ALPNProto)
+		if tlsConfig.ClientAuth != tls.NoClientCert {
+			// the CA's validation server has no client certificate. It
+			// only offers acme-tls/1, and nothing else can be negotiated
+			// without one, so the proxy stays behind the client CA.
+			challengeConfig := tlsConfig.Clone()
+			challengeConfig.ClientAuth = tls.NoClientCert
+			challengeConfig.NextProtos = []string{acme.ALPNProto}
+			tlsConfig.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+				if slices.Equal(hello.SupportedProtos, []string{acme.ALPNProto}) {
+					return challengeConfig, nil
+				}
+				return nil, nil
+			}
+		}
+	}
+	return tlsConfig, nil
+}
+
+// peerCertificate returns the verified client certificate of the request, if
+// any.
+func peerCertificate(r *http.Request) *x509.Certificate {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	return r.TLS.VerifiedChains[0][0]
+}
+
+// CertificateIdentity returns the identity a client certificate stands for:
+// its subject common name, or else its first DNS, email or URI SAN.
+func CertificateIdentity(cert *x509.Certificate) string {
+	switch {
+	case cert.Subject.CommonName != "":
+		return cert.Subject.CommonName
+	case len(cert.DNSNames) > 0:
+		return cert.DNSNames[0]
+	case len(cert.EmailAddresses) > 0:
+		return cert.EmailAddresses[0]
+	case len(cert.URIs) > 0:
+		return cert.URIs[0].String()
+	}
+	return ""
+}
+
+// ReloadCertificates reloads the server's certificate files from disk, e.g.
+// on SIGHUP. Certificates are also reloaded automatically when the files
+// change; see WithCertReloadInterval.
+func (s *ProxyServer) ReloadCertificates() error {
+	certs := s.certFiles()
+	if certs == nil {
+		return errors.New("no certificate files are in use")
+	}
+	return certs.Reload()
+}
+
+// certFiles returns the loader of the certificate files set with WithTLSCert
+// and WithTLSCertPair, creating it on first use, or nil if there are none or
+// the certificates are obtained with ACME.
+func (s *ProxyServer) certFiles() *certLoader {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.certs != nil || len(s.acme.domains) > 0 {
+		return s.certs
+	}
+	var pairs []certPair
+	if s.certPath != "" {
+		pairs = append(pairs, certPair{certPath: s.certPath, keyPath: s.keyPath})
+	}
+	pairs = append(pairs, s.extraCerts...)
+	if len(pairs) > 0 {
+		s.certs = newCertLoader(pairs, s.certExpiryWarning, s.logger)
+	}
+	return s.certs
+}
+
+// SelfSignedCertificate returns a new self-signed certificate for hosts,
+// which are host names or IP addresses, valid for a year from now. It is
+// meant for local listeners whose clients pin or explicitly trust it, e.g.
+// with SPKIPin.
+func SelfSignedCertificate(hosts ...string) (tls.Certificate, error) {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	serialNumber, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	notBefore := time.Now().Add(-time.Hour)
+	template := x509.Certificate{
+		SerialNumber:          serialNumber,
+		Subject:               pkix.Name{CommonName: "h2go local proxy"},
+		NotBefore:             notBefore,
+		NotAfter:              notBefore.Add(366 * 24 * time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, priv.Public(), priv)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: priv, Leaf: leaf}, nil
+}
+
+// localTLSConfig returns the TLS configuration of a local listener on addr
+// with the certificate and key files, or with a self-signed certificate for
+// the host of addr, and localhost if it is unspecified, if both are empty.
+func localTLSConfig(addr, certFile, keyFile string) (*tls.Config, error) {
+	var cert tls.Certificate
+	var err error
+	if certFile != "" || keyFile != "" {
+		cert, err = tls.LoadX509KeyPair(certFile, keyFile)
+	} else {
+		hosts := []string{"localhost", "127.0.0.1", "::1"}
+		if host, _, splitErr := net.SplitHostPort(addr); splitErr == nil && host != "" {
+			ip := net.ParseIP(host)
+			if (ip == nil || !ip.IsUnspecified()) && !slices.Contains(hosts, host) {
+				hosts = append(hosts, host)
+			}
+		}
+		cert, err = SelfSignedCertificate(hosts...)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error loading local listener certificate: %w", err)
+	}
+	return &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{cert},
+	}, nil
+}
@@ -0,0 +1,492 @@
+package h2go
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/proxy"
+)
+
+// testCert is a certificate and key written to disk for TLS tests.
+type testCert struct {
+	cert     *x509.Certificate
+	key      *ecdsa.PrivateKey
+	certPath string
+	keyPath  string
+}
+
+// newTestCert issues a certificate for cn, signed by parent, or self-signed
+// as a CA if parent is nil.
+func newTestCert(t *testing.T, parent *testCert, cn string, usage x509.ExtKeyUsage) *testCert {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+		DNSNames:     []string{cn},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	signer, signerKey := tmpl, key
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+		tmpl.KeyUsage |= x509.KeyUsageCertSign
+		tmpl.ExtKeyUsage = nil
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	tc := &testCert{
+		cert:     cert,
+		key:      key,
+		certPath: filepath.Join(dir, "cert.pem"),
+		keyPath:  filepath.Join(dir, "key.pem"),
+	}
+	if err := os.WriteFile(tc.certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(tc.keyPath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return tc
+}
+
+// newTestTLSProxyServer starts an HTTPS ProxyServer using serverCert and
+// returns it with its base URL.
+func newTestTLSProxyServer(t *testing.T, serverCert *testCert, opts ...ServerOption) (*ProxyServer, string) {
+	t.Helper()
+	s := NewProxyServer(opts...)
+	s.registerHandlers()
+	tlsConfig, err := s.newTLSConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := tls.LoadX509KeyPair(serverCert.certPath, serverCert.keyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tlsConfig.Certificates = []tls.Certificate{cert}
+
+	ts := httptest.NewUnstartedServer(s.mux)
+	ts.EnableHTTP2 = true
+	ts.TLS = tlsConfig
+	ts.StartTLS()
+	t.Cleanup(ts.Close)
+	return s, ts.URL
+}
+
+func TestMutualTLS(t *testing.T) {
+	ca := newTestCert(t, nil, "test-ca", 0)
+	serverCert := newTestCert(t, ca, "server", x509.ExtKeyUsageServerAuth)
+	clientCert := newTestCert(t, ca, "device-1", x509.ExtKeyUsageClientAuth)
+
+	var identity string
+	_, url := newTestTLSProxyServer(t, serverCert,
+		WithClientCA(ca.certPath),
+		WithClientCertAuth(true),
+		WithACL(ACLFunc(func(req *TunnelRequest) error {
+			identity = req.Client
+			return nil
+		})),
+	)
+	target := strings.TrimPrefix(url, "https://")
+
+	// no secret: the certificate alone authenticates the client
+	client := NewClient(
+		WithServerURL(url),
+		WithServerCA(ca.certPath),
+		WithClientCertificate(clientCert.certPath, clientCert.keyPath),
+		WithInterval(time.Millisecond*20),
+	)
+	conn, err := client.Connect(target)
+	if err != nil {
+		t.Fatalf("Connect() error = %v", err)
+	}
+	conn.Close()
+	if identity != "device-1" {
+		t.Errorf("identity = %q, want %q", identity, "device-1")
+	}
+
+	// without a certificate the handshake fails
+	client = NewClient(
+		WithServerURL(url),
+		WithServerCA(ca.certPath),
+		WithSecret(testSecret),
+	)
+	if _, err := client.Connect(target); err == nil {
+		t.Fatal("Connect() without client certificate succeeded")
+	}
+}
+
+func TestClientTLSConfigError(t *testing.T) {
+	client := NewClient(
+		WithServerURL("https://localhost"),
+		WithClientCertificate("/nonexistent/cert.pem", "/nonexistent/key.pem"),
+	)
+	if _, err := client.Connect("localhost:443"); err == nil {
+		t.Fatal("Connect() with a missing certificate succeeded")
+	}
+}
+
+func TestACLForbidden(t *testing.T) {
+	_, url := newTestProxyServer(t, WithACL(ACLFunc(func(req *TunnelRequest) error {
+		return errors.New("destination not allowed")
+	})))
+
+	client := NewClient(
+		WithServerURL(url),
+		WithSecret(testSecret),
+	)
+	_, err := client.Connect(strings.TrimPrefix(url, "http://"))
+	if !errors.Is(err, ErrForbidden) {
+		t.Fatalf("Connect() error = %v, want %v", err, ErrForbidden)
+	}
+}
+
+func TestCertificateIdentity(t *testing.T) {
+	cert := &x509.Certificate{Subject: pkix.Name{CommonName: "alice"}, DNSNames: []string{"alice.example.com"}}
+	if got := CertificateIdentity(cert); got != "alice" {
+		t.Errorf("CertificateIdentity() = %q, want %q", got, "alice")
+	}
+	cert.Subject.CommonName = ""
+	if got := CertificateIdentity(cert); got != "alice.example.com" {
+		t.Errorf("CertificateIdentity() = %q, want %q", got, "alice.example.com")
+	}
+}
+
+func TestACMETLSConfig(t *testing.T) {
+	ca := newTestCert(t, nil, "test-ca", 0)
+	s := NewProxyServer(
+		WithACME("proxy.example.com"),
+		WithACMECacheDir(t.TempDir()),
+		WithClientCA(ca.certPath),
+	)
+	tlsConfig, err := s.newTLSConfig()
+	if err != nil {
+		t.Fatalf("newTLSConfig() error = %v", err)
+	}
+	if tlsConfig.GetCertificate == nil {
+		t.Fatal("GetCertificate is not set")
+	}
+	if !slices.Contains(tlsConfig.NextProtos, acme.ALPNProto) {
+		t.Errorf("NextProtos = %v, want %s included", tlsConfig.NextProtos, acme.ALPNProto)
+	}
+	if _, err := tlsConfig.GetCertificate(&tls.ClientHelloInfo{ServerName: "other.example.com"}); err == nil {
+		t.Error("GetCertificate() issued a certificate for a domain not configured")
+	}
+
+	challenge, err := tlsConfig.GetConfigForClient(&tls.ClientHelloInfo{SupportedProtos: []string{acme.ALPNProto}})
+	if err != nil || challenge == nil || challenge.ClientAuth != tls.NoClientCert {
+		t.Error("TLS-ALPN-01 challenges should not require a client certificate")
+	}
+	if !slices.Equal(challenge.NextProtos, []string{acme.ALPNProto}) {
+		t.Errorf("challenge NextProtos = %v, want only %s", challenge.NextProtos, acme.ALPNProto)
+	}
+}
+
+func TestACMEChallengeNoClientCertBypass(t *testing.T) {
+	ca := newTestCert(t, nil, "test-ca", 0)
+	serverCert := newTestCert(t, ca, "proxy.example.com", x509.ExtKeyUsageServerAuth)
+	// a certificate in the cache keeps the CA from being asked
+	cacheDir := t.TempDir()
+	var cached []byte
+	for _, path := range []string{serverCert.keyPath, serverCert.certPath} {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cached = append(cached, data...)
+	}
+	if err := os.WriteFile(filepath.Join(cacheDir, "proxy.example.com"), cached, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	s := NewProxyServer(
+		WithACME("proxy.example.com"),
+		WithACMECacheDir(cacheDir),
+		WithClientCA(ca.certPath),
+	)
+	tlsConfig, err := s.newTLSConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", tlsConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				conn.(*tls.Conn).Handshake()
+				conn.Read(make([]byte, 1))
+			}()
+		}
+	}()
+
+	// a hello without a certificate must not reach the proxy by offering
+	// acme-tls/1 next to h2
+	conn, err := tls.Dial("tcp", ln.Addr().String(), &tls.Config{
+		ServerName:         "proxy.example.com",
+		InsecureSkipVerify: true,
+		NextProtos:         []string{acme.ALPNProto, "h2"},
+	})
+	if err == nil {
+		// TLS 1.3 clients learn about a rejected certificate on first read
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		_, err = conn.Read(make([]byte, 1))
+		conn.Close()
+	}
+	if err == nil || errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("handshake without a client certificate error = %v, want a failure", err)
+	}
+}
+
+// TestACMEPebble obtains a certificate from a Pebble test CA, see
+// https://github.com/letsencrypt/pebble. It runs when H2GO_PEBBLE_DIRECTORY
+// is the directory URL, e.g. https://localhost:14000/dir, and H2GO_PEBBLE_CA
+// the file of the CA that signs it, e.g. pebble.minica.pem. The server
+// listens on the ports Pebble validates by default: 5001 for TLS-ALPN-01 and
+// 5002 for HTTP-01. H2GO_PEBBLE_DOMAIN defaults to localhost.
+func TestACMEPebble(t *testing.T) {
+	directory, directoryCA := os.Getenv("H2GO_PEBBLE_DIRECTORY"), os.Getenv("H2GO_PEBBLE_CA")
+	if directory == "" || directoryCA == "" {
+		t.Skip("set H2GO_PEBBLE_DIRECTORY and H2GO_PEBBLE_CA to test against Pebble")
+	}
+	domain := os.Getenv("H2GO_PEBBLE_DOMAIN")
+	if domain == "" {
+		domain = "localhost"
+	}
+	s := NewProxyServer(
+		WithListenAddr(":5001"),
+		WithServerSecret(testSecret),
+		WithACME(domain),
+		WithACMECacheDir(t.TempDir()),
+		WithACMEDirectory(directory),
+		WithACMEDirectoryCA(directoryCA),
+		WithACMEHTTPAddr(":5002"),
+	)
+	go s.ListenAndServe()
+	waitListening(t, "tcp", "127.0.0.1:5001")
+
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: time.Minute}, "tcp", "127.0.0.1:5001", &tls.Config{
+		ServerName: domain,
+		// the roots of Pebble change on every start
+		InsecureSkipVerify: true,
+	})
+	if err != nil {
+		t.Fatalf("handshake error = %v", err)
+	}
+	defer conn.Close()
+	leaf := conn.ConnectionState().PeerCertificates[0]
+	if err := leaf.VerifyHostname(domain); err != nil || !strings.Contains(leaf.Issuer.CommonName, "Pebble") {
+		t.Errorf("certificate for %v issued by %q, want %s from Pebble", leaf.DNSNames, leaf.Issuer.CommonName, domain)
+	}
+}
+
+func TestPinnedSPKI(t *testing.T) {
+	serverCert := newTestCert(t, nil, "self-signed", 0)
+	_, url := newTestTLSProxyServer(t, serverCert, WithServerSecret(testSecret))
+	target := strings.TrimPrefix(url, "https://")
+	other := newTestCert(t, nil, "other", 0)
+
+	// the pin alone is enough to trust a self-signed certificate,
+	// and the other pin allows for rotation
+	client := NewClient(
+		WithServerURL(url),
+		WithSecret(testSecret),
+		WithPinnedSPKI("sha256/"+SPKIPin(other.cert), SPKIPin(serverCert.cert)),
+	)
+	conn, err := client.Connect(target)
+	if err != nil {
+		t.Fatalf("Connect() error = %v", err)
+	}
+	conn.Close()
+
+	client = NewClient(
+		WithServerURL(url),
+		WithSecret(testSecret),
+		WithPinnedSPKI(SPKIPin(other.cert)),
+	)
+	if _, err := client.Connect(target); !errors.Is(err, ErrPinMismatch) {
+		t.Fatalf("Connect() error = %v, want %v", err, ErrPinMismatch)
+	}
+}
+
+func TestPinnedCA(t *testing.T) {
+	ca := newTestCert(t, nil, "pinned-ca", 0)
+	issued := newTestCert(t, ca, "server", x509.ExtKeyUsageServerAuth)
+	attacker := newTestCert(t, nil, "attacker", 0)
+
+	// chainFile writes cert followed by the certificate of ca
+	chainFile := func(cert *testCert) *testCert {
+		chain := *cert
+		chain.certPath = filepath.Join(t.TempDir(), "chain.pem")
+		data, _ := os.ReadFile(cert.certPath)
+		caData, _ := os.ReadFile(ca.certPath)
+		if err := os.WriteFile(chain.certPath, append(data, caData...), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		return &chain
+	}
+
+	for _, tt := range []struct {
+		name   string
+		server *testCert
+		ok     bool
+	}{
+		{"issued by the pinned CA", chainFile(issued), true},
+		{"pinned CA appended to another chain", chainFile(attacker), false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			_, url := newTestTLSProxyServer(t, tt.server, WithServerSecret(testSecret))
+			client := NewClient(
+				WithServerURL(url),
+				WithSecret(testSecret),
+				WithPinnedSPKI(SPKIPin(ca.cert)),
+			)
+			conn, err := client.Connect(strings.TrimPrefix(url, "https://"))
+			if tt.ok && err != nil {
+				t.Fatalf("Connect() error = %v", err)
+			}
+			if !tt.ok && !errors.Is(err, ErrPinMismatch) {
+				t.Fatalf("Connect() error = %v, want %v", err, ErrPinMismatch)
+			}
+			if conn != nil {
+				conn.Close()
+			}
+		})
+	}
+}
+
+func TestNormalizePin(t *testing.T) {
+	pin := "/" + strings.Repeat("A", pinLen-2) + "="
+	for _, in := range []string{pin, "sha256/" + pin, "sha256//" + pin} {
+		if got := normalizePin(in); got != pin {
+			t.Errorf("normalizePin(%q) = %q, want %q", in, got, pin)
+		}
+	}
+}
+
+func TestLocalServerTLS(t *testing.T) {
+	echo := startEcho(t)
+	cert, err := SelfSignedCertificate("127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(cert.Leaf)
+
+	addr := freeAddr(t)
+	s := NewLocalServer(
+		WithHTTPHandler(Direct{}),
+		WithSocks5Handler(Direct{}),
+		WithLocalTLS(&tls.Config{Certificates: []tls.Certificate{cert}}),
+		WithLocalListenAddr(addr),
+	)
+	go s.ListenAndServe()
+	waitListening(t, "tcp", addr)
+
+	dial := func(t *testing.T, protos ...string) *tls.Conn {
+		t.Helper()
+		conn, err := tls.Dial("tcp", addr, &tls.Config{RootCAs: roots, NextProtos: protos})
+		if err != nil {
+			t.Fatalf("tls.Dial() error = %v", err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		return conn
+	}
+
+	t.Run("http/1.1", func(t *testing.T) {
+		conn := dial(t, "http/1.1")
+		if p := conn.ConnectionState().NegotiatedProtocol; p != "http/1.1" {
+			t.Fatalf("negotiated %q, want http/1.1", p)
+		}
+		io.WriteString(conn, "CONNECT "+echo+" HTTP/1.1\r\nHost: "+echo+"\r\n\r\n")
+		br := bufio.NewReader(conn)
+		res, err := http.ReadResponse(br, nil)
+		if err != nil || res.StatusCode != http.StatusOK {
+			t.Fatalf("CONNECT response = %v, %v", res, err)
+		}
+		checkEcho(t, &readerConn{Conn: conn, r: br})
+	})
+
+	t.Run("h2", func(t *testing.T) {
+		tr := &http2.Transport{
+			// h2Tunnel asks for http:// URLs, which still go through dial
+			AllowHTTP: true,
+			DialTLSContext: func(ctx context.Context, network, _ string, _ *tls.Config) (net.Conn, error) {
+				return dial(t, "h2"), nil
+			},
+		}
+		defer tr.CloseIdleConnections()
+		checkTunnelEcho(t, h2Tunnel(t, tr, echo, ""))
+	})
+
+	t.Run("socks5", func(t *testing.T) {
+		conn := dial(t)
+		dialer, err := proxy.SOCKS5("tcp", addr, nil, dialerFunc(func(network, addr string) (net.Conn, error) {
+			return conn, nil
+		}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		tunnel, err := dialer.Dial("tcp", echo)
+		if err != nil {
+			t.Fatalf("Dial() error = %v", err)
+		}
+		checkEcho(t, tunnel)
+	})
+}
+
+// dialerFunc adapts a function to proxy.Dialer.
+type dialerFunc func(network, addr string) (net.Conn, error)
+
+func (f dialerFunc) Dial(network, addr string) (net.Conn, error) { return f(network, addr) }
@@ -0,0 +1,84 @@
+package h2go
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+// ErrTransparentNotSupported is returned by transparent listeners on
+// platforms other than Linux.
+var ErrTransparentNotSupported = errors.New("transparent proxy is only supported on Linux")
+
+// sniffTimeout bounds the wait for the first bytes of a transparently
+// proxied connection. Protocols where the server speaks first send nothing,
+// so their connections go to the original IP address after it.
+const sniffTimeout = 300 * time.Millisecond
+
+// handleTransparent serves a connection redirected to a transparent
+// listener, sending it to the destination the client originally dialed.
+func (s *LocalServer) handleTransparent(conn net.Conn, l *Listener) error {
+	if l.Protocol == ProtocolTProxy {
+		// TPROXY keeps the original destination as the local address
+		dst, ok := conn.LocalAddr().(*net.TCPAddr)
+		if !ok {
+			return fmt.Errorf("original destination: %w", ErrNotSupportedProtocol)
+		}
+		return s.serveTransparent(conn, dst, l)
+	}
+	dst, err := originalDst(conn)
+	if err != nil {
+		return fmt.Errorf("original destination: %w", err)
+	}
+	return s.serveTransparent(conn, dst, l)
+}
+
+// serveTransparent connects conn to dst, or to the host name sniffed from
+// the client's first bytes on dst's port if l sniffs.
+func (s *LocalServer) serveTransparent(conn net.Conn, dst *net.TCPAddr, l *Listener) error {
+	if isListenerAddr(dst, l.bound) {
+		// connecting to the listener itself would loop forever
+		return fmt.Errorf("%s is not a redirected connection", dst)
+	}
+	handler := s.handlerFor(l, s.Socks5Handler)
+	if handler == nil {
+		return ErrNotSupportedProtocol
+	}
+
+	br := bufio.NewReaderSize(conn, maxSniffLen)
+	host := dst.IP.String()
+	if l.Sniff {
+		conn.SetReadDeadline(time.Now().Add(sniffTimeout))
+		if name := sniffHost(br); name != "" {
+			host = name
+		}
+		conn.SetReadDeadline(time.Time{})
+	}
+	addr := net.JoinHostPort(host, strconv.Itoa(dst.Port))
+
+	conn2, err := s.connect(handler, conn, &ConnectRequest{Addr: addr, Protocol: l.Protocol})
+	if err != nil {
+		return err
+	}
+	defer handler.Clean()
+	defer conn2.Close()
+	s.Logger.Info("transparent",
+		"local", conn.RemoteAddr().String(),
+		"dst", dst.String(),
+		"remote", addr)
+	return s.transport(struct {
+		io.Reader
+		io.Writer
+	}{br, conn}, conn2)
+}
+
+// isListenerAddr reports whether dst is the address the listener is bound
+// to, as it is for connections made to the listener directly.
+func isListenerAddr(dst *net.TCPAddr, bound net.Addr) bool {
+	l, ok := bound.(*net.TCPAddr)
+	return ok && l.Port == dst.Port && (l.IP.IsUnspecified() || l.IP.Equal(dst.IP))
+}
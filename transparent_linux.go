@@ -0,0 +1,82 @@
+//go:build linux
+
+package h2go
+
+import (
+	"encoding/binary"
+	"net"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// originalDst returns the destination a connection redirected by an
+// iptables REDIRECT rule was originally sent to.
+func originalDst(conn net.Conn) (*net.TCPAddr, error) {
+	tc, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil, ErrNotSupportedProtocol
+	}
+	raw, err := tc.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	var (
+		dst    *net.TCPAddr
+		optErr error
+	)
+	err = raw.Control(func(fd uintptr) {
+		dst, optErr = getOriginalDst(int(fd), conn.LocalAddr().(*net.TCPAddr).IP.To4() == nil)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return dst, optErr
+}
+
+// getOriginalDst reads SO_ORIGINAL_DST from fd. The kernel fills a
+// sockaddr_in or sockaddr_in6, which the getsockopt helpers of the same
+// size read for us.
+func getOriginalDst(fd int, ipv6 bool) (*net.TCPAddr, error) {
+	var port [2]byte
+	if ipv6 {
+		info, err := unix.GetsockoptIPv6MTUInfo(fd, unix.SOL_IPV6, unix.SO_ORIGINAL_DST)
+		if err != nil {
+			return nil, err
+		}
+		binary.NativeEndian.PutUint16(port[:], info.Addr.Port)
+		return &net.TCPAddr{
+			IP:   net.IP(info.Addr.Addr[:]),
+			Port: int(binary.BigEndian.Uint16(port[:])),
+		}, nil
+	}
+	mreq, err := unix.GetsockoptIPv6Mreq(fd, unix.SOL_IP, unix.SO_ORIGINAL_DST)
+	if err != nil {
+		return nil, err
+	}
+	// family(2) port(2) addr(4)
+	return &net.TCPAddr{
+		IP:   net.IPv4(mreq.Multiaddr[4], mreq.Multiaddr[5], mreq.Multiaddr[6], mreq.Multiaddr[7]),
+		Port: int(binary.BigEndian.Uint16(mreq.Multiaddr[2:4])),
+	}, nil
+}
+
+// transparentControl marks a listening socket with IP_TRANSPARENT so that it
+// accepts connections TPROXY rules send to it. It needs CAP_NET_ADMIN.
+func transparentControl(network, address string, c syscall.RawConn) error {
+	var optErr error
+	err := c.Control(func(fd uintptr) {
+		if network == "tcp6" {
+			optErr = unix.SetsockoptInt(int(fd), unix.SOL_IPV6, unix.IPV6_TRANSPARENT, 1)
+		} else {
+			optErr = unix.SetsockoptInt(int(fd), unix.SOL_IP, unix.IP_TRANSPARENT, 1)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	if optErr != nil {
+		return &net.OpError{Op: "setsockopt", Net: network, Err: optErr}
+	}
+	return nil
+}
@@ -0,0 +1,16 @@
+//go:build !linux
+
+package h2go
+
+import (
+	"net"
+	"syscall"
+)
+
+func originalDst(conn net.Conn) (*net.TCPAddr, error) {
+	return nil, ErrTransparentNotSupported
+}
+
+func transparentControl(network, address string, c syscall.RawConn) error {
+	return ErrTransparentNotSupported
+}
@@ -0,0 +1,98 @@
+package h2go
+
+import (
+	"bufio"
+	"crypto/tls"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSniffHost(t *testing.T) {
+	tlsHello := func() io.Reader {
+		client, server := net.Pipe()
+		go func() {
+			tls.Client(client, &tls.Config{ServerName: "tls.example.com"}).Handshake()
+		}()
+		t.Cleanup(func() {
+			client.Close()
+			server.Close()
+		})
+		return server
+	}
+
+	tests := []struct {
+		name string
+		r    io.Reader
+		want string
+	}{
+		{"tls", tlsHello(), "tls.example.com"},
+		{"http", strings.NewReader("GET / HTTP/1.1\r\nHost: web.example.com:8080\r\n\r\n"), "web.example.com"},
+		{"incomplete http", strings.NewReader("GET / HTTP/1.1\r\nHost: web.example.com"), ""},
+		{"other", strings.NewReader("SSH-2.0-OpenSSH_9.6\r\n"), ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := sniffHost(bufio.NewReaderSize(tt.r, maxSniffLen)); got != tt.want {
+				t.Errorf("sniffHost() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// echoHandler connects every address to an echo server, recording the
+// addresses it was asked for.
+type echoHandler struct {
+	echo  string
+	addrs chan string
+}
+
+func (h *echoHandler) Connect(addr string) (io.ReadWriteCloser, error) {
+	h.addrs <- addr
+	return net.Dial("tcp", h.echo)
+}
+
+func (h *echoHandler) Clean() {}
+
+func TestServeTransparent(t *testing.T) {
+	h := &echoHandler{echo: startEcho(t), addrs: make(chan string, 1)}
+	s := NewLocalServer(WithSocks5Handler(h))
+	dst := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 80}
+
+	tests := []struct {
+		name  string
+		l     *Listener
+		write string
+		want  string
+	}{
+		{"ip", &Listener{Protocol: ProtocolRedirect}, "ping", "192.0.2.1:80"},
+		{"sniffed", &Listener{Protocol: ProtocolRedirect, Sniff: true},
+			"GET / HTTP/1.1\r\nHost: web.example.com\r\n\r\n", "web.example.com:80"},
+		{"server speaks first", &Listener{Protocol: ProtocolTProxy, Sniff: true}, "", "192.0.2.1:80"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, conn := net.Pipe()
+			defer client.Close()
+			go s.serveTransparent(conn, dst, tt.l)
+
+			client.Write([]byte(tt.write))
+			select {
+			case addr := <-h.addrs:
+				if addr != tt.want {
+					t.Errorf("connected to %s, want %s", addr, tt.want)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("handler not called")
+			}
+			if tt.write != "" {
+				buf := make([]byte, len(tt.write))
+				if _, err := io.ReadFull(client, buf); err != nil || string(buf) != tt.write {
+					t.Errorf("echo = %q, %v, want %q", buf, err, tt.write)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,49 @@
+package h2go
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+// Ensure Client can be used as a dialer of golang.org/x/net/proxy.
+var (
+	_ proxy.Dialer        = (*Client)(nil)
+	_ proxy.ContextDialer = (*Client)(nil)
+)
+
+// Dial connects to addr through the proxy server. It is DialContext with
+// a background context, and makes Client a proxy.Dialer.
+func (c *Client) Dial(network, addr string) (net.Conn, error) {
+	return c.DialContext(context.Background(), network, addr)
+}
+
+// NewTransport returns an http.Transport that connects to every destination
+// through c, without a LocalServer. Requests to https URLs are encrypted
+// end-to-end: the TLS handshake with the destination runs inside the
+// tunnel, so the proxy server only relays ciphertext. The Proxy field is
+// unset, so proxy environment variables are ignored.
+//
+// Example:
+//
+//	httpClient := &http.Client{Transport: h2go.NewTransport(client)}
+//	res, err := httpClient.Get("https://example.com")
+func NewTransport(c *Client) *http.Transport {
+	return &http.Transport{
+		DialContext:           c.DialContext,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: time.Second,
+	}
+}
+
+// NewTunneledHTTPClient returns an http.Client whose requests go through c,
+// using NewTransport.
+func NewTunneledHTTPClient(c *Client) *http.Client {
+	return &http.Client{Transport: NewTransport(c)}
+}
@@ -0,0 +1,73 @@
+package h2go
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"golang.org/x/net/proxy"
+)
+
+func TestNewTransport(t *testing.T) {
+	client := startReverseServer(t)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Proto+" "+r.URL.Path)
+	})
+
+	plain := httptest.NewServer(handler)
+	defer plain.Close()
+	tlsServer := httptest.NewUnstartedServer(handler)
+	tlsServer.EnableHTTP2 = true
+	tlsServer.StartTLS()
+	defer tlsServer.Close()
+
+	tests := []struct {
+		name   string
+		server *httptest.Server
+		path   string
+		want   string
+	}{
+		{name: "http", server: plain, path: "/plain", want: "HTTP/1.1 /plain"},
+		{name: "https", server: tlsServer, path: "/tls", want: "HTTP/2.0 /tls"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			transport := NewTransport(client)
+			if tt.server.TLS != nil {
+				// trust the test certificate, the handshake runs through the tunnel
+				transport.TLSClientConfig = tt.server.Client().Transport.(*http.Transport).TLSClientConfig.Clone()
+			}
+			res, err := (&http.Client{Transport: transport}).Get(tt.server.URL + tt.path)
+			if err != nil {
+				t.Fatalf("Get() error = %v", err)
+			}
+			defer res.Body.Close()
+			body, _ := io.ReadAll(res.Body)
+			if string(body) != tt.want {
+				t.Errorf("body = %q, want %q", body, tt.want)
+			}
+		})
+	}
+}
+
+func TestClientProxyDialer(t *testing.T) {
+	echo := startEcho(t)
+	client := startReverseServer(t)
+
+	var dialer proxy.ContextDialer = client
+	conn, err := dialer.DialContext(context.Background(), "tcp", echo)
+	if err != nil {
+		t.Fatalf("DialContext() error = %v", err)
+	}
+	checkEcho(t, conn)
+	conn.Close()
+
+	conn, err = proxy.Dialer(client).Dial("tcp", echo)
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	checkEcho(t, conn)
+	conn.Close()
+}